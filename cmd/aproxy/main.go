@@ -1,19 +1,25 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"aproxy/internal/config"
 	"aproxy/internal/database"
 	"aproxy/internal/logger"
+	"aproxy/pkg/admin"
 	"aproxy/pkg/manager"
 	"aproxy/pkg/proxy"
+	"aproxy/pkg/rules"
 )
 
 var (
@@ -89,7 +95,57 @@ func main() {
 		log.Fatal("Failed to start proxy manager: %v", err)
 	}
 
-	server := proxy.NewServer(mgr, cfg.Server)
+	engine, err := rules.NewEngine(cfg.Rules, cfg.Upstreams)
+	if err != nil {
+		log.Fatal("Failed to load routing rules: %v", err)
+	}
+	// Each extra listener's rules come before the top-level ones
+	listenerEngines := make([]*rules.Engine, len(cfg.Listeners))
+	for i, lc := range cfg.Listeners {
+		listenerEngines[i], err = rules.NewEngine(slices.Concat(lc.Rules, cfg.Rules), cfg.Upstreams)
+		if err != nil {
+			log.Fatal("Failed to load routing rules for listener %q: %v", lc.Name, err)
+		}
+	}
+	// Routing rules and upstreams reload when the config file changes
+	config.Watch(func(updated *config.Config) {
+		if err := engine.Update(updated.Rules, updated.Upstreams); err != nil {
+			log.ErrorBg("Keeping previous routing rules: %v", err)
+		}
+		for i, lc := range cfg.Listeners {
+			// Listeners themselves are fixed at startup; only rules reload
+			var listenerRules []config.RuleConfig
+			for _, ulc := range updated.Listeners {
+				if ulc.Name == lc.Name {
+					listenerRules = ulc.Rules
+				}
+			}
+			if err := listenerEngines[i].Update(slices.Concat(listenerRules, updated.Rules), updated.Upstreams); err != nil {
+				log.ErrorBg("Keeping previous routing rules for listener %q: %v", lc.Name, err)
+			}
+		}
+	})
+
+	server := proxy.NewServer(mgr, cfg.Server, engine)
+	if cfg.Server.MITM.Enabled {
+		if err := server.EnableMITM(cfg.Server.MITM); err != nil {
+			log.Fatal("Failed to set up TLS interception: %v", err)
+		}
+	}
+	if cfg.Server.TLS.Enabled {
+		if err := server.EnableTLS(cfg.Server.TLS); err != nil {
+			log.Fatal("Failed to set up the TLS listener: %v", err)
+		}
+	}
+	if cfg.Server.PAC.Enabled && cfg.Server.PAC.FailoverCount > 0 {
+		log.WarnBg("PAC failover is on: /proxy.pac lists %d pool proxy addresses without authentication", cfg.Server.PAC.FailoverCount)
+	}
+	if cfg.Admin.ListenAddr != "" {
+		// The management listener serves /stats and /proxies; keep them off the proxy port.
+		server.DisableManagement()
+	} else {
+		log.WarnBg("No admin.listen_addr set, serving /stats and /proxies on the proxy port")
+	}
 
 	go func() {
 		if err := server.Start(); err != nil {
@@ -98,6 +154,39 @@ func main() {
 	}()
 
 	log.InfoBg("Proxy server started on %s", cfg.Server.ListenAddr)
+
+	listeners := make([]*proxy.Server, len(cfg.Listeners))
+	for i, lc := range cfg.Listeners {
+		listeners[i], err = server.Listener(lc, listenerEngines[i])
+		if err != nil {
+			log.Fatal("Failed to set up listener: %v", err)
+		}
+		go func() {
+			if err := listeners[i].Start(); err != nil && err != http.ErrServerClosed {
+				log.ErrorBg("Listener %q error: %v", lc.Name, err)
+			}
+		}()
+		addr := lc.ListenAddr
+		if len(lc.Ports) > 0 {
+			ports := make([]string, len(lc.Ports))
+			for j, pc := range lc.Ports {
+				ports[j] = pc.Ports + "=" + pc.Preset
+			}
+			addr = fmt.Sprintf("%s ports %s", cmp.Or(lc.ListenHost, "*"), strings.Join(ports, ", "))
+		}
+		log.InfoBg("Listener %q (%s) started on %s", lc.Name, cmp.Or(lc.Protocol, "http"), addr)
+	}
+
+	var adminServer *admin.Server
+	if cfg.Admin.ListenAddr != "" {
+		adminServer = admin.NewServer(mgr, server, cfg.Admin)
+		go func() {
+			if err := adminServer.Start(); err != nil && err != http.ErrServerClosed {
+				log.ErrorBg("Management server error: %v", err)
+			}
+		}()
+		log.InfoBg("Management listener started on %s", cfg.Admin.ListenAddr)
+	}
 	log.InfoBg("Press Ctrl+C to stop")
 
 	c := make(chan os.Signal, 1)
@@ -113,9 +202,20 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	// Listeners first: the main server closes the transports they share
+	for i, l := range listeners {
+		if err := l.Stop(ctx); err != nil {
+			log.ErrorBg("Listener %q shutdown error: %v", cfg.Listeners[i].Name, err)
+		}
+	}
 	if err := server.Stop(ctx); err != nil {
 		log.ErrorBg("Server shutdown error: %v", err)
 	}
+	if adminServer != nil {
+		if err := adminServer.Stop(ctx); err != nil {
+			log.ErrorBg("Management server shutdown error: %v", err)
+		}
+	}
 
 	log.InfoBg("Shutdown complete")
 }
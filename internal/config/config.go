@@ -3,11 +3,13 @@ package config
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"aproxy/internal/logger"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
 )
@@ -20,25 +22,262 @@ type Config struct {
 	Scraper  ScraperConfig  `mapstructure:"scraper" validate:"required"`
 	Checker  CheckerConfig  `mapstructure:"checker" validate:"required"`
 	Database DatabaseConfig `mapstructure:"database" validate:"required"`
+	Admin    AdminConfig    `mapstructure:"admin"`
+	// Extra proxy ports alongside Server.ListenAddr, sharing its pool
+	Listeners []ListenerConfig `mapstructure:"listeners" validate:"unique=Name,dive"`
+
+	// Routing, hot-reloaded by Watch
+	Upstreams []UpstreamConfig `mapstructure:"upstreams" validate:"dive"`
+	Rules     []RuleConfig     `mapstructure:"rules" validate:"dive"`
 }
 
 type ServerConfig struct {
-	ListenAddr     string            `mapstructure:"listen_addr" validate:"required,hostname_port"`
-	ReadTimeout    time.Duration     `mapstructure:"read_timeout" validate:"required,min=1s,max=5m"`
-	WriteTimeout   time.Duration     `mapstructure:"write_timeout" validate:"required,min=1s,max=5m"`
-	IdleTimeout    time.Duration     `mapstructure:"idle_timeout" validate:"required,min=1s,max=10m"`
-	MaxConnections int               `mapstructure:"max_connections" validate:"required,min=1,max=10000"`
-	EnableHTTPS    bool              `mapstructure:"enable_https"`
-	MaxRetries     int               `mapstructure:"max_retries" validate:"required,min=1,max=10"`
-	StripHeaders   []string          `mapstructure:"strip_headers"`
-	AddHeaders     map[string]string `mapstructure:"add_headers"`
-	AuthToken      string            `mapstructure:"auth_token"`
+	ListenAddr     string               `mapstructure:"listen_addr" validate:"required,hostname_port"`
+	ReadTimeout    time.Duration        `mapstructure:"read_timeout" validate:"required,min=1s,max=5m"`
+	WriteTimeout   time.Duration        `mapstructure:"write_timeout" validate:"required,min=1s,max=5m"`
+	IdleTimeout    time.Duration        `mapstructure:"idle_timeout" validate:"required,min=1s,max=10m"`
+	MaxConnections int                  `mapstructure:"max_connections" validate:"required,min=1,max=10000"`
+	EnableHTTPS    bool                 `mapstructure:"enable_https"`
+	MaxRetries     int                  `mapstructure:"max_retries" validate:"required,min=1,max=10"`
+	StripHeaders   []string             `mapstructure:"strip_headers"`
+	AddHeaders     map[string]string    `mapstructure:"add_headers"`
+	AuthToken      string               `mapstructure:"auth_token"`
+	HealthEndpoint bool                 `mapstructure:"health_endpoint"`
+	PAC            PACConfig            `mapstructure:"pac"`
+	Hedge          HedgeConfig          `mapstructure:"hedge"`
+	Transport      TransportConfig      `mapstructure:"transport"`
+	Tunnel         TunnelConfig         `mapstructure:"tunnel"`
+	Admission      AdmissionConfig      `mapstructure:"admission"`
+	RateLimit      RateLimitConfig      `mapstructure:"rate_limit"`
+	BlockDetection BlockDetectionConfig `mapstructure:"block_detection"`
+	Cache          CacheConfig          `mapstructure:"cache"`
+	MITM           MITMConfig           `mapstructure:"mitm"`
+	HeaderProfiles HeaderProfilesConfig `mapstructure:"header_profiles"`
+	Via            ViaConfig            `mapstructure:"via"`
+	TLS            TLSListenerConfig    `mapstructure:"tls"`
+}
+
+// TLSListenerConfig serves the proxy port over TLS, so clients don't send
+// auth_token in the clear. CertFile and KeyFile are reloaded when they change;
+// with SelfSigned, a certificate is generated there if neither exists, for
+// development. ClientAuth "optional" or "require" asks clients for a
+// certificate signed by ClientCA, and a verified one stands in for auth_token.
+type TLSListenerConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	CertFile   string `mapstructure:"cert_file" validate:"required_if=Enabled true"`
+	KeyFile    string `mapstructure:"key_file" validate:"required_if=Enabled true"`
+	SelfSigned bool   `mapstructure:"self_signed"`
+	ClientAuth string `mapstructure:"client_auth" validate:"oneof=none optional require"`
+	ClientCA   string `mapstructure:"client_ca" validate:"required_unless=ClientAuth none"`
+}
+
+// ViaConfig sets how the Via header is handled in both directions: "strip"
+// removes it so targets and clients don't learn a proxy was involved, "keep"
+// passes it on unchanged, and "append" adds this hop as Pseudonym, as RFC 7230
+// asks of proxies. Pseudonym is a host-name-like token.
+type ViaConfig struct {
+	Mode      string `mapstructure:"mode" validate:"oneof=strip keep append"`
+	Pseudonym string `mapstructure:"pseudonym" validate:"required,hostname_rfc1123"`
+}
+
+// HeaderProfilesConfig makes proxied requests look like they come from real
+// browsers: each request gets the User-Agent, Accept, Accept-Language and
+// client hint headers of one profile, replacing the client's. With Rotation
+// "request" every request gets a random profile; with "session" a client
+// keeps its profile until it has been idle for SessionTTL. Profiles are
+// loaded from File when set, else taken from Profiles, else built in.
+type HeaderProfilesConfig struct {
+	Enabled       bool                  `mapstructure:"enabled"`
+	Rotation      string                `mapstructure:"rotation" validate:"oneof=request session"`
+	SessionTTL    time.Duration         `mapstructure:"session_ttl" validate:"min=1m,max=24h"`
+	KeepUserAgent bool                  `mapstructure:"keep_user_agent"`
+	File          string                `mapstructure:"file"`
+	Profiles      []HeaderProfileConfig `mapstructure:"profiles" validate:"dive"`
+}
+
+// HeaderProfileConfig is a set of headers one browser sends together.
+type HeaderProfileConfig struct {
+	Name    string            `mapstructure:"name" validate:"required"`
+	Headers map[string]string `mapstructure:"headers" validate:"required,dive,keys,required,endkeys"`
+}
+
+// MITMConfig enables TLS interception of CONNECT tunnels, so header policies,
+// block detection and per-request retries apply to HTTPS too. Clients must
+// trust the CA in CACert; if neither CACert nor CAKey exists, a new CA is
+// generated and written there. Domains limits interception to those domains
+// and their subdomains (empty intercepts all), and Bypass is always tunneled,
+// e.g. for clients that pin certificates.
+type MITMConfig struct {
+	Enabled   bool     `mapstructure:"enabled"`
+	CACert    string   `mapstructure:"ca_cert" validate:"required"`
+	CAKey     string   `mapstructure:"ca_key" validate:"required"`
+	Domains   []string `mapstructure:"domains" validate:"dive,required"`
+	Bypass    []string `mapstructure:"bypass" validate:"dive,required"`
+	CertCache int      `mapstructure:"cert_cache" validate:"required,min=1,max=100000"`
+}
+
+// CacheConfig enables a shared HTTP cache for plain-HTTP GETs, following
+// Cache-Control, Expires, ETag/Last-Modified revalidation and Vary. Entries
+// live in memory and, when DiskPath is set, overflow to disk; the disk tier is
+// cleared on startup. Requests with Authorization or Cookie headers are never
+// served from or stored in the cache.
+type CacheConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	MemoryMaxMB int    `mapstructure:"memory_max_mb" validate:"required,min=1,max=65536"`
+	DiskPath    string `mapstructure:"disk_path"`
+	DiskMaxMB   int    `mapstructure:"disk_max_mb" validate:"required,min=1,max=1048576"`
+	MaxObjectMB int    `mapstructure:"max_object_mb" validate:"required,min=1,max=1024"`
+}
+
+// BlockDetectionConfig recognizes block pages and challenges that targets
+// serve in place of content. It is off unless Enabled is set, since a 403 or
+// 429 can be a target's real answer. A response matching any rule counts as
+// blocked: it is retried through another proxy while attempts remain, and
+// counts against that proxy's reputation for the host. Body rules see up to
+// BodyBytes of the body as sent, so compressed bodies are not matched.
+type BlockDetectionConfig struct {
+	Enabled   bool              `mapstructure:"enabled"`
+	BodyBytes int               `mapstructure:"body_bytes" validate:"min=0,max=1048576"`
+	Rules     []BlockRuleConfig `mapstructure:"rules" validate:"dive"`
+}
+
+// BlockRuleConfig matches a response when every condition set on it holds:
+// the status is one of Status, each header matches its regex, and the body
+// matches Body. Domains limits the rule to those domains and their subdomains.
+type BlockRuleConfig struct {
+	Name    string            `mapstructure:"name"`
+	Domains []string          `mapstructure:"domains" validate:"dive,required"`
+	Status  []int             `mapstructure:"status" validate:"required_without_all=Headers Body,dive,min=100,max=599"`
+	Headers map[string]string `mapstructure:"headers" validate:"dive,keys,required,endkeys,regexp"`
+	Body    string            `mapstructure:"body" validate:"omitempty,regexp"`
+}
+
+// RateLimitConfig sets token-bucket limits on proxied requests per client IP,
+// per authenticated user, per target domain, and per target domain through
+// each upstream proxy. Requests over a limit are refused with 429, or with
+// policy "delay" held for up to MaxDelay first.
+type RateLimitConfig struct {
+	Policy         string             `mapstructure:"policy" validate:"oneof=reject delay"`
+	MaxDelay       time.Duration      `mapstructure:"max_delay" validate:"min=0,max=1m"`
+	PerClient      RateConfig         `mapstructure:"per_client"`
+	PerUser        RateConfig         `mapstructure:"per_user"`
+	PerDomain      RateConfig         `mapstructure:"per_domain"`
+	PerDomainProxy RateConfig         `mapstructure:"per_domain_proxy"`
+	Domains        []DomainRateConfig `mapstructure:"domains" validate:"dive"`
+}
+
+// RateConfig is a token bucket: Rate requests per second (0 = unlimited),
+// with bursts of up to Burst (at least 1).
+type RateConfig struct {
+	Rate  float64 `mapstructure:"rate" validate:"min=0"`
+	Burst int     `mapstructure:"burst" validate:"min=0"`
+}
+
+// DomainRateConfig overrides PerDomain for a domain and its subdomains, which
+// share one bucket.
+type DomainRateConfig struct {
+	Domain     string `mapstructure:"domain" validate:"required"`
+	RateConfig `mapstructure:",squash"`
+}
+
+// AdmissionConfig tunes how MaxConnections is enforced. Connections beyond the
+// limit wait in a queue of QueueSize for up to QueueTimeout, then get 503;
+// with no queue they get 503 at once. MaxPerClient caps concurrent connections
+// per client IP (0 = no cap).
+type AdmissionConfig struct {
+	QueueSize    int           `mapstructure:"queue_size" validate:"min=0,max=100000"`
+	QueueTimeout time.Duration `mapstructure:"queue_timeout" validate:"min=0,max=5m"`
+	MaxPerClient int           `mapstructure:"max_per_client" validate:"min=0,max=10000"`
+}
+
+// TransportConfig sizes the cache of per-upstream HTTP transports, which keeps
+// connections to each upstream proxy alive between requests.
+type TransportConfig struct {
+	MaxCached   int           `mapstructure:"max_cached" validate:"required,min=1,max=10000"`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout" validate:"required,min=1s,max=1h"`
+}
+
+// TunnelConfig bounds relayed CONNECT tunnels and upgraded connections: one
+// is closed after IdleTimeout without data in either direction, and after
+// MaxLifetime regardless (0 = no limit).
+type TunnelConfig struct {
+	IdleTimeout time.Duration `mapstructure:"idle_timeout" validate:"required,min=1s,max=24h"`
+	MaxLifetime time.Duration `mapstructure:"max_lifetime" validate:"min=0,max=168h"`
+}
+
+// HedgeConfig races extra upstream attempts for idempotent requests and
+// CONNECT: if the first hasn't connected after Delay, another starts, and the
+// first to succeed is used. A zero Delay uses the pool's p90 check latency.
+type HedgeConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	Delay       time.Duration `mapstructure:"delay" validate:"min=0,max=30s"`
+	MaxAttempts int           `mapstructure:"max_attempts" validate:"min=2,max=3"`
+}
+
+// PACConfig controls the generated Proxy Auto-Config file served at
+// /proxy.pac and /wpad.dat. Domain entries are a suffix ("example.com" matches
+// it and its subdomains), a shell glob ("*.corp.*") or an IPv4 CIDR.
+//
+// The PAC file is served without authentication, so FailoverCount > 0 hands
+// that many of the pool's fastest proxy addresses to anyone who can reach
+// the proxy port or management listener. It is off by default.
+type PACConfig struct {
+	Enabled        bool     `mapstructure:"enabled"`
+	ProxyAddr      string   `mapstructure:"proxy_addr" validate:"omitempty,hostname_port"`
+	ProxyDomains   []string `mapstructure:"proxy_domains" validate:"dive,required"`
+	DirectDomains  []string `mapstructure:"direct_domains" validate:"dive,required"`
+	DirectPlain    bool     `mapstructure:"direct_plain_hosts"`
+	FailoverCount  int      `mapstructure:"failover_count" validate:"min=0,max=20"`
+	FallbackDirect bool     `mapstructure:"fallback_direct"`
 }
 
 type ProxyConfig struct {
-	UpdateInterval time.Duration `mapstructure:"update_interval" validate:"required,min=1m,max=24h"`
-	MaxFailures    int           `mapstructure:"max_failures" validate:"required,min=1,max=100"`
-	RecheckTime    time.Duration `mapstructure:"recheck_time" validate:"required,min=1m,max=1h"`
+	UpdateInterval time.Duration    `mapstructure:"update_interval" validate:"required,min=1m,max=24h"`
+	MaxFailures    int              `mapstructure:"max_failures" validate:"required,min=1,max=100"`
+	RecheckTime    time.Duration    `mapstructure:"recheck_time" validate:"required,min=1m,max=1h"`
+	Politeness     PolitenessConfig `mapstructure:"politeness"`
+	Reputation     ReputationConfig `mapstructure:"reputation"`
+	Presets        []PresetConfig   `mapstructure:"presets" validate:"unique=Name,dive"`
+}
+
+// PresetConfig is a named pool selection that listener ports map to (see
+// ListenerConfig.Ports). With Sticky, each port keeps the proxy it was given
+// while that proxy stays in the pool and isn't blocked by the target.
+type PresetConfig struct {
+	Name   string       `mapstructure:"name" validate:"required"`
+	Filter FilterConfig `mapstructure:"filter"`
+	Sticky bool         `mapstructure:"sticky"`
+}
+
+// ReputationConfig controls how outcomes of real requests, per proxy and
+// target host, steer selection. Outcomes count for half as much after each
+// HalfLife. A proxy that got a block page (see BlockDetectionConfig) from a
+// host is avoided there for BlockCooldown. Selection compares up
+// to Candidates proxies in round-robin order and takes the best for the host.
+type ReputationConfig struct {
+	HalfLife        time.Duration `mapstructure:"half_life" validate:"required,min=1m,max=168h"`
+	BlockCooldown   time.Duration `mapstructure:"block_cooldown" validate:"min=0,max=24h"`
+	Candidates      int           `mapstructure:"candidates" validate:"required,min=1,max=64"`
+	PersistInterval time.Duration `mapstructure:"persist_interval" validate:"required,min=10s,max=1h"`
+}
+
+// PolitenessConfig spaces out requests from one proxy to the same target host,
+// so no exit IP sends bursts to a site. A proxy is skipped for a host until
+// MinInterval has passed since it last served that host, and once it has
+// served MaxHits requests there within Window (0 disables either check).
+type PolitenessConfig struct {
+	MinInterval time.Duration            `mapstructure:"min_interval" validate:"min=0,max=1h"`
+	Window      time.Duration            `mapstructure:"window" validate:"required,min=1s,max=24h"`
+	MaxHits     int                      `mapstructure:"max_hits" validate:"min=0"`
+	Domains     []DomainPolitenessConfig `mapstructure:"domains" validate:"dive"`
+}
+
+// DomainPolitenessConfig overrides the politeness limits for a domain and its
+// subdomains, which are counted together.
+type DomainPolitenessConfig struct {
+	Domain      string        `mapstructure:"domain" validate:"required"`
+	MinInterval time.Duration `mapstructure:"min_interval" validate:"min=0,max=1h"`
+	MaxHits     int           `mapstructure:"max_hits" validate:"min=0"`
 }
 
 type ScraperConfig struct {
@@ -56,6 +295,9 @@ type CheckerConfig struct {
 	BatchSize         int           `mapstructure:"batch_size" validate:"required,min=10,max=500"`
 	BatchDelay        time.Duration `mapstructure:"batch_delay" validate:"required,min=5s,max=5m"`
 	BackgroundEnabled bool          `mapstructure:"background_enabled"`
+	// VerifyTLS requires pool proxies that expect TLS to present a certificate
+	// valid for their host; those that don't are unhealthy.
+	VerifyTLS bool `mapstructure:"verify_tls"`
 }
 
 type DatabaseConfig struct {
@@ -64,6 +306,84 @@ type DatabaseConfig struct {
 	CleanupInterval time.Duration `mapstructure:"cleanup_interval" validate:"required,min=30m,max=24h"`
 }
 
+// AdminConfig configures the management listener, which serves the admin API
+// plus /stats, /proxies and /health. It is disabled when ListenAddr is empty
+// and always requires its own token. ListenAddr may be "unix:/path/to.sock".
+type AdminConfig struct {
+	ListenAddr string `mapstructure:"listen_addr" validate:"omitempty,listen_addr"`
+	AuthToken  string `mapstructure:"auth_token" validate:"required_with=ListenAddr,omitempty,min=16"`
+}
+
+// FilterConfig narrows pool selection; zero fields don't filter.
+type FilterConfig struct {
+	Types          []string      `mapstructure:"types"`
+	Countries      []string      `mapstructure:"countries"`
+	Anonymity      []string      `mapstructure:"anonymity"`
+	MaxLatency     time.Duration `mapstructure:"max_latency" validate:"min=0"`
+	MinSuccessRate float64       `mapstructure:"min_success_rate" validate:"min=0,max=1"`
+}
+
+// UpstreamConfig is a named upstream group that rules route to. A "static"
+// group (the default) rotates through fixed proxies ("proto://host:port"); a
+// "pool" group selects from the scraped pool narrowed by filter.
+// InsecureSkipVerify accepts any certificate from the group's https:// proxies.
+type UpstreamConfig struct {
+	Name               string       `mapstructure:"name" validate:"required"`
+	Type               string       `mapstructure:"type" validate:"omitempty,oneof=static pool"`
+	Proxies            []string     `mapstructure:"proxies" validate:"required_unless=Type pool,dive,required"`
+	Filter             FilterConfig `mapstructure:"filter"`
+	InsecureSkipVerify bool         `mapstructure:"insecure_skip_verify"`
+}
+
+// RuleConfig is one routing rule. A rule matches when any host matcher
+// (domains, globs, regexes, cidrs) matches, or there are none, and the port is
+// in ports, or ports is empty. Rules are evaluated in order; the first match wins.
+// Action "chain" tunnels through one proxy from each group in chain, in order.
+type RuleConfig struct {
+	Name     string       `mapstructure:"name"`
+	Domains  []string     `mapstructure:"domains" validate:"dive,required"`
+	Globs    []string     `mapstructure:"globs" validate:"dive,required"`
+	Regexes  []string     `mapstructure:"regexes" validate:"dive,required"`
+	CIDRs    []string     `mapstructure:"cidrs" validate:"dive,cidr"`
+	Ports    []string     `mapstructure:"ports" validate:"dive,required"`
+	Action   string       `mapstructure:"action" validate:"required,oneof=direct pool upstream chain reject"`
+	Upstream string       `mapstructure:"upstream" validate:"required_if=Action upstream"`
+	Chain    []string     `mapstructure:"chain" validate:"required_if=Action chain,dive,required"`
+	Filter   FilterConfig `mapstructure:"filter"`
+}
+
+// ListenerConfig is an extra proxy port with its own policy. It serves HTTP
+// proxy requests, or with Protocol "socks5", SOCKS5 CONNECT. AuthToken, the
+// header policy and Rules replace those of server for this port; Rules are
+// evaluated before the top-level rules. Filter narrows pool selection
+// wherever a matching rule doesn't set its own. Everything else, including
+// limits and retries, comes from server.
+//
+// With Ports instead of ListenAddr, the listener binds every port of each
+// range on ListenHost (all interfaces if empty), and pool selection on a port
+// uses its preset, for clients that can pick a port but not send headers.
+type ListenerConfig struct {
+	Name         string             `mapstructure:"name" validate:"required"`
+	ListenAddr   string             `mapstructure:"listen_addr" validate:"required_without=Ports,excluded_with=Ports,omitempty,hostname_port"`
+	ListenHost   string             `mapstructure:"listen_host"`
+	Ports        []PortPresetConfig `mapstructure:"ports" validate:"dive"`
+	Protocol     string             `mapstructure:"protocol" validate:"omitempty,oneof=http socks5"`
+	AuthToken    string             `mapstructure:"auth_token"`
+	Filter       FilterConfig       `mapstructure:"filter"`
+	Rules        []RuleConfig       `mapstructure:"rules" validate:"dive"`
+	StripHeaders []string           `mapstructure:"strip_headers"`
+	AddHeaders   map[string]string  `mapstructure:"add_headers"`
+	// Via is nil to keep server's setting
+	Via *ViaConfig `mapstructure:"via" validate:"omitempty"`
+}
+
+// PortPresetConfig maps a port ("11000") or range ("10000-10099") of a
+// listener to a preset from proxy.presets.
+type PortPresetConfig struct {
+	Ports  string `mapstructure:"ports" validate:"required"`
+	Preset string `mapstructure:"preset" validate:"required"`
+}
+
 // setDefaults configures default values for viper
 func setDefaults() {
 	// Server defaults
@@ -81,11 +401,80 @@ func setDefaults() {
 		"User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
 	})
 	viper.SetDefault("server.auth_token", "")
+	viper.SetDefault("server.health_endpoint", true)
+	viper.SetDefault("server.pac.enabled", false)
+	viper.SetDefault("server.pac.proxy_addr", "")
+	viper.SetDefault("server.pac.proxy_domains", []string{})
+	viper.SetDefault("server.pac.direct_domains", []string{"localhost", "127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"})
+	viper.SetDefault("server.pac.direct_plain_hosts", true)
+	viper.SetDefault("server.pac.failover_count", 0)
+	viper.SetDefault("server.pac.fallback_direct", false)
+	viper.SetDefault("server.hedge.enabled", false)
+	viper.SetDefault("server.hedge.delay", "0s")
+	viper.SetDefault("server.hedge.max_attempts", 2)
+	viper.SetDefault("server.transport.max_cached", 256)
+	viper.SetDefault("server.transport.idle_timeout", "90s")
+	viper.SetDefault("server.tunnel.idle_timeout", "5m")
+	viper.SetDefault("server.tunnel.max_lifetime", "0s")
+	viper.SetDefault("server.cache.enabled", false)
+	viper.SetDefault("server.cache.memory_max_mb", 64)
+	viper.SetDefault("server.cache.disk_path", "")
+	viper.SetDefault("server.cache.disk_max_mb", 1024)
+	viper.SetDefault("server.cache.max_object_mb", 8)
+	viper.SetDefault("server.mitm.enabled", false)
+	viper.SetDefault("server.mitm.ca_cert", "./data/aproxy-ca.pem")
+	viper.SetDefault("server.mitm.ca_key", "./data/aproxy-ca-key.pem")
+	viper.SetDefault("server.mitm.domains", []string{})
+	viper.SetDefault("server.mitm.bypass", []string{})
+	viper.SetDefault("server.mitm.cert_cache", 1000)
+	viper.SetDefault("server.header_profiles.enabled", false)
+	viper.SetDefault("server.header_profiles.rotation", "request")
+	viper.SetDefault("server.header_profiles.session_ttl", "30m")
+	viper.SetDefault("server.header_profiles.keep_user_agent", false)
+	viper.SetDefault("server.header_profiles.file", "")
+	viper.SetDefault("server.header_profiles.profiles", []map[string]any{})
+	viper.SetDefault("server.tls.enabled", false)
+	viper.SetDefault("server.tls.cert_file", "./data/aproxy-cert.pem")
+	viper.SetDefault("server.tls.key_file", "./data/aproxy-key.pem")
+	viper.SetDefault("server.tls.self_signed", false)
+	viper.SetDefault("server.tls.client_auth", "none")
+	viper.SetDefault("server.tls.client_ca", "")
+	viper.SetDefault("server.via.mode", "strip")
+	viper.SetDefault("server.via.pseudonym", "aproxy")
+	viper.SetDefault("server.admission.queue_size", 0)
+	viper.SetDefault("server.admission.queue_timeout", "10s")
+	viper.SetDefault("server.admission.max_per_client", 0)
+	viper.SetDefault("server.rate_limit.policy", "reject")
+	viper.SetDefault("server.rate_limit.max_delay", "5s")
+	viper.SetDefault("server.rate_limit.per_client.rate", 0)
+	viper.SetDefault("server.rate_limit.per_client.burst", 0)
+	viper.SetDefault("server.rate_limit.per_user.rate", 0)
+	viper.SetDefault("server.rate_limit.per_user.burst", 0)
+	viper.SetDefault("server.rate_limit.per_domain.rate", 0)
+	viper.SetDefault("server.rate_limit.per_domain.burst", 0)
+	viper.SetDefault("server.rate_limit.per_domain_proxy.rate", 0)
+	viper.SetDefault("server.rate_limit.per_domain_proxy.burst", 0)
+	viper.SetDefault("server.rate_limit.domains", []map[string]any{})
+	viper.SetDefault("server.block_detection.enabled", false)
+	viper.SetDefault("server.block_detection.body_bytes", 16384)
+	viper.SetDefault("server.block_detection.rules", []map[string]any{
+		{"name": "refused", "status": []int{403, 429}},
+		{"name": "cloudflare-challenge", "headers": map[string]string{"Cf-Mitigated": "^challenge$"}},
+	})
 
 	// Proxy defaults
 	viper.SetDefault("proxy.update_interval", "15m")
 	viper.SetDefault("proxy.max_failures", 3)
 	viper.SetDefault("proxy.recheck_time", "5m")
+	viper.SetDefault("proxy.politeness.min_interval", "0s")
+	viper.SetDefault("proxy.politeness.window", "10m")
+	viper.SetDefault("proxy.politeness.max_hits", 0)
+	viper.SetDefault("proxy.politeness.domains", []map[string]any{})
+	viper.SetDefault("proxy.reputation.half_life", "1h")
+	viper.SetDefault("proxy.reputation.block_cooldown", "30m")
+	viper.SetDefault("proxy.reputation.candidates", 4)
+	viper.SetDefault("proxy.reputation.persist_interval", "1m")
+	viper.SetDefault("proxy.presets", []map[string]any{})
 
 	// Scraper defaults
 	viper.SetDefault("scraper.timeout", "30s")
@@ -101,12 +490,22 @@ func setDefaults() {
 	viper.SetDefault("checker.batch_size", 50)
 	viper.SetDefault("checker.batch_delay", "30s")
 	viper.SetDefault("checker.background_enabled", true)
+	viper.SetDefault("checker.verify_tls", false)
 
 	// Database defaults
 	viper.SetDefault("database.path", "./data/aproxy.db")
 	viper.SetDefault("database.max_age", "24h")
 	viper.SetDefault("database.cleanup_interval", "1h")
 
+	// Admin API defaults (disabled)
+	viper.SetDefault("admin.listen_addr", "")
+	viper.SetDefault("admin.auth_token", "")
+
+	// Routing defaults (everything through the pool)
+	viper.SetDefault("upstreams", []map[string]any{})
+	viper.SetDefault("rules", []map[string]any{})
+	viper.SetDefault("listeners", []map[string]any{})
+
 }
 
 // LoadConfig loads configuration from multiple sources with validation
@@ -148,11 +547,43 @@ func LoadConfig(configPath string) (*Config, error) {
 		log.InfoBg("No config file found, using defaults and environment variables")
 	}
 
+	return decode()
+}
+
+// Watch calls onChange with the new configuration whenever the config file
+// changes. Edits that fail validation are logged and skipped. It is a no-op
+// when no config file was loaded.
+func Watch(onChange func(*Config)) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		config, err := decode()
+		if err != nil {
+			log.ErrorBg("Ignoring config change in %s: %v", e.Name, err)
+			return
+		}
+		log.InfoBg("Config file %s changed, reloading", e.Name)
+		onChange(config)
+	})
+	viper.WatchConfig()
+}
+
+// decode unmarshals and validates the current viper state.
+func decode() (*Config, error) {
 	// Unmarshal configuration
 	var config Config
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
+	if path := config.Server.HeaderProfiles.File; path != "" {
+		profiles, err := loadHeaderProfiles(path)
+		if err != nil {
+			return nil, err
+		}
+		config.Server.HeaderProfiles.Profiles = profiles
+	}
 
 	// Validate configuration
 	validate := validator.New()
@@ -169,19 +600,58 @@ func LoadConfig(configPath string) (*Config, error) {
 	return &config, nil
 }
 
+// loadHeaderProfiles reads the "profiles" list of a YAML or JSON file.
+func loadHeaderProfiles(path string) ([]HeaderProfileConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read header profiles: %w", err)
+	}
+	var profiles []HeaderProfileConfig
+	if err := v.UnmarshalKey("profiles", &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse header profiles: %w", err)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no profiles in %s", path)
+	}
+	return profiles, nil
+}
+
 // registerCustomValidators adds custom validation rules
 func registerCustomValidators(validate *validator.Validate) error {
 	// Custom validator for hostname:port format
-	return validate.RegisterValidation("hostname_port", func(fl validator.FieldLevel) bool {
+	if err := validate.RegisterValidation("hostname_port", func(fl validator.FieldLevel) bool {
+		return isHostPort(fl.Field().String())
+	}); err != nil {
+		return err
+	}
+
+	// Custom validator for listener addresses: hostname:port or unix:/path
+	if err := validate.RegisterValidation("listen_addr", func(fl validator.FieldLevel) bool {
 		addr := fl.Field().String()
-		if addr == "" {
-			return false
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			return path != ""
 		}
-		// Simple check for :port format
-		return strings.Contains(addr, ":")
+		return isHostPort(addr)
+	}); err != nil {
+		return err
+	}
+
+	// Custom validator for regular expressions
+	return validate.RegisterValidation("regexp", func(fl validator.FieldLevel) bool {
+		_, err := regexp.Compile(fl.Field().String())
+		return err == nil
 	})
 }
 
+func isHostPort(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	// Simple check for :port format
+	return strings.Contains(addr, ":")
+}
+
 // SaveConfigTemplate generates a sample configuration file
 func SaveConfigTemplate(path string) error {
 	setDefaults()
@@ -200,9 +670,13 @@ func PrintConfig(config *Config) {
 	if config.Server.AuthToken != "" {
 		authToken = fmt.Sprintf("[SET] (length: %d)", len(config.Server.AuthToken))
 	}
-	log.InfoBg("Configuration loaded: server=%s https=%v auth=%s db=%s maxAge=%v "+
+	admin := "[DISABLED]"
+	if config.Admin.ListenAddr != "" {
+		admin = config.Admin.ListenAddr
+	}
+	log.InfoBg("Configuration loaded: server=%s https=%v auth=%s admin=%s listeners=%d db=%s maxAge=%v "+
 		"proxyUpdate=%v maxFailures=%d checker=%dw/%v batch=%d/%v bg=%v sources=%v",
-		config.Server.ListenAddr, config.Server.EnableHTTPS, authToken,
+		config.Server.ListenAddr, config.Server.EnableHTTPS, authToken, admin, len(config.Listeners),
 		config.Database.Path, config.Database.MaxAge,
 		config.Proxy.UpdateInterval, config.Proxy.MaxFailures,
 		config.Checker.MaxWorkers, config.Checker.Timeout,
@@ -58,7 +58,7 @@ CREATE TABLE IF NOT EXISTS proxies (
     proxy_type TEXT NOT NULL,
     country TEXT,
     anonymity TEXT,
-    https BOOLEAN DEFAULT 0,
+    https BOOLEAN DEFAULT 0, -- the proxy expects TLS, as found by the checker
     
     -- Health tracking
     status TEXT NOT NULL DEFAULT 'unknown', -- healthy, unhealthy, timeout, error, unknown
@@ -84,7 +84,43 @@ CREATE INDEX IF NOT EXISTS idx_proxies_last_checked ON proxies(last_checked_at);
 CREATE INDEX IF NOT EXISTS idx_proxies_status ON proxies(status);
 
 -- Index for finding proxies by type
-CREATE INDEX IF NOT EXISTS idx_proxies_type ON proxies(proxy_type);`
+CREATE INDEX IF NOT EXISTS idx_proxies_type ON proxies(proxy_type);
+
+-- Health check history, one row per check
+CREATE TABLE IF NOT EXISTS proxy_checks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    proxy_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    response_time_ms INTEGER,
+    error TEXT,
+    checked_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Index for reading a proxy's history newest-first
+CREATE INDEX IF NOT EXISTS idx_proxy_checks_proxy ON proxy_checks(proxy_id, checked_at);
+
+-- Operator bans; banned host:port pairs never enter the pool
+CREATE TABLE IF NOT EXISTS proxy_bans (
+    host TEXT NOT NULL,
+    port INTEGER NOT NULL,
+    reason TEXT,
+    banned_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY(host, port)
+);
+
+-- Outcomes of real requests per proxy and target host, decayed over time
+CREATE TABLE IF NOT EXISTS proxy_target_stats (
+    host TEXT NOT NULL,
+    port INTEGER NOT NULL,
+    target TEXT NOT NULL,
+    successes REAL NOT NULL,
+    failures REAL NOT NULL,
+    blocked_at DATETIME,
+    updated_at DATETIME NOT NULL,
+
+    PRIMARY KEY(host, port, target)
+);`
 
 	_, err := db.Exec(schema)
 	return err
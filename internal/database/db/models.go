@@ -23,3 +23,29 @@ type Proxy struct {
 	LastCheckedAt  *time.Time
 	LastHealthyAt  *time.Time
 }
+
+type ProxyBan struct {
+	Host     string
+	Port     int64
+	Reason   *string
+	BannedAt time.Time
+}
+
+type ProxyCheck struct {
+	ID             int64
+	ProxyID        int64
+	Status         string
+	ResponseTimeMs *int64
+	Error          *string
+	CheckedAt      time.Time
+}
+
+type ProxyTargetStat struct {
+	Host      string
+	Port      int64
+	Target    string
+	Successes float64
+	Failures  float64
+	BlockedAt *time.Time
+	UpdatedAt time.Time
+}
@@ -10,6 +10,35 @@ import (
 	"time"
 )
 
+const banProxy = `-- name: BanProxy :exec
+INSERT INTO proxy_bans (host, port, reason, banned_at)
+VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT(host, port) DO UPDATE SET
+    reason = excluded.reason,
+    banned_at = excluded.banned_at
+`
+
+type BanProxyParams struct {
+	Host   string
+	Port   int64
+	Reason *string
+}
+
+func (q *Queries) BanProxy(ctx context.Context, arg BanProxyParams) error {
+	_, err := q.db.ExecContext(ctx, banProxy, arg.Host, arg.Port, arg.Reason)
+	return err
+}
+
+const cleanupOldChecks = `-- name: CleanupOldChecks :exec
+DELETE FROM proxy_checks
+WHERE checked_at < ? OR proxy_id NOT IN (SELECT id FROM proxies)
+`
+
+func (q *Queries) CleanupOldChecks(ctx context.Context, checkedAt time.Time) error {
+	_, err := q.db.ExecContext(ctx, cleanupOldChecks, checkedAt)
+	return err
+}
+
 const cleanupOldProxies = `-- name: CleanupOldProxies :exec
 DELETE FROM proxies
 WHERE last_healthy_at IS NULL OR last_healthy_at < ?
@@ -20,6 +49,16 @@ func (q *Queries) CleanupOldProxies(ctx context.Context, lastHealthyAt *time.Tim
 	return err
 }
 
+const cleanupTargetStats = `-- name: CleanupTargetStats :exec
+DELETE FROM proxy_target_stats
+WHERE updated_at < ?
+`
+
+func (q *Queries) CleanupTargetStats(ctx context.Context, updatedAt time.Time) error {
+	_, err := q.db.ExecContext(ctx, cleanupTargetStats, updatedAt)
+	return err
+}
+
 const countHealthyProxies = `-- name: CountHealthyProxies :one
 SELECT COUNT(*) FROM proxies WHERE status = 'healthy'
 `
@@ -74,9 +113,71 @@ func (q *Queries) CountProxiesByType(ctx context.Context) ([]CountProxiesByTypeR
 	return items, nil
 }
 
+const deleteProxy = `-- name: DeleteProxy :execrows
+DELETE FROM proxies
+WHERE host = ? AND port = ?
+`
+
+type DeleteProxyParams struct {
+	Host string
+	Port int64
+}
+
+func (q *Queries) DeleteProxy(ctx context.Context, arg DeleteProxyParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteProxy, arg.Host, arg.Port)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const getCheckStats = `-- name: GetCheckStats :many
+SELECT p.host, p.port, COUNT(c.id) AS total,
+    CAST(SUM(CASE WHEN c.status = 'healthy' THEN 1 ELSE 0 END) AS INTEGER) AS healthy
+FROM proxies p
+JOIN proxy_checks c ON c.proxy_id = p.id
+GROUP BY p.id
+`
+
+type GetCheckStatsRow struct {
+	Host    string
+	Port    int64
+	Total   int64
+	Healthy int64
+}
+
+func (q *Queries) GetCheckStats(ctx context.Context) ([]GetCheckStatsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getCheckStats)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetCheckStatsRow
+	for rows.Next() {
+		var i GetCheckStatsRow
+		if err := rows.Scan(
+			&i.Host,
+			&i.Port,
+			&i.Total,
+			&i.Healthy,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getHealthyProxies = `-- name: GetHealthyProxies :many
 SELECT id, host, port, proxy_type, country, anonymity, https, status, response_time_ms, fail_count, first_seen_at, last_checked_at, last_healthy_at FROM proxies
 WHERE status = 'healthy'
+  AND NOT EXISTS (SELECT 1 FROM proxy_bans b WHERE b.host = proxies.host AND b.port = proxies.port)
 ORDER BY last_healthy_at DESC
 `
 
@@ -148,9 +249,142 @@ func (q *Queries) GetProxyByHostPort(ctx context.Context, arg GetProxyByHostPort
 	return i, err
 }
 
+const getProxyChecks = `-- name: GetProxyChecks :many
+SELECT id, proxy_id, status, response_time_ms, error, checked_at FROM proxy_checks
+WHERE proxy_id = ?
+ORDER BY checked_at DESC, id DESC
+LIMIT ?
+`
+
+type GetProxyChecksParams struct {
+	ProxyID int64
+	Limit   int64
+}
+
+func (q *Queries) GetProxyChecks(ctx context.Context, arg GetProxyChecksParams) ([]ProxyCheck, error) {
+	rows, err := q.db.QueryContext(ctx, getProxyChecks, arg.ProxyID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ProxyCheck
+	for rows.Next() {
+		var i ProxyCheck
+		if err := rows.Scan(
+			&i.ID,
+			&i.ProxyID,
+			&i.Status,
+			&i.ResponseTimeMs,
+			&i.Error,
+			&i.CheckedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertProxyCheck = `-- name: InsertProxyCheck :exec
+INSERT INTO proxy_checks (proxy_id, status, response_time_ms, error, checked_at)
+VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+`
+
+type InsertProxyCheckParams struct {
+	ProxyID        int64
+	Status         string
+	ResponseTimeMs *int64
+	Error          *string
+}
+
+func (q *Queries) InsertProxyCheck(ctx context.Context, arg InsertProxyCheckParams) error {
+	_, err := q.db.ExecContext(ctx, insertProxyCheck,
+		arg.ProxyID,
+		arg.Status,
+		arg.ResponseTimeMs,
+		arg.Error,
+	)
+	return err
+}
+
+const listBans = `-- name: ListBans :many
+SELECT host, port, reason, banned_at FROM proxy_bans
+ORDER BY banned_at DESC
+`
+
+func (q *Queries) ListBans(ctx context.Context) ([]ProxyBan, error) {
+	rows, err := q.db.QueryContext(ctx, listBans)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ProxyBan
+	for rows.Next() {
+		var i ProxyBan
+		if err := rows.Scan(
+			&i.Host,
+			&i.Port,
+			&i.Reason,
+			&i.BannedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTargetStats = `-- name: ListTargetStats :many
+SELECT host, port, target, successes, failures, blocked_at, updated_at FROM proxy_target_stats
+WHERE updated_at >= ?
+`
+
+func (q *Queries) ListTargetStats(ctx context.Context, updatedAt time.Time) ([]ProxyTargetStat, error) {
+	rows, err := q.db.QueryContext(ctx, listTargetStats, updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ProxyTargetStat
+	for rows.Next() {
+		var i ProxyTargetStat
+		if err := rows.Scan(
+			&i.Host,
+			&i.Port,
+			&i.Target,
+			&i.Successes,
+			&i.Failures,
+			&i.BlockedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const markProxyHealthy = `-- name: MarkProxyHealthy :exec
 UPDATE proxies
-SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?,
+SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?, https = ?,
     last_healthy_at = CURRENT_TIMESTAMP, fail_count = 0
 WHERE id = ?
 `
@@ -158,17 +392,23 @@ WHERE id = ?
 type MarkProxyHealthyParams struct {
 	Status         string
 	ResponseTimeMs *int64
+	Https          *bool
 	ID             int64
 }
 
 func (q *Queries) MarkProxyHealthy(ctx context.Context, arg MarkProxyHealthyParams) error {
-	_, err := q.db.ExecContext(ctx, markProxyHealthy, arg.Status, arg.ResponseTimeMs, arg.ID)
+	_, err := q.db.ExecContext(ctx, markProxyHealthy,
+		arg.Status,
+		arg.ResponseTimeMs,
+		arg.Https,
+		arg.ID,
+	)
 	return err
 }
 
 const markProxyUnhealthy = `-- name: MarkProxyUnhealthy :exec
 UPDATE proxies
-SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?,
+SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?, https = ?,
     fail_count = fail_count + 1
 WHERE id = ?
 `
@@ -176,11 +416,32 @@ WHERE id = ?
 type MarkProxyUnhealthyParams struct {
 	Status         string
 	ResponseTimeMs *int64
+	Https          *bool
 	ID             int64
 }
 
 func (q *Queries) MarkProxyUnhealthy(ctx context.Context, arg MarkProxyUnhealthyParams) error {
-	_, err := q.db.ExecContext(ctx, markProxyUnhealthy, arg.Status, arg.ResponseTimeMs, arg.ID)
+	_, err := q.db.ExecContext(ctx, markProxyUnhealthy,
+		arg.Status,
+		arg.ResponseTimeMs,
+		arg.Https,
+		arg.ID,
+	)
+	return err
+}
+
+const unbanProxy = `-- name: UnbanProxy :exec
+DELETE FROM proxy_bans
+WHERE host = ? AND port = ?
+`
+
+type UnbanProxyParams struct {
+	Host string
+	Port int64
+}
+
+func (q *Queries) UnbanProxy(ctx context.Context, arg UnbanProxyParams) error {
+	_, err := q.db.ExecContext(ctx, unbanProxy, arg.Host, arg.Port)
 	return err
 }
 
@@ -225,3 +486,36 @@ func (q *Queries) UpsertProxy(ctx context.Context, arg UpsertProxyParams) (Proxy
 	)
 	return i, err
 }
+
+const upsertTargetStat = `-- name: UpsertTargetStat :exec
+INSERT INTO proxy_target_stats (host, port, target, successes, failures, blocked_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(host, port, target) DO UPDATE SET
+    successes = excluded.successes,
+    failures = excluded.failures,
+    blocked_at = excluded.blocked_at,
+    updated_at = excluded.updated_at
+`
+
+type UpsertTargetStatParams struct {
+	Host      string
+	Port      int64
+	Target    string
+	Successes float64
+	Failures  float64
+	BlockedAt *time.Time
+	UpdatedAt time.Time
+}
+
+func (q *Queries) UpsertTargetStat(ctx context.Context, arg UpsertTargetStatParams) error {
+	_, err := q.db.ExecContext(ctx, upsertTargetStat,
+		arg.Host,
+		arg.Port,
+		arg.Target,
+		arg.Successes,
+		arg.Failures,
+		arg.BlockedAt,
+		arg.UpdatedAt,
+	)
+	return err
+}
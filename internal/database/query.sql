@@ -9,6 +9,7 @@ RETURNING *;
 -- name: GetHealthyProxies :many
 SELECT * FROM proxies
 WHERE status = 'healthy'
+  AND NOT EXISTS (SELECT 1 FROM proxy_bans b WHERE b.host = proxies.host AND b.port = proxies.port)
 ORDER BY last_healthy_at DESC;
 
 -- name: GetProxyByHostPort :one
@@ -17,13 +18,13 @@ WHERE host = ? AND port = ?;
 
 -- name: MarkProxyHealthy :exec
 UPDATE proxies
-SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?,
+SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?, https = ?,
     last_healthy_at = CURRENT_TIMESTAMP, fail_count = 0
 WHERE id = ?;
 
 -- name: MarkProxyUnhealthy :exec
 UPDATE proxies
-SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?,
+SET status = ?, last_checked_at = CURRENT_TIMESTAMP, response_time_ms = ?, https = ?,
     fail_count = fail_count + 1
 WHERE id = ?;
 
@@ -39,3 +40,60 @@ SELECT COUNT(*) FROM proxies WHERE status = 'healthy';
 
 -- name: CountProxiesByType :many
 SELECT proxy_type, COUNT(*) AS count FROM proxies GROUP BY proxy_type;
+
+-- name: DeleteProxy :execrows
+DELETE FROM proxies
+WHERE host = ? AND port = ?;
+
+-- name: InsertProxyCheck :exec
+INSERT INTO proxy_checks (proxy_id, status, response_time_ms, error, checked_at)
+VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP);
+
+-- name: GetProxyChecks :many
+SELECT * FROM proxy_checks
+WHERE proxy_id = ?
+ORDER BY checked_at DESC, id DESC
+LIMIT ?;
+
+-- name: CleanupOldChecks :exec
+DELETE FROM proxy_checks
+WHERE checked_at < ? OR proxy_id NOT IN (SELECT id FROM proxies);
+
+-- name: BanProxy :exec
+INSERT INTO proxy_bans (host, port, reason, banned_at)
+VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT(host, port) DO UPDATE SET
+    reason = excluded.reason,
+    banned_at = excluded.banned_at;
+
+-- name: UnbanProxy :exec
+DELETE FROM proxy_bans
+WHERE host = ? AND port = ?;
+
+-- name: ListBans :many
+SELECT * FROM proxy_bans
+ORDER BY banned_at DESC;
+
+-- name: GetCheckStats :many
+SELECT p.host, p.port, COUNT(c.id) AS total,
+    CAST(SUM(CASE WHEN c.status = 'healthy' THEN 1 ELSE 0 END) AS INTEGER) AS healthy
+FROM proxies p
+JOIN proxy_checks c ON c.proxy_id = p.id
+GROUP BY p.id;
+
+-- name: UpsertTargetStat :exec
+INSERT INTO proxy_target_stats (host, port, target, successes, failures, blocked_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(host, port, target) DO UPDATE SET
+    successes = excluded.successes,
+    failures = excluded.failures,
+    blocked_at = excluded.blocked_at,
+    updated_at = excluded.updated_at;
+
+-- name: ListTargetStats :many
+SELECT * FROM proxy_target_stats
+WHERE updated_at >= ?;
+
+-- name: CleanupTargetStats :exec
+DELETE FROM proxy_target_stats
+WHERE updated_at < ?;
@@ -18,3 +18,33 @@ CREATE TABLE proxies (
 
     UNIQUE(host, port)
 );
+
+CREATE TABLE proxy_checks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    proxy_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    response_time_ms INTEGER,
+    error TEXT,
+    checked_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE proxy_bans (
+    host TEXT NOT NULL,
+    port INTEGER NOT NULL,
+    reason TEXT,
+    banned_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY(host, port)
+);
+
+CREATE TABLE proxy_target_stats (
+    host TEXT NOT NULL,
+    port INTEGER NOT NULL,
+    target TEXT NOT NULL,
+    successes REAL NOT NULL,
+    failures REAL NOT NULL,
+    blocked_at DATETIME,
+    updated_at DATETIME NOT NULL,
+
+    PRIMARY KEY(host, port, target)
+);
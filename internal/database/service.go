@@ -14,6 +14,16 @@ import (
 // Proxy is the stored proxy row (re-exported sqlc model).
 type Proxy = db.Proxy
 
+// ProxyCheck is one stored health check result (re-exported sqlc model).
+type ProxyCheck = db.ProxyCheck
+
+// ProxyBan is an operator ban on a host:port (re-exported sqlc model).
+type ProxyBan = db.ProxyBan
+
+// ProxyTargetStat holds a proxy's request outcomes for one target host
+// (re-exported sqlc model).
+type ProxyTargetStat = db.ProxyTargetStat
+
 // Service handles database operations for proxies.
 type Service struct {
 	q  *db.Queries
@@ -115,18 +125,30 @@ func (s *Service) BatchUpdateProxyHealth(ctx context.Context, updates map[int32]
 	qtx := s.q.WithTx(tx)
 	for id, result := range updates {
 		rt := int64(result.ResponseTime.Milliseconds())
+		tls := result.Proxy.TLS
 		if result.Status == StatusHealthy {
 			err = qtx.MarkProxyHealthy(ctx, db.MarkProxyHealthyParams{
-				Status: result.Status.String(), ResponseTimeMs: &rt, ID: int64(id),
+				Status: result.Status.String(), ResponseTimeMs: &rt, Https: &tls, ID: int64(id),
 			})
 		} else {
 			err = qtx.MarkProxyUnhealthy(ctx, db.MarkProxyUnhealthyParams{
-				Status: result.Status.String(), ResponseTimeMs: &rt, ID: int64(id),
+				Status: result.Status.String(), ResponseTimeMs: &rt, Https: &tls, ID: int64(id),
 			})
 		}
 		if err != nil {
 			return fmt.Errorf("failed to update proxy %d: %w", id, err)
 		}
+
+		var errMsg *string
+		if result.Error != nil {
+			msg := result.Error.Error()
+			errMsg = &msg
+		}
+		if err := qtx.InsertProxyCheck(ctx, db.InsertProxyCheckParams{
+			ProxyID: int64(id), Status: result.Status.String(), ResponseTimeMs: &rt, Error: errMsg,
+		}); err != nil {
+			return fmt.Errorf("failed to record check for proxy %d: %w", id, err)
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -141,9 +163,128 @@ func (s *Service) CleanupOldProxies(ctx context.Context, maxAge time.Duration) e
 	if err := s.q.CleanupOldProxies(ctx, &cutoff); err != nil {
 		return fmt.Errorf("failed to cleanup old proxies: %w", err)
 	}
+	if err := s.q.CleanupOldChecks(ctx, cutoff); err != nil {
+		return fmt.Errorf("failed to cleanup old checks: %w", err)
+	}
+	return nil
+}
+
+// DeleteProxy removes a proxy row and returns the number of rows removed. Its
+// check history is dropped by the next cleanup.
+func (s *Service) DeleteProxy(ctx context.Context, host string, port int) (int64, error) {
+	n, err := s.q.DeleteProxy(ctx, db.DeleteProxyParams{Host: host, Port: int64(port)})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete proxy: %w", err)
+	}
+	return n, nil
+}
+
+// GetProxyChecks returns up to limit of a proxy's most recent check results.
+func (s *Service) GetProxyChecks(ctx context.Context, proxyID int64, limit int) ([]ProxyCheck, error) {
+	checks, err := s.q.GetProxyChecks(ctx, db.GetProxyChecksParams{ProxyID: proxyID, Limit: int64(limit)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy checks: %w", err)
+	}
+	return checks, nil
+}
+
+// GetSuccessRates returns, per host:port, the fraction of retained checks that
+// passed. Proxies without recorded checks are absent.
+func (s *Service) GetSuccessRates(ctx context.Context) (map[string]float64, error) {
+	rows, err := s.q.GetCheckStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get check stats: %w", err)
+	}
+	rates := make(map[string]float64, len(rows))
+	for _, row := range rows {
+		if row.Total > 0 {
+			rates[fmt.Sprintf("%s:%d", row.Host, row.Port)] = float64(row.Healthy) / float64(row.Total)
+		}
+	}
+	return rates, nil
+}
+
+// BanProxy bans host:port, replacing the reason of an existing ban.
+func (s *Service) BanProxy(ctx context.Context, host string, port int, reason string) error {
+	var r *string
+	if reason != "" {
+		r = &reason
+	}
+	if err := s.q.BanProxy(ctx, db.BanProxyParams{Host: host, Port: int64(port), Reason: r}); err != nil {
+		return fmt.Errorf("failed to ban proxy: %w", err)
+	}
+	return nil
+}
+
+// UnbanProxy lifts a ban. Unbanning a proxy that isn't banned is a no-op.
+func (s *Service) UnbanProxy(ctx context.Context, host string, port int) error {
+	if err := s.q.UnbanProxy(ctx, db.UnbanProxyParams{Host: host, Port: int64(port)}); err != nil {
+		return fmt.Errorf("failed to unban proxy: %w", err)
+	}
+	return nil
+}
+
+// ListBans returns all bans, newest first.
+func (s *Service) ListBans(ctx context.Context) ([]ProxyBan, error) {
+	bans, err := s.q.ListBans(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bans: %w", err)
+	}
+	return bans, nil
+}
+
+// GetBannedAddresses returns the set of banned host:port keys.
+func (s *Service) GetBannedAddresses(ctx context.Context) (map[string]bool, error) {
+	bans, err := s.ListBans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	banned := make(map[string]bool, len(bans))
+	for _, b := range bans {
+		banned[fmt.Sprintf("%s:%d", b.Host, b.Port)] = true
+	}
+	return banned, nil
+}
+
+// SaveTargetStats upserts per-target request outcomes in one transaction.
+func (s *Service) SaveTargetStats(ctx context.Context, stats []ProxyTargetStat) error {
+	if len(stats) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qtx := s.q.WithTx(tx)
+	for _, st := range stats {
+		if err := qtx.UpsertTargetStat(ctx, db.UpsertTargetStatParams(st)); err != nil {
+			return fmt.Errorf("failed to save stats for %s:%d -> %s: %w", st.Host, st.Port, st.Target, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
+// ListTargetStats returns per-target outcomes updated within maxAge, deleting
+// older ones.
+func (s *Service) ListTargetStats(ctx context.Context, maxAge time.Duration) ([]ProxyTargetStat, error) {
+	cutoff := time.Now().UTC().Add(-maxAge) // stored in UTC, compared as text
+	if err := s.q.CleanupTargetStats(ctx, cutoff); err != nil {
+		return nil, fmt.Errorf("failed to cleanup target stats: %w", err)
+	}
+	stats, err := s.q.ListTargetStats(ctx, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list target stats: %w", err)
+	}
+	return stats, nil
+}
+
 // GetProxyStats returns aggregate statistics about the proxy table.
 func (s *Service) GetProxyStats(ctx context.Context) (ProxyStats, error) {
 	var stats ProxyStats
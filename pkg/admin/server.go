@@ -0,0 +1,421 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+	"aproxy/pkg/checker"
+	"aproxy/pkg/manager"
+	"aproxy/pkg/proxy"
+	"aproxy/pkg/scraper"
+)
+
+// maxBodyBytes bounds import and recheck request bodies.
+const maxBodyBytes = 4 << 20
+
+// Server is the management listener: the admin API plus the proxy server's
+// /health, /stats and /proxies, on an address separate from the proxy port.
+type Server struct {
+	manager *manager.DBManager
+	proxy   *proxy.Server
+	server  *http.Server
+	config  config.AdminConfig
+	mux     *http.ServeMux
+	logger  *logger.Logger
+}
+
+func NewServer(mgr *manager.DBManager, proxyServer *proxy.Server, config config.AdminConfig) *Server {
+	s := &Server{
+		manager: mgr,
+		proxy:   proxyServer,
+		config:  config,
+		mux:     http.NewServeMux(),
+		logger:  logger.New("admin"),
+	}
+
+	management := proxyServer.ManagementHandler()
+	s.mux.Handle("GET /health", management)
+	s.mux.Handle("GET /stats", management)
+	s.mux.Handle("GET /proxies", management)
+	s.mux.Handle("GET /proxy.pac", management)
+	s.mux.Handle("GET /wpad.dat", management)
+
+	s.mux.HandleFunc("GET /admin/status", s.handleStatus)
+	s.mux.HandleFunc("POST /admin/proxies", s.handleAddProxies)
+	s.mux.HandleFunc("GET /admin/proxies/{addr}", s.handleGetProxy)
+	s.mux.HandleFunc("DELETE /admin/proxies/{addr}", s.handleDeleteProxy)
+	s.mux.HandleFunc("POST /admin/proxies/{addr}/ban", s.handleBanProxy)
+	s.mux.HandleFunc("DELETE /admin/proxies/{addr}/ban", s.handleUnbanProxy)
+	s.mux.HandleFunc("POST /admin/proxies/{addr}/pin", s.handlePinProxy)
+	s.mux.HandleFunc("DELETE /admin/pin", s.handleUnpin)
+	s.mux.HandleFunc("GET /admin/bans", s.handleListBans)
+	s.mux.HandleFunc("POST /admin/refresh", s.handleRefresh)
+	s.mux.HandleFunc("POST /admin/recheck", s.handleRecheck)
+	s.mux.HandleFunc("POST /admin/pause", s.handlePause)
+	s.mux.HandleFunc("POST /admin/resume", s.handleResume)
+	s.mux.HandleFunc("DELETE /admin/cache", s.handlePurgeCache)
+
+	return s
+}
+
+func (s *Server) Start() error {
+	ln, err := listen(s.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    1 << 20,
+	}
+
+	return s.server.Serve(ln)
+}
+
+// listen opens a TCP listener, or a unix socket for "unix:/path" addresses.
+// A stale socket left by an unclean exit is removed first; any other file at
+// the path is an error.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("refusing to replace non-socket file %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return ln, nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	if s.server != nil {
+		return s.server.Shutdown(ctx)
+	}
+	return nil
+}
+
+// publicPaths are served without authentication: health probes and PAC files,
+// which browsers fetch without credentials.
+var publicPaths = map[string]bool{
+	"/health":    true,
+	"/proxy.pac": true,
+	"/wpad.dat":  true,
+}
+
+// ServeHTTP authenticates every request except publicPaths before routing it.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqID := logger.GenerateID()
+
+	if publicPaths[r.URL.Path] {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	if !s.checkAuth(r) {
+		s.logger.Warn(reqID, "Unauthorized admin request from %s to %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="aproxy-admin"`)
+		writeError(w, http.StatusUnauthorized, "admin authorization required")
+		return
+	}
+
+	s.logger.Info(reqID, "Admin %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	s.mux.ServeHTTP(w, r)
+}
+
+// checkAuth compares the bearer token in constant time.
+func (s *Server) checkAuth(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.config.AuthToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AuthToken)) == 1
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"paused":        s.manager.Paused(),
+		"refreshing":    s.manager.Refreshing(),
+		"pinned":        s.manager.PinnedProxy(),
+		"cached_count":  s.manager.Count(),
+		"healthy_count": s.manager.HealthyCount(),
+	})
+}
+
+// handleAddProxies imports proxies from a JSON {"proxies": [...]} body or a
+// plain-text list, one "proto://host:port" or "host:port" per line. Bare
+// addresses get the type from the "type" query parameter (default http).
+func (s *Server) handleAddProxies(w http.ResponseWriter, r *http.Request) {
+	defaultType := r.URL.Query().Get("type")
+	if defaultType == "" {
+		defaultType = "http"
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	var list io.Reader = body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Proxies []string `json:"proxies"`
+		}
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		list = strings.NewReader(strings.Join(req.Proxies, "\n"))
+	}
+
+	proxies, err := scraper.ParseList(list, defaultType)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read proxy list: "+err.Error())
+		return
+	}
+	if len(proxies) == 0 {
+		writeError(w, http.StatusBadRequest, "no valid proxies in request")
+		return
+	}
+
+	results := s.manager.AddProxies(r.Context(), proxies)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"submitted": len(proxies),
+		"results":   resultsJSON(results),
+	})
+}
+
+func (s *Server) handleGetProxy(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("history"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 500 {
+			writeError(w, http.StatusBadRequest, "history must be between 0 and 500")
+			return
+		}
+		limit = n
+	}
+
+	record, err := s.manager.GetProxyRecord(r.Context(), r.PathValue("addr"), limit)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	p := record.Proxy
+	checks := make([]map[string]any, len(record.Checks))
+	for i, c := range record.Checks {
+		checks[i] = map[string]any{
+			"status":           c.Status,
+			"response_time_ms": c.ResponseTimeMs,
+			"error":            c.Error,
+			"checked_at":       c.CheckedAt.UTC().Format(time.RFC3339),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"host":             p.Host,
+		"port":             p.Port,
+		"type":             p.ProxyType,
+		"country":          p.Country,
+		"anonymity":        p.Anonymity,
+		"status":           p.Status,
+		"response_time_ms": p.ResponseTimeMs,
+		"fail_count":       p.FailCount,
+		"first_seen_at":    p.FirstSeenAt.UTC().Format(time.RFC3339),
+		"last_checked_at":  formatTime(p.LastCheckedAt),
+		"last_healthy_at":  formatTime(p.LastHealthyAt),
+		"banned":           record.Banned,
+		"cached":           record.Cached,
+		"pinned":           record.Pinned,
+		"checks":           checks,
+	})
+}
+
+func (s *Server) handleDeleteProxy(w http.ResponseWriter, r *http.Request) {
+	if err := s.manager.DeleteProxy(r.Context(), r.PathValue("addr")); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleBanProxy(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+
+	if err := s.manager.BanProxy(r.Context(), r.PathValue("addr"), req.Reason); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleUnbanProxy(w http.ResponseWriter, r *http.Request) {
+	if err := s.manager.UnbanProxy(r.Context(), r.PathValue("addr")); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.manager.ListBans(r.Context())
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	list := make([]map[string]any, len(bans))
+	for i, b := range bans {
+		list[i] = map[string]any{
+			"address":   fmt.Sprintf("%s:%d", b.Host, b.Port),
+			"reason":    b.Reason,
+			"banned_at": b.BannedAt.UTC().Format(time.RFC3339),
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"bans": list, "count": len(bans)})
+}
+
+func (s *Server) handlePinProxy(w http.ResponseWriter, r *http.Request) {
+	if err := s.manager.PinProxy(r.PathValue("addr")); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	s.manager.UnpinProxy()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if err := s.manager.TriggerRefresh(); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"status": "refresh started"})
+}
+
+// handlePurgeCache empties the response cache, or with ?url= drops that URL.
+func (s *Server) handlePurgeCache(w http.ResponseWriter, r *http.Request) {
+	purged, ok := s.proxy.PurgeCache(r.URL.Query().Get("url"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "response cache is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"purged": purged})
+}
+
+func (s *Server) handleRecheck(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Addresses []string `json:"addresses"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(req.Addresses) == 0 {
+		writeError(w, http.StatusBadRequest, "addresses must not be empty")
+		return
+	}
+
+	results, err := s.manager.RecheckProxies(r.Context(), req.Addresses)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"requested": len(req.Addresses),
+		"results":   resultsJSON(results),
+	})
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	s.manager.Pause()
+	writeJSON(w, http.StatusOK, map[string]any{"paused": true})
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	s.manager.Resume()
+	writeJSON(w, http.StatusOK, map[string]any{"paused": false})
+}
+
+func resultsJSON(results []checker.CheckResult) []map[string]any {
+	list := make([]map[string]any, len(results))
+	for i, res := range results {
+		entry := map[string]any{
+			"address":          res.Proxy.Address(),
+			"type":             res.Proxy.Type,
+			"status":           res.Status.String(),
+			"response_time_ms": res.ResponseTime.Milliseconds(),
+		}
+		if res.Error != nil {
+			entry["error"] = res.Error.Error()
+		}
+		list[i] = entry
+	}
+	return list
+}
+
+func formatTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]any{"error": msg})
+}
+
+// writeManagerError maps manager errors onto HTTP status codes.
+func writeManagerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, manager.ErrProxyNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, manager.ErrRefreshInProgress):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, manager.ErrInvalidAddress):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
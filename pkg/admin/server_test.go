@@ -0,0 +1,313 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/database"
+	"aproxy/pkg/manager"
+	"aproxy/pkg/proxy"
+	"aproxy/pkg/rules"
+	"aproxy/pkg/scraper"
+)
+
+const testToken = "test-admin-token-0123456789"
+
+// newTestServer returns an admin server over a temporary database, and the
+// proxy server it manages.
+func newTestServer(t *testing.T) (*Server, *proxy.Server) {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "aproxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	mgr := manager.NewDBManager(db, &config.Config{Checker: config.CheckerConfig{
+		TestURL:    "http://check.example/",
+		Timeout:    5 * time.Second,
+		MaxWorkers: 2,
+		UserAgent:  "aproxy-test",
+	}})
+	engine, err := rules.NewEngine(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer := proxy.NewServer(mgr, config.ServerConfig{AuthToken: "proxy-token", HealthEndpoint: true}, engine)
+	return NewServer(mgr, proxyServer, config.AdminConfig{AuthToken: testToken}), proxyServer
+}
+
+// fakeProxy starts an HTTP proxy that answers every request itself, which
+// the checker takes as healthy, and returns its address.
+func fakeProxy(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "203.0.113.1")
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestAdminAuth(t *testing.T) {
+	s, _ := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	cases := []struct {
+		name   string
+		path   string
+		header string
+		status int
+	}{
+		{"no token", "/admin/status", "", http.StatusUnauthorized},
+		{"wrong token", "/admin/status", "Bearer wrong-token", http.StatusUnauthorized},
+		{"token as basic auth", "/admin/status", "Basic " + testToken, http.StatusUnauthorized},
+		{"stats without token", "/stats", "", http.StatusUnauthorized},
+		{"proxies without token", "/proxies", "", http.StatusUnauthorized},
+		{"valid token", "/admin/status", "Bearer " + testToken, http.StatusOK},
+		{"stats with token", "/stats", "Bearer " + testToken, http.StatusOK},
+		{"health is public", "/health", "", http.StatusServiceUnavailable}, // empty pool
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+c.path, nil)
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, c.status)
+			}
+			if c.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+
+	// An admin listener without a token refuses everything but /health
+	s.config.AuthToken = ""
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/status", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("empty configured token: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	addr := fakeProxy(t)
+	unknown := "192.0.2.1:8080"
+
+	// Requests run in order against the same pool
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/admin/proxies", "http://" + addr, http.StatusOK},
+		{"POST", "/admin/proxies", `{"proxies": []}`, http.StatusBadRequest},
+		{"POST", "/admin/proxies", `{"proxies": `, http.StatusBadRequest},
+		{"POST", "/admin/proxies", "not a proxy", http.StatusBadRequest},
+		{"GET", "/health", "", http.StatusOK},
+		{"GET", "/admin/proxies/" + addr, "", http.StatusOK},
+		{"GET", "/admin/proxies/" + addr + "?history=501", "", http.StatusBadRequest},
+		{"GET", "/admin/proxies/" + unknown, "", http.StatusNotFound},
+		{"GET", "/admin/proxies/not-an-address", "", http.StatusBadRequest},
+		{"POST", "/admin/proxies/" + addr + "/pin", "", http.StatusNoContent},
+		{"POST", "/admin/proxies/" + unknown + "/pin", "", http.StatusNotFound},
+		{"DELETE", "/admin/pin", "", http.StatusNoContent},
+		{"POST", "/admin/recheck", `{"addresses": ["` + addr + `"]}`, http.StatusOK},
+		{"POST", "/admin/recheck", `{"addresses": []}`, http.StatusBadRequest},
+		{"POST", "/admin/recheck", `[`, http.StatusBadRequest},
+		{"POST", "/admin/proxies/" + addr + "/ban", `{"reason": "abuse"}`, http.StatusNoContent},
+		{"POST", "/admin/proxies/" + addr + "/ban", `{"reason": `, http.StatusBadRequest},
+		{"POST", "/admin/proxies/not-an-address/ban", "", http.StatusBadRequest},
+		{"GET", "/admin/bans", "", http.StatusOK},
+		{"GET", "/health", "", http.StatusServiceUnavailable},
+		{"DELETE", "/admin/proxies/" + addr + "/ban", "", http.StatusNoContent},
+		{"DELETE", "/admin/proxies/" + addr, "", http.StatusNoContent},
+		{"DELETE", "/admin/proxies/" + addr, "", http.StatusNotFound},
+		{"DELETE", "/admin/proxies/" + unknown, "", http.StatusNotFound},
+		{"POST", "/admin/pause", "", http.StatusOK},
+		{"POST", "/admin/resume", "", http.StatusOK},
+		{"DELETE", "/admin/cache", "", http.StatusNotFound}, // response cache disabled
+		{"GET", "/admin/unknown", "", http.StatusNotFound},
+		{"PUT", "/admin/pause", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		if strings.HasPrefix(c.body, "{") || strings.HasPrefix(c.body, "[") {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s: status = %d %s, want %d", c.method, c.path, resp.StatusCode, body, c.status)
+		}
+	}
+
+	if s.manager.Paused() {
+		t.Error("manager still paused after /admin/resume")
+	}
+	if s.manager.Count() != 0 {
+		t.Errorf("%d proxies cached after delete, want 0", s.manager.Count())
+	}
+}
+
+func TestWriteManagerError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("lookup: %w", manager.ErrProxyNotFound), http.StatusNotFound},
+		{manager.ErrRefreshInProgress, http.StatusConflict},
+		{fmt.Errorf("%w %q", manager.ErrInvalidAddress, "x"), http.StatusBadRequest},
+		{errors.New("database is locked"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		writeManagerError(w, c.err)
+		if w.Code != c.status {
+			t.Errorf("%v: status = %d, want %d", c.err, w.Code, c.status)
+		}
+		if !strings.Contains(w.Body.String(), `"error"`) {
+			t.Errorf("%v: body %q has no error field", c.err, w.Body.String())
+		}
+	}
+}
+
+// get fetches url with header and returns the status.
+func get(t *testing.T, client *http.Client, url string, header http.Header) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	maps.Copy(req.Header, header)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestManagementMovesOffProxyPort(t *testing.T) {
+	s, proxyServer := newTestServer(t)
+	host, portStr, _ := net.SplitHostPort(fakeProxy(t))
+	port, _ := strconv.Atoi(portStr)
+	s.manager.AddProxies(context.Background(), []scraper.Proxy{{Host: host, Port: port, Type: "http"}})
+
+	proxyPort := httptest.NewServer(proxyServer)
+	defer proxyPort.Close()
+	management := httptest.NewServer(s)
+	defer management.Close()
+	client := http.DefaultClient
+	proxyAuth := http.Header{"Proxy-Authorization": {"Bearer proxy-token"}}
+	adminAuth := http.Header{"Authorization": {"Bearer " + testToken}}
+
+	// Without a management listener the proxy port serves everything
+	for _, path := range []string{"/stats", "/proxies"} {
+		if got := get(t, client, proxyPort.URL+path, proxyAuth); got != http.StatusOK {
+			t.Errorf("proxy port %s before DisableManagement: status = %d, want 200", path, got)
+		}
+	}
+
+	proxyServer.DisableManagement()
+	for _, path := range []string{"/stats", "/proxies"} {
+		if got := get(t, client, proxyPort.URL+path, proxyAuth); got == http.StatusOK {
+			t.Errorf("proxy port still serves %s", path)
+		}
+		if got := get(t, client, management.URL+path, adminAuth); got != http.StatusOK {
+			t.Errorf("management %s: status = %d, want 200", path, got)
+		}
+	}
+
+	// /health needs no token on either listener
+	for _, url := range []string{proxyPort.URL, management.URL} {
+		if got := get(t, client, url+"/health", nil); got != http.StatusOK {
+			t.Errorf("%s/health: status = %d, want 200", url, got)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, so stay out of t.TempDir()
+	dir, err := os.MkdirTemp("", "aproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	// Leave a stale socket behind, as a crash would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket not left behind: %v", err)
+	}
+
+	ln, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %v, %v; want 0660", fi.Mode().Perm(), err)
+	}
+
+	s, _ := newTestServer(t)
+	go http.Serve(ln, s)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	if got := get(t, client, "http://admin/admin/status", nil); got != http.StatusUnauthorized {
+		t.Errorf("status without token over the socket = %d, want 401", got)
+	}
+	if got := get(t, client, "http://admin/admin/status", http.Header{"Authorization": {"Bearer " + testToken}}); got != http.StatusOK {
+		t.Errorf("status over the socket = %d, want 200", got)
+	}
+
+	// Anything else at the path is left alone
+	other := filepath.Join(dir, "data.db")
+	os.WriteFile(other, []byte("keep"), 0600)
+	if _, err := listen("unix:" + other); err == nil {
+		t.Error("listen replaced a regular file")
+	}
+	if data, _ := os.ReadFile(other); string(data) != "keep" {
+		t.Errorf("regular file changed to %q", data)
+	}
+}
@@ -3,6 +3,7 @@ package checker
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -55,6 +56,7 @@ type Checker struct {
 	timeout    time.Duration
 	maxWorkers int
 	userAgent  string
+	verifyTLS  bool
 	logger     *logger.Logger
 }
 
@@ -64,12 +66,18 @@ func NewChecker(config config.CheckerConfig) *Checker {
 		timeout:    config.Timeout,
 		maxWorkers: config.MaxWorkers,
 		userAgent:  config.UserAgent,
+		verifyTLS:  config.VerifyTLS,
 		logger:     logger.New("checker"),
 	}
 }
 
 func (c *Checker) CheckProxy(ctx context.Context, proxy scraper.Proxy) CheckResult {
 	start := time.Now()
+	if proxy.Type == "https" {
+		// Lists call both TLS proxies and plain ones that support CONNECT "https"
+		proxy.TLS = c.expectsTLS(ctx, proxy)
+	}
+	proxy.VerifyTLS = proxy.TLS && c.verifyTLS
 	result := CheckResult{
 		Proxy:     proxy,
 		CheckedAt: start,
@@ -183,10 +191,55 @@ func (c *Checker) buildTransport(proxy scraper.Proxy) (*http.Transport, error) {
 		return nil, err
 	}
 	transport.Proxy = http.ProxyURL(proxyURL)
-	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 0}).DialContext
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 0}
+	transport.DialContext = dialer.DialContext
+	if proxy.TLS {
+		// Speak TLS to the proxy itself; the transport's TLSClientConfig is
+		// for the target
+		tlsConfig := proxyTLSConfig(proxy, proxy.VerifyTLS)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("TLS to proxy: %w", err)
+			}
+			return tlsConn, nil
+		}
+	}
 	return transport, nil
 }
 
+// proxyTLSConfig is the client config for speaking TLS to proxy, sending its
+// host as SNI.
+func proxyTLSConfig(proxy scraper.Proxy, verify bool) *tls.Config {
+	return &tls.Config{ServerName: proxy.Host, InsecureSkipVerify: !verify}
+}
+
+// expectsTLS probes whether proxy answers a TLS handshake. A plain HTTP proxy
+// replies to the ClientHello with an HTTP error, which fails the handshake.
+// The certificate isn't checked here; that is up to the health check.
+func (c *Checker) expectsTLS(ctx context.Context, proxy scraper.Proxy) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", proxy.Address())
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	err = tls.Client(conn, proxyTLSConfig(proxy, false)).HandshakeContext(ctx)
+	var recordErr tls.RecordHeaderError
+	if err != nil && !errors.As(err, &recordErr) {
+		c.logger.DebugBg("TLS probe of %s failed: %v", proxy.Address(), err)
+	}
+	return err == nil
+}
+
 // runCheck issues the test request over the transport and classifies the result.
 func (c *Checker) runCheck(ctx context.Context, transport *http.Transport) (ProxyStatus, error) {
 	client := &http.Client{
@@ -245,7 +298,9 @@ func FilterHealthyProxies(results []CheckResult) []scraper.Proxy {
 	var healthy []scraper.Proxy
 	for _, result := range results {
 		if result.Status == StatusHealthy {
-			healthy = append(healthy, result.Proxy)
+			proxy := result.Proxy
+			proxy.Latency = result.ResponseTime
+			healthy = append(healthy, proxy)
 		}
 	}
 	return healthy
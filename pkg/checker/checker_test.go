@@ -0,0 +1,79 @@
+package checker
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/scraper"
+)
+
+// forwardHandler proxies absolute-URI requests, as an HTTP proxy does.
+func forwardHandler(transport *http.Transport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := r.Clone(r.Context())
+		req.RequestURI = ""
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+}
+
+func proxyFor(t *testing.T, srv *httptest.Server) scraper.Proxy {
+	t.Helper()
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return scraper.Proxy{Host: host, Port: port, Type: "https"}
+}
+
+func TestCheckTLSProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "203.0.113.1")
+	}))
+	defer target.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	tlsProxy := httptest.NewTLSServer(forwardHandler(transport))
+	defer tlsProxy.Close()
+	plainProxy := httptest.NewServer(forwardHandler(transport))
+	defer plainProxy.Close()
+
+	cfg := config.CheckerConfig{TestURL: target.URL, Timeout: 5 * time.Second, MaxWorkers: 1, UserAgent: "aproxy-test"}
+
+	cases := []struct {
+		name        string
+		proxy       scraper.Proxy
+		verify      bool
+		wantTLS     bool
+		wantHealthy bool
+	}{
+		{"listed https, plain proxy", proxyFor(t, plainProxy), false, false, true},
+		{"listed https, TLS proxy", proxyFor(t, tlsProxy), false, true, true},
+		// httptest's certificate isn't trusted by the system roots
+		{"untrusted certificate with verification", proxyFor(t, tlsProxy), true, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg.VerifyTLS = c.verify
+			result := NewChecker(cfg).CheckProxy(context.Background(), c.proxy)
+			if result.Proxy.TLS != c.wantTLS {
+				t.Errorf("TLS = %v, want %v", result.Proxy.TLS, c.wantTLS)
+			}
+			if healthy := result.Status == StatusHealthy; healthy != c.wantHealthy {
+				t.Errorf("status = %s (%v), want healthy %v", result.Status, result.Error, c.wantHealthy)
+			}
+		})
+	}
+}
@@ -201,7 +201,7 @@ func (c *DBChecker) CheckProxiesWithCaching(ctx context.Context, proxies []scrap
 }
 
 // dbProxyToResult converts a stored proxy row into a cached CheckResult.
-func dbProxyToResult(dbProxy *database.Proxy) CheckResult {
+func (c *DBChecker) dbProxyToResult(dbProxy *database.Proxy) CheckResult {
 	proxy := scraper.Proxy{
 		Host: dbProxy.Host,
 		Port: int(dbProxy.Port),
@@ -210,6 +210,7 @@ func dbProxyToResult(dbProxy *database.Proxy) CheckResult {
 	if dbProxy.Country != nil {
 		proxy.Country = *dbProxy.Country
 	}
+	c.storedTLS(&proxy, dbProxy)
 
 	status := StatusUnknown
 	switch dbProxy.Status {
@@ -237,7 +238,7 @@ func dbProxyToResult(dbProxy *database.Proxy) CheckResult {
 func (c *DBChecker) getCachedResults(ctx context.Context, dbProxies []*database.Proxy) []CheckResult {
 	results := make([]CheckResult, 0, len(dbProxies))
 	for _, dbProxy := range dbProxies {
-		results = append(results, dbProxyToResult(dbProxy))
+		results = append(results, c.dbProxyToResult(dbProxy))
 	}
 	return results
 }
@@ -255,7 +256,7 @@ func (c *DBChecker) getAllResults(ctx context.Context, dbProxies []*database.Pro
 		if fresh, ok := freshMap[addr]; ok {
 			allResults = append(allResults, fresh)
 		} else {
-			allResults = append(allResults, dbProxyToResult(dbProxy))
+			allResults = append(allResults, c.dbProxyToResult(dbProxy))
 		}
 	}
 
@@ -269,6 +270,11 @@ func (c *DBChecker) GetHealthyProxiesFromDB(ctx context.Context) ([]scraper.Prox
 		return nil, fmt.Errorf("failed to get healthy proxies from database: %w", err)
 	}
 
+	rates, err := c.dbService.GetSuccessRates(ctx)
+	if err != nil {
+		c.logger.WarnBg("Failed to load success rates: %v", err)
+	}
+
 	proxies := make([]scraper.Proxy, 0, len(dbProxies))
 	for _, dbProxy := range dbProxies {
 		proxy := scraper.Proxy{
@@ -283,6 +289,8 @@ func (c *DBChecker) GetHealthyProxiesFromDB(ctx context.Context) ([]scraper.Prox
 		if dbProxy.LastHealthyAt != nil {
 			proxy.LastSeen = *dbProxy.LastHealthyAt
 		}
+		c.storedTLS(&proxy, &dbProxy)
+		annotate(&proxy, &dbProxy, rates)
 
 		proxies = append(proxies, proxy)
 	}
@@ -290,6 +298,91 @@ func (c *DBChecker) GetHealthyProxiesFromDB(ctx context.Context) ([]scraper.Prox
 	return proxies, nil
 }
 
+// AnnotateProxies fills in stored anonymity and success rates, and latency
+// where the proxy has none yet.
+func (c *DBChecker) AnnotateProxies(ctx context.Context, proxies []scraper.Proxy) {
+	addresses := make([]string, len(proxies))
+	for i, p := range proxies {
+		addresses[i] = p.Address()
+	}
+
+	dbProxies, err := c.dbService.GetProxiesByAddresses(ctx, addresses)
+	if err != nil {
+		c.logger.WarnBg("Failed to load proxies for annotation: %v", err)
+		return
+	}
+	rates, err := c.dbService.GetSuccessRates(ctx)
+	if err != nil {
+		c.logger.WarnBg("Failed to load success rates: %v", err)
+	}
+
+	for i := range proxies {
+		if dbProxy, ok := dbProxies[proxies[i].Address()]; ok {
+			annotate(&proxies[i], dbProxy, rates)
+		}
+	}
+}
+
+// annotate copies health metadata from a stored row onto proxy.
+func annotate(proxy *scraper.Proxy, dbProxy *database.Proxy, rates map[string]float64) {
+	if dbProxy.Anonymity != nil {
+		proxy.Anonymity = *dbProxy.Anonymity
+	}
+	if proxy.Latency == 0 && dbProxy.ResponseTimeMs != nil {
+		proxy.Latency = time.Duration(*dbProxy.ResponseTimeMs) * time.Millisecond
+	}
+	proxy.SuccessRate = rates[proxy.Address()]
+}
+
+// storedTLS marks proxy as speaking TLS if its last check found it so.
+func (c *DBChecker) storedTLS(proxy *scraper.Proxy, dbProxy *database.Proxy) {
+	proxy.TLS = dbProxy.Https != nil && *dbProxy.Https
+	proxy.VerifyTLS = proxy.TLS && c.verifyTLS
+}
+
+// RecheckProxies checks the given proxies immediately, ignoring the check
+// interval, and stores the results. Proxies not yet in the database are added.
+func (c *DBChecker) RecheckProxies(ctx context.Context, proxies []scraper.Proxy) []CheckResult {
+	if len(proxies) == 0 {
+		return nil
+	}
+
+	ids := make(map[string]int64, len(proxies))
+	for _, proxy := range proxies {
+		dbProxy, err := c.dbService.UpsertProxy(ctx, proxy)
+		if err != nil {
+			c.logger.WarnBg("Failed to upsert proxy %s: %v", proxy.Address(), err)
+			continue
+		}
+		ids[proxy.Address()] = dbProxy.ID
+	}
+
+	results := c.Checker.CheckProxies(ctx, proxies)
+
+	updates := make(map[int32]database.CheckResult, len(results))
+	for _, result := range results {
+		id, ok := ids[result.Proxy.Address()]
+		if !ok {
+			continue
+		}
+		updates[int32(id)] = database.CheckResult{
+			Proxy:        result.Proxy,
+			Status:       database.ProxyStatus(result.Status),
+			ResponseTime: result.ResponseTime,
+			Error:        result.Error,
+			CheckedAt:    result.CheckedAt,
+		}
+	}
+
+	updateCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.dbService.BatchUpdateProxyHealth(updateCtx, updates); err != nil {
+		c.logger.WarnBg("Failed to store recheck results: %v", err)
+	}
+
+	return results
+}
+
 // CleanupOldProxies removes proxies that haven't been healthy for a long time
 func (c *DBChecker) CleanupOldProxies(ctx context.Context, maxAge time.Duration) error {
 	return c.dbService.CleanupOldProxies(ctx, maxAge)
@@ -0,0 +1,309 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"aproxy/internal/database"
+	"aproxy/pkg/checker"
+	"aproxy/pkg/scraper"
+)
+
+var (
+	// ErrProxyNotFound is returned when an operator names a proxy the database doesn't know.
+	ErrProxyNotFound = errors.New("proxy not found")
+	// ErrInvalidAddress is returned for addresses that aren't "host:port".
+	ErrInvalidAddress = errors.New("invalid proxy address")
+)
+
+// ProxyRecord is a proxy's stored row plus its recent check history.
+type ProxyRecord struct {
+	Proxy  *database.Proxy
+	Checks []database.ProxyCheck
+	Banned bool
+	Cached bool
+	Pinned bool
+}
+
+// AddProxies checks the given proxies immediately, stores them, and adds the
+// healthy ones to the pool. Banned proxies are skipped.
+func (m *DBManager) AddProxies(ctx context.Context, proxies []scraper.Proxy) []checker.CheckResult {
+	proxies = m.withoutBanned(ctx, proxies)
+	results := m.dbChecker.RecheckProxies(ctx, proxies)
+	m.applyResults(results)
+	return results
+}
+
+// RecheckProxies re-runs the health check for the given host:port addresses,
+// ignoring the check interval. Addresses not in the database are skipped.
+func (m *DBManager) RecheckProxies(ctx context.Context, addresses []string) ([]checker.CheckResult, error) {
+	existing, err := m.dbService.GetProxiesByAddresses(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies := make([]scraper.Proxy, 0, len(existing))
+	for _, dbProxy := range existing {
+		proxies = append(proxies, dbProxyToProxy(dbProxy))
+	}
+
+	results := m.dbChecker.RecheckProxies(ctx, m.withoutBanned(ctx, proxies))
+	m.applyResults(results)
+	return results, nil
+}
+
+// DeleteProxy removes a proxy from the database and the pool. It may come back
+// on the next scrape; use BanProxy to keep it out.
+func (m *DBManager) DeleteProxy(ctx context.Context, addr string) error {
+	host, port, err := parseAddress(addr)
+	if err != nil {
+		return err
+	}
+	n, err := m.dbService.DeleteProxy(ctx, host, port)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrProxyNotFound, addr)
+	}
+	m.removeFromCache(addr)
+
+	m.mu.Lock()
+	if m.pinned == addr {
+		m.pinned = ""
+	}
+	m.mu.Unlock()
+
+	m.logger.InfoBg("Deleted proxy %s", addr)
+	return nil
+}
+
+// BanProxy bans a proxy so it never re-enters the pool, and removes it now.
+func (m *DBManager) BanProxy(ctx context.Context, addr, reason string) error {
+	host, port, err := parseAddress(addr)
+	if err != nil {
+		return err
+	}
+	if err := m.dbService.BanProxy(ctx, host, port, reason); err != nil {
+		return err
+	}
+	m.removeFromCache(addr)
+
+	m.mu.Lock()
+	if m.pinned == addr {
+		m.pinned = ""
+	}
+	m.mu.Unlock()
+
+	m.logger.InfoBg("Banned proxy %s (reason: %q)", addr, reason)
+	return nil
+}
+
+// UnbanProxy lifts a ban. The proxy rejoins the pool after its next healthy check.
+func (m *DBManager) UnbanProxy(ctx context.Context, addr string) error {
+	host, port, err := parseAddress(addr)
+	if err != nil {
+		return err
+	}
+	if err := m.dbService.UnbanProxy(ctx, host, port); err != nil {
+		return err
+	}
+	m.logger.InfoBg("Unbanned proxy %s", addr)
+	return nil
+}
+
+// ListBans returns all banned proxies, newest first.
+func (m *DBManager) ListBans(ctx context.Context) ([]database.ProxyBan, error) {
+	return m.dbService.ListBans(ctx)
+}
+
+// PinProxy makes GetNextProxy prefer addr for as long as it stays in the pool.
+func (m *DBManager) PinProxy(addr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.cachedProxies {
+		if p.Address() == addr {
+			m.pinned = addr
+			m.logger.InfoBg("Pinned proxy %s", addr)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w in the healthy pool: %s", ErrProxyNotFound, addr)
+}
+
+// UnpinProxy restores plain round-robin selection.
+func (m *DBManager) UnpinProxy() {
+	m.mu.Lock()
+	m.pinned = ""
+	m.mu.Unlock()
+}
+
+// PinnedProxy returns the pinned address, or "" if none.
+func (m *DBManager) PinnedProxy() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pinned
+}
+
+// GetProxyRecord returns the stored record for addr with up to historyLimit checks.
+func (m *DBManager) GetProxyRecord(ctx context.Context, addr string, historyLimit int) (*ProxyRecord, error) {
+	host, port, err := parseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dbProxy, err := m.dbService.GetProxyByHostPort(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if dbProxy == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProxyNotFound, addr)
+	}
+
+	checks, err := m.dbService.GetProxyChecks(ctx, dbProxy.ID, historyLimit)
+	if err != nil {
+		return nil, err
+	}
+	banned, err := m.dbService.GetBannedAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &ProxyRecord{Proxy: dbProxy, Checks: checks, Banned: banned[addr]}
+
+	m.mu.RLock()
+	for _, p := range m.cachedProxies {
+		if p.Address() == addr {
+			record.Cached = true
+			break
+		}
+	}
+	record.Pinned = m.pinned == addr
+	m.mu.RUnlock()
+
+	return record, nil
+}
+
+// TriggerRefresh starts RefreshProxies in the background and returns at once.
+func (m *DBManager) TriggerRefresh() error {
+	if !m.refreshing.CompareAndSwap(false, true) {
+		return ErrRefreshInProgress
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.refreshing.Store(false)
+		if err := m.refresh(); err != nil {
+			m.logger.WarnBg("Triggered refresh failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Refreshing reports whether a refresh is currently running.
+func (m *DBManager) Refreshing() bool {
+	return m.refreshing.Load()
+}
+
+// Pause suspends the scheduled refresh and cache reload loops. Operator-triggered
+// refreshes and rechecks still run.
+func (m *DBManager) Pause() {
+	if !m.paused.Swap(true) {
+		m.logger.InfoBg("Background operations paused")
+	}
+}
+
+// Resume re-enables the background loops.
+func (m *DBManager) Resume() {
+	if m.paused.Swap(false) {
+		m.logger.InfoBg("Background operations resumed")
+	}
+}
+
+// Paused reports whether background operations are paused.
+func (m *DBManager) Paused() bool {
+	return m.paused.Load()
+}
+
+// applyResults adds healthy results to the cache and drops the rest.
+func (m *DBManager) applyResults(results []checker.CheckResult) {
+	for _, result := range results {
+		if result.Status != checker.StatusHealthy {
+			m.removeFromCache(result.Proxy.Address())
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cached := make(map[string]bool, len(m.cachedProxies))
+	for _, p := range m.cachedProxies {
+		cached[p.Address()] = true
+	}
+	for _, result := range results {
+		if result.Status == checker.StatusHealthy && !cached[result.Proxy.Address()] {
+			proxy := result.Proxy
+			proxy.Latency = result.ResponseTime
+			m.cachedProxies = append(m.cachedProxies, proxy)
+			cached[result.Proxy.Address()] = true
+		}
+	}
+}
+
+// withoutBanned filters banned proxies out of the list. On a database error the
+// list is returned unchanged.
+func (m *DBManager) withoutBanned(ctx context.Context, proxies []scraper.Proxy) []scraper.Proxy {
+	banned, err := m.dbService.GetBannedAddresses(ctx)
+	if err != nil {
+		m.logger.WarnBg("Failed to load bans: %v", err)
+		return proxies
+	}
+	if len(banned) == 0 {
+		return proxies
+	}
+
+	kept := make([]scraper.Proxy, 0, len(proxies))
+	for _, p := range proxies {
+		if !banned[p.Address()] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// dbProxyToProxy converts a stored row back into a scraper.Proxy.
+func dbProxyToProxy(dbProxy *database.Proxy) scraper.Proxy {
+	proxy := scraper.Proxy{
+		Host: dbProxy.Host,
+		Port: int(dbProxy.Port),
+		Type: dbProxy.ProxyType,
+	}
+	if dbProxy.Country != nil {
+		proxy.Country = *dbProxy.Country
+	}
+	if dbProxy.LastHealthyAt != nil {
+		proxy.LastSeen = *dbProxy.LastHealthyAt
+	}
+	if dbProxy.Anonymity != nil {
+		proxy.Anonymity = *dbProxy.Anonymity
+	}
+	return proxy
+}
+
+// parseAddress splits a "host:port" address.
+func parseAddress(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w %q: %v", ErrInvalidAddress, addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("%w %q: bad port", ErrInvalidAddress, addr)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,189 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/database"
+	"aproxy/pkg/checker"
+	"aproxy/pkg/scraper"
+)
+
+// newTestManager returns a manager over a temporary database whose checks
+// pass for any proxy that answers HTTP (see fakeProxy).
+func newTestManager(t *testing.T) *DBManager {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "aproxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewDBManager(db, &config.Config{Checker: config.CheckerConfig{
+		TestURL:    "http://check.example/",
+		Timeout:    5 * time.Second,
+		MaxWorkers: 2,
+		UserAgent:  "aproxy-test",
+	}})
+}
+
+// fakeProxy starts an HTTP proxy that answers every request itself, which
+// the checker takes as healthy.
+func fakeProxy(t *testing.T) scraper.Proxy {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "203.0.113.1")
+	}))
+	t.Cleanup(srv.Close)
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return scraper.Proxy{Host: host, Port: port, Type: "http"}
+}
+
+// addHealthy imports p and fails the test unless it joins the pool.
+func addHealthy(t *testing.T, m *DBManager, p scraper.Proxy) {
+	t.Helper()
+	results := m.AddProxies(context.Background(), []scraper.Proxy{p})
+	if len(results) != 1 || results[0].Status != checker.StatusHealthy {
+		t.Fatalf("AddProxies(%s) = %+v, want one healthy result", p.Address(), results)
+	}
+}
+
+func cached(m *DBManager, addr string) bool {
+	for _, p := range m.GetHealthyProxies() {
+		if p.Address() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBanProxy(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t)
+	p := fakeProxy(t)
+	addHealthy(t, m, p)
+	if err := m.PinProxy(p.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.BanProxy(ctx, p.Address(), "abuse"); err != nil {
+		t.Fatal(err)
+	}
+	if cached(m, p.Address()) {
+		t.Error("banned proxy still in the pool")
+	}
+	if m.PinnedProxy() != "" {
+		t.Error("banned proxy still pinned")
+	}
+	bans, err := m.ListBans(ctx)
+	if err != nil || len(bans) != 1 || bans[0].Reason == nil || *bans[0].Reason != "abuse" {
+		t.Fatalf("ListBans = %+v, %v; want the ban", bans, err)
+	}
+	record, err := m.GetProxyRecord(ctx, p.Address(), 10)
+	if err != nil || !record.Banned || record.Cached || len(record.Checks) != 1 {
+		t.Fatalf("GetProxyRecord = %+v, %v; want banned, out of the pool, one check", record, err)
+	}
+
+	// Imports and rechecks skip it until it is unbanned
+	if results := m.AddProxies(ctx, []scraper.Proxy{p}); len(results) != 0 {
+		t.Errorf("banned proxy was checked: %+v", results)
+	}
+	if results, err := m.RecheckProxies(ctx, []string{p.Address()}); err != nil || len(results) != 0 {
+		t.Errorf("RecheckProxies = %+v, %v; want the banned proxy skipped", results, err)
+	}
+	if err := m.UnbanProxy(ctx, p.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if bans, _ := m.ListBans(ctx); len(bans) != 0 {
+		t.Errorf("ban kept after UnbanProxy: %+v", bans)
+	}
+	addHealthy(t, m, p)
+	if !cached(m, p.Address()) {
+		t.Error("unbanned proxy did not rejoin the pool")
+	}
+}
+
+func TestPinProxy(t *testing.T) {
+	m := newTestManager(t)
+	first, second := fakeProxy(t), fakeProxy(t)
+	addHealthy(t, m, first)
+	addHealthy(t, m, second)
+
+	if err := m.PinProxy("192.0.2.1:8080"); !errors.Is(err, ErrProxyNotFound) {
+		t.Errorf("pinning a proxy outside the pool: %v, want ErrProxyNotFound", err)
+	}
+	if err := m.PinProxy(second.Address()); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if p, err := m.GetNextProxy(); err != nil || p.Address() != second.Address() {
+			t.Fatalf("GetNextProxy = %v, %v; want the pinned %s", p, err, second.Address())
+		}
+	}
+	record, err := m.GetProxyRecord(context.Background(), second.Address(), 0)
+	if err != nil || !record.Pinned || !record.Cached {
+		t.Errorf("GetProxyRecord = %+v, %v; want pinned and cached", record, err)
+	}
+
+	m.UnpinProxy()
+	seen := map[string]bool{}
+	for range 2 {
+		p, err := m.GetNextProxy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[p.Address()] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("round-robin after UnpinProxy gave %v, want both proxies", seen)
+	}
+}
+
+func TestDeleteProxy(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t)
+	p := fakeProxy(t)
+	addHealthy(t, m, p)
+	if err := m.PinProxy(p.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.DeleteProxy(ctx, p.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if cached(m, p.Address()) {
+		t.Error("deleted proxy still in the pool")
+	}
+	if _, err := m.GetProxyRecord(ctx, p.Address(), 0); !errors.Is(err, ErrProxyNotFound) {
+		t.Errorf("GetProxyRecord after delete: %v, want ErrProxyNotFound", err)
+	}
+	if err := m.DeleteProxy(ctx, p.Address()); !errors.Is(err, ErrProxyNotFound) {
+		t.Errorf("deleting it again: %v, want ErrProxyNotFound", err)
+	}
+
+	// Scraped back, it is an ordinary pool member again
+	addHealthy(t, m, p)
+	if pinned := m.PinnedProxy(); pinned != "" {
+		t.Errorf("deleted proxy came back pinned: %s", pinned)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for _, addr := range []string{"10.0.0.1", "10.0.0.1:0", "10.0.0.1:65536", "10.0.0.1:http"} {
+		if _, _, err := parseAddress(addr); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("parseAddress(%q) = %v, want ErrInvalidAddress", addr, err)
+		}
+	}
+	if host, port, err := parseAddress("[2001:db8::1]:1080"); err != nil || host != "2001:db8::1" || port != 1080 {
+		t.Errorf("parseAddress IPv6 = %s %d %v", host, port, err)
+	}
+}
@@ -2,9 +2,12 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"aproxy/internal/config"
@@ -38,11 +41,33 @@ type DBManager struct {
 	currentIndex  int
 	mu            sync.RWMutex
 
+	// Operator controls (see admin.go)
+	pinned     string // address preferred by GetNextProxy while it's in the cache
+	paused     atomic.Bool
+	refreshing atomic.Bool
+
+	// politeness spaces out hits on each target host (see politeness.go)
+	politeness *politeness
+	// reputation scores proxies per target host (see reputation.go)
+	reputation *reputation
+	// presets are the named selections of listener ports (see presets.go)
+	presets map[string]Preset
+	// sessions maps each Selection.Session to the address it was given;
+	// created on first use
+	sessions map[string]string
+
+	// evictHooks are told about proxies that leave the cache (see OnEvict)
+	evictHooks []func(addr string)
+
 	// Configuration
 	backgroundEnabled bool
 	updateInterval    time.Duration
+	persistInterval   time.Duration
 }
 
+// ErrRefreshInProgress is returned when a refresh is requested while one is running.
+var ErrRefreshInProgress = errors.New("proxy refresh already in progress")
+
 // NewDBManager creates a new database-backed manager with configuration
 func NewDBManager(db *database.DB, cfg *config.Config) *DBManager {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -57,6 +82,10 @@ func NewDBManager(db *database.DB, cfg *config.Config) *DBManager {
 		ctx:               ctx,
 		cancel:            cancel,
 		cachedProxies:     make([]scraper.Proxy, 0),
+		politeness:        newPoliteness(cfg.Proxy.Politeness),
+		reputation:        newReputation(cfg.Proxy.Reputation),
+		presets:           newPresets(cfg.Proxy.Presets),
+		persistInterval:   cfg.Proxy.Reputation.PersistInterval,
 		backgroundEnabled: cfg.Checker.BackgroundEnabled,
 		logger:            logger.New("manager"),
 	}
@@ -72,8 +101,15 @@ func (m *DBManager) Start(updateInterval time.Duration) error {
 		m.logger.WarnBg("Failed to load existing proxies: %v", err)
 	}
 
+	if err := m.loadReputation(); err != nil {
+		m.logger.WarnBg("Failed to load per-target proxy stats: %v", err)
+	}
+
 	m.logger.InfoBg("Database proxy manager started with %d cached proxies", len(m.cachedProxies))
 
+	m.wg.Add(1)
+	go m.reputationLoop(m.persistInterval)
+
 	// Start background operations if enabled
 	if m.backgroundEnabled {
 		m.logger.InfoBg("Starting background proxy operations...")
@@ -121,6 +157,15 @@ func (m *DBManager) Stop() {
 
 // RefreshProxies scrapes new proxies and checks them with caching
 func (m *DBManager) RefreshProxies() error {
+	if !m.refreshing.CompareAndSwap(false, true) {
+		return ErrRefreshInProgress
+	}
+	defer m.refreshing.Store(false)
+	return m.refresh()
+}
+
+// refresh does the work of RefreshProxies; the caller holds the refreshing flag.
+func (m *DBManager) refresh() error {
 	m.logger.InfoBg("Refreshing proxy list with database caching...")
 
 	// Use manager's context to respect cancellation, but with timeout
@@ -133,21 +178,20 @@ func (m *DBManager) RefreshProxies() error {
 		return fmt.Errorf("failed to scrape proxies: %w", err)
 	}
 
+	proxies = m.withoutBanned(ctx, proxies)
+
 	m.logger.InfoBg("Scraped %d proxies, checking health with caching...", len(proxies))
 
 	// Use database-backed checker with caching and progressive updates
 	results := m.dbChecker.CheckProxiesWithCaching(ctx, proxies)
 	healthyProxies := checker.FilterHealthyProxies(results)
+	m.dbChecker.AnnotateProxies(ctx, healthyProxies)
 
 	m.logger.InfoBg("Found %d healthy proxies out of %d checked", len(healthyProxies), len(results))
 
 	// Update in-memory cache
-	m.mu.Lock()
-	oldCount := len(m.cachedProxies)
-	m.cachedProxies = healthyProxies
-	m.currentIndex = 0
-	newCount := len(m.cachedProxies)
-	m.mu.Unlock()
+	oldCount := m.setCache(healthyProxies)
+	newCount := len(healthyProxies)
 
 	m.logger.InfoBg("Updated proxy cache: %d -> %d healthy proxies", oldCount, newCount)
 
@@ -182,17 +226,39 @@ func (m *DBManager) loadHealthyProxies() error {
 		return fmt.Errorf("failed to load healthy proxies: %w", err)
 	}
 
-	m.mu.Lock()
-	m.cachedProxies = proxies
-	m.currentIndex = 0
-	m.mu.Unlock()
+	m.setCache(proxies)
 
 	m.logger.InfoBg("Loaded %d healthy proxies from database", len(proxies))
 	return nil
 }
 
+// Selection describes which pool proxy a request wants. The zero value
+// accepts any proxy.
+type Selection struct {
+	Filter ProxyFilter
+	// Target is the host the request is going to. When set, proxies still
+	// cooling down for it are skipped (see config.PolitenessConfig).
+	Target string
+	// Session, when set, keeps returning the proxy first selected for it
+	// while that proxy is in the cache and usable for Target. While it is
+	// only cooling down for Target, other proxies stand in without taking
+	// over the session.
+	Session string
+}
+
 // GetNextProxy returns the next proxy in round-robin fashion
 func (m *DBManager) GetNextProxy() (*scraper.Proxy, error) {
+	return m.SelectProxy(Selection{})
+}
+
+// SelectProxy returns a proxy that satisfies sel, preferring the pinned proxy
+// and then the session's proxy if they qualify. Otherwise it takes up to
+// reputation.candidates matches in round-robin order and returns the one
+// with the best record against sel.Target, skipping proxies the target
+// recently blocked unless nothing else matches. If every match is cooling
+// down for sel.Target it returns a *CooldownError. The hit only counts
+// towards the cooldown once the caller reports it with RecordHit.
+func (m *DBManager) SelectProxy(sel Selection) (*scraper.Proxy, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -200,10 +266,83 @@ func (m *DBManager) GetNextProxy() (*scraper.Proxy, error) {
 		return nil, fmt.Errorf("no healthy proxies available")
 	}
 
-	proxy := &m.cachedProxies[m.currentIndex]
-	m.currentIndex = (m.currentIndex + 1) % len(m.cachedProxies)
+	now := time.Now()
+	var retryAfter time.Duration // shortest cooldown among matches
+	usable := func(p *scraper.Proxy) bool {
+		if !sel.Filter.Match(*p) {
+			return false
+		}
+		if sel.Target == "" {
+			return true
+		}
+		wait := m.politeness.wait(p.Address(), sel.Target, now)
+		if wait > 0 {
+			if retryAfter == 0 || wait < retryAfter {
+				retryAfter = wait
+			}
+			return false
+		}
+		return true
+	}
 
-	return proxy, nil
+	keepSession := false // the session's proxy is only cooling down
+	for _, preferred := range []string{m.pinned, m.sessions[sel.Session]} {
+		if preferred == "" {
+			continue
+		}
+		for i := range m.cachedProxies {
+			p := &m.cachedProxies[i]
+			if p.Address() != preferred {
+				continue
+			}
+			blocked := m.reputation.blocked(p.Address(), sel.Target, now)
+			if usable(p) && !blocked {
+				return p, nil
+			}
+			if preferred == m.sessions[sel.Session] && sel.Filter.Match(*p) && !blocked {
+				keepSession = true
+			}
+		}
+	}
+
+	n := len(m.cachedProxies)
+	best, fallback := -1, -1
+	var bestScore float64
+	for i, seen := 0, 0; i < n && seen < m.reputation.candidates; i++ {
+		idx := (m.currentIndex + i) % n
+		p := &m.cachedProxies[idx]
+		if !usable(p) {
+			continue
+		}
+		if m.reputation.blocked(p.Address(), sel.Target, now) {
+			if fallback < 0 {
+				fallback = idx
+			}
+			continue
+		}
+		seen++
+		if score := m.reputation.score(p.Address(), sel.Target, now); best < 0 || score > bestScore {
+			best, bestScore = idx, score
+		}
+	}
+	if best < 0 {
+		best = fallback
+	}
+	if best >= 0 {
+		m.currentIndex = (best + 1) % n
+		if sel.Session != "" && !keepSession {
+			if m.sessions == nil {
+				m.sessions = make(map[string]string)
+			}
+			m.sessions[sel.Session] = m.cachedProxies[best].Address()
+		}
+		return &m.cachedProxies[best], nil
+	}
+
+	if retryAfter > 0 {
+		return nil, &CooldownError{Host: sel.Target, RetryAfter: retryAfter}
+	}
+	return nil, fmt.Errorf("no healthy proxies match the selection")
 }
 
 // GetRandomProxy returns a random proxy
@@ -223,24 +362,74 @@ func (m *DBManager) GetRandomProxy() (*scraper.Proxy, error) {
 
 // ReportProxyFailure removes a failing proxy from the cache
 func (m *DBManager) ReportProxyFailure(proxy scraper.Proxy) {
+	if m.removeFromCache(proxy.Address()) {
+		m.logger.WarnBg("Removed failing proxy from cache: %s", proxy.Address())
+	}
+}
+
+// removeFromCache drops addr from the in-memory cache, reporting whether it was present.
+func (m *DBManager) removeFromCache(addr string) bool {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 
-	targetKey := proxy.Address()
 	newProxies := make([]scraper.Proxy, 0, len(m.cachedProxies))
-
 	for _, p := range m.cachedProxies {
-		if p.Address() != targetKey {
+		if p.Address() != addr {
 			newProxies = append(newProxies, p)
 		}
 	}
 
-	if len(newProxies) < len(m.cachedProxies) {
-		m.cachedProxies = newProxies
-		m.logger.WarnBg("Removed failing proxy from cache: %s", targetKey)
+	if len(newProxies) == len(m.cachedProxies) {
+		m.mu.Unlock()
+		return false
+	}
+
+	m.cachedProxies = newProxies
+	if m.currentIndex >= len(m.cachedProxies) {
+		m.currentIndex = 0
+	}
+	hooks := m.evictHooks
+	m.mu.Unlock()
+
+	notifyEvicted(hooks, []string{addr})
+	return true
+}
+
+// setCache replaces the cache and returns its previous size. Proxies that are
+// no longer cached are reported to the eviction hooks.
+func (m *DBManager) setCache(proxies []scraper.Proxy) int {
+	m.mu.Lock()
+	old := m.cachedProxies
+	m.cachedProxies = proxies
+	m.currentIndex = 0
+	hooks := m.evictHooks
+	m.mu.Unlock()
 
-		if m.currentIndex >= len(m.cachedProxies) && len(m.cachedProxies) > 0 {
-			m.currentIndex = 0
+	kept := make(map[string]bool, len(proxies))
+	for _, p := range proxies {
+		kept[p.Address()] = true
+	}
+	var evicted []string
+	for _, p := range old {
+		if !kept[p.Address()] {
+			evicted = append(evicted, p.Address())
+		}
+	}
+	notifyEvicted(hooks, evicted)
+	return len(old)
+}
+
+// OnEvict registers fn to be called with the address of every proxy that
+// leaves the cache, so holders of per-proxy state can release it.
+func (m *DBManager) OnEvict(fn func(addr string)) {
+	m.mu.Lock()
+	m.evictHooks = append(m.evictHooks, fn)
+	m.mu.Unlock()
+}
+
+func notifyEvicted(hooks []func(addr string), addrs []string) {
+	for _, addr := range addrs {
+		for _, hook := range hooks {
+			hook(addr)
 		}
 	}
 }
@@ -268,6 +457,25 @@ func (m *DBManager) GetStats() Stats {
 	return stats
 }
 
+// LatencyPercentile returns the q-th quantile (0-1) of the cached proxies' last
+// check latency, or 0 when none is known.
+func (m *DBManager) LatencyPercentile(q float64) time.Duration {
+	m.mu.RLock()
+	latencies := make([]time.Duration, 0, len(m.cachedProxies))
+	for _, p := range m.cachedProxies {
+		if p.Latency > 0 {
+			latencies = append(latencies, p.Latency)
+		}
+	}
+	m.mu.RUnlock()
+
+	if len(latencies) == 0 {
+		return 0
+	}
+	slices.Sort(latencies)
+	return latencies[int(q*float64(len(latencies)-1))]
+}
+
 // GetHealthyProxies returns a copy of all healthy proxies
 func (m *DBManager) GetHealthyProxies() []scraper.Proxy {
 	m.mu.RLock()
@@ -309,6 +517,10 @@ func (m *DBManager) cacheRefreshLoop(ticker *time.Ticker) {
 		case <-m.ctx.Done():
 			return
 		case <-ticker.C:
+			if m.paused.Load() {
+				continue
+			}
+
 			// Only reload if we have few proxies in cache
 			m.mu.RLock()
 			currentCount := len(m.cachedProxies)
@@ -340,6 +552,10 @@ func (m *DBManager) updateLoop() {
 		case <-m.ctx.Done():
 			return
 		case <-m.updateTicker.C:
+			if m.paused.Load() {
+				m.logger.InfoBg("Background operations paused, skipping scheduled refresh")
+				continue
+			}
 			m.logger.InfoBg("Running scheduled proxy refresh...")
 			if err := m.RefreshProxies(); err != nil {
 				m.logger.ErrorBg("Failed to refresh proxies: %v", err)
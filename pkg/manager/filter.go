@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"strings"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/scraper"
+)
+
+// ProxyFilter narrows the pool to proxies matching every set field. The zero
+// value matches everything. String lists match case-insensitively.
+type ProxyFilter struct {
+	Types          []string
+	Countries      []string
+	Anonymity      []string
+	MaxLatency     time.Duration
+	MinSuccessRate float64
+}
+
+// NewProxyFilter builds a filter from its config form.
+func NewProxyFilter(cfg config.FilterConfig) ProxyFilter {
+	return ProxyFilter{
+		Types:          cfg.Types,
+		Countries:      cfg.Countries,
+		Anonymity:      cfg.Anonymity,
+		MaxLatency:     cfg.MaxLatency,
+		MinSuccessRate: cfg.MinSuccessRate,
+	}
+}
+
+// IsZero reports whether the filter matches every proxy.
+func (f ProxyFilter) IsZero() bool {
+	return len(f.Types) == 0 && len(f.Countries) == 0 && len(f.Anonymity) == 0 &&
+		f.MaxLatency == 0 && f.MinSuccessRate == 0
+}
+
+// Match reports whether p passes the filter.
+func (f ProxyFilter) Match(p scraper.Proxy) bool {
+	if len(f.Types) > 0 && !containsFold(f.Types, p.Type) {
+		return false
+	}
+	if len(f.Countries) > 0 && !containsFold(f.Countries, p.Country) {
+		return false
+	}
+	if len(f.Anonymity) > 0 && !containsFold(f.Anonymity, p.Anonymity) {
+		return false
+	}
+	if f.MaxLatency > 0 && (p.Latency == 0 || p.Latency > f.MaxLatency) {
+		return false
+	}
+	if f.MinSuccessRate > 0 && p.SuccessRate < f.MinSuccessRate {
+		return false
+	}
+	return true
+}
+
+// Apply returns the proxies that pass the filter.
+func (f ProxyFilter) Apply(proxies []scraper.Proxy) []scraper.Proxy {
+	if f.IsZero() {
+		return proxies
+	}
+	matched := make([]scraper.Proxy, 0, len(proxies))
+	for _, p := range proxies {
+		if f.Match(p) {
+			matched = append(matched, p)
+		}
+	}
+	return matched
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/scraper"
+)
+
+// CooldownError is returned by SelectProxy when every proxy matching the
+// selection has hit the target host too recently or too often.
+type CooldownError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("all proxies cooling down for %s, retry after %s", e.Host, e.RetryAfter)
+}
+
+type politenessLimit struct {
+	domain      string // "" for the default limit
+	minInterval time.Duration
+	maxHits     int
+}
+
+// politeness tracks when each proxy last hit each target host and how often
+// it did within the window. It is guarded by DBManager.mu.
+type politeness struct {
+	window   time.Duration
+	fallback politenessLimit
+	domains  []politenessLimit
+
+	hits      map[string][]time.Time // by proxy address and host key, oldest first
+	lastSweep time.Time
+}
+
+func newPoliteness(cfg config.PolitenessConfig) *politeness {
+	p := &politeness{
+		window:   cfg.Window,
+		fallback: politenessLimit{minInterval: cfg.MinInterval, maxHits: cfg.MaxHits},
+		hits:     make(map[string][]time.Time),
+	}
+	for _, d := range cfg.Domains {
+		p.domains = append(p.domains, politenessLimit{
+			domain:      strings.TrimPrefix(strings.ToLower(d.Domain), "."),
+			minInterval: d.MinInterval,
+			maxHits:     d.MaxHits,
+		})
+		// The last hit must stay in the window for the interval to be checked
+		p.window = max(p.window, d.MinInterval)
+	}
+	p.window = max(p.window, cfg.MinInterval)
+	return p
+}
+
+// limit returns the limit for host and the key its hits are counted under;
+// subdomains of a configured domain share one key.
+func (p *politeness) limit(host string) (politenessLimit, string) {
+	for _, d := range p.domains {
+		if host == d.domain || strings.HasSuffix(host, "."+d.domain) {
+			return d, d.domain
+		}
+	}
+	return p.fallback, host
+}
+
+// wait reports how long addr must wait before it may hit host again; 0 means
+// it may go now.
+func (p *politeness) wait(addr, host string, now time.Time) time.Duration {
+	lim, key := p.limit(host)
+	hits := p.recent(addr+"|"+key, now)
+	if len(hits) == 0 {
+		return 0
+	}
+
+	var wait time.Duration
+	if lim.minInterval > 0 {
+		wait = lim.minInterval - now.Sub(hits[len(hits)-1])
+	}
+	if lim.maxHits > 0 && len(hits) >= lim.maxHits {
+		// Free once enough of the oldest hits leave the window
+		wait = max(wait, p.window-now.Sub(hits[len(hits)-lim.maxHits]))
+	}
+	return max(wait, 0)
+}
+
+// record notes that addr was chosen for host.
+func (p *politeness) record(addr, host string, now time.Time) {
+	lim, key := p.limit(host)
+	if lim.minInterval == 0 && lim.maxHits == 0 {
+		return
+	}
+	key = addr + "|" + key
+	p.hits[key] = append(p.recent(key, now), now)
+	p.sweep(now)
+}
+
+// RecordHit notes that a request to target, a host name, is going out
+// through proxy, starting its politeness cooldown there. Callers report the
+// proxy SelectProxy returned once they commit to using it, so a pick they
+// drop doesn't hold the proxy back.
+func (m *DBManager) RecordHit(proxy scraper.Proxy, target string) {
+	if target == "" {
+		return
+	}
+	m.mu.Lock()
+	m.politeness.record(proxy.Address(), target, time.Now())
+	m.mu.Unlock()
+}
+
+// recent drops hits older than the window and returns the rest.
+func (p *politeness) recent(key string, now time.Time) []time.Time {
+	hits := p.hits[key]
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= p.window {
+		i++
+	}
+	if i == len(hits) {
+		delete(p.hits, key)
+		return nil
+	}
+	hits = hits[i:]
+	p.hits[key] = hits
+	return hits
+}
+
+// sweep drops idle entries, at most once a minute.
+func (p *politeness) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < time.Minute {
+		return
+	}
+	p.lastSweep = now
+	for key := range p.hits {
+		p.recent(key, now)
+	}
+}
@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+func TestPoliteness(t *testing.T) {
+	p := newPoliteness(config.PolitenessConfig{
+		MinInterval: 2 * time.Second,
+		Window:      time.Minute,
+		Domains: []config.DomainPolitenessConfig{
+			{Domain: "example.com", MaxHits: 2},
+		},
+	})
+	now := time.Now()
+
+	steps := []struct {
+		after  time.Duration // since the previous step
+		addr   string
+		host   string
+		wait   time.Duration
+		record bool
+	}{
+		{0, "a", "other.org", 0, true},
+		{time.Second, "a", "other.org", time.Second, false}, // min interval
+		{0, "b", "other.org", 0, false},                     // other proxies unaffected
+		{time.Second, "a", "other.org", 0, true},
+		{0, "a", "www.example.com", 0, true},
+		{0, "a", "example.com", 0, true},                // no min interval for example.com
+		{0, "a", "api.example.com", time.Minute, false}, // subdomains share max_hits
+		{30 * time.Second, "a", "example.com", 30 * time.Second, false},
+		{30 * time.Second, "a", "example.com", 0, false}, // left the window
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if got := p.wait(step.addr, step.host, now); got != step.wait {
+			t.Errorf("step %d: wait = %s, want %s", i, got, step.wait)
+		}
+		if step.record {
+			p.record(step.addr, step.host, now)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package manager
+
+import "aproxy/internal/config"
+
+// Preset is a named pool selection from config (see config.PresetConfig).
+type Preset struct {
+	Name   string
+	Filter ProxyFilter
+	Sticky bool
+}
+
+func newPresets(cfgs []config.PresetConfig) map[string]Preset {
+	presets := make(map[string]Preset, len(cfgs))
+	for _, pc := range cfgs {
+		presets[pc.Name] = Preset{Name: pc.Name, Filter: NewProxyFilter(pc.Filter), Sticky: pc.Sticky}
+	}
+	return presets
+}
+
+// Preset returns the preset with the given name.
+func (m *DBManager) Preset(name string) (Preset, bool) {
+	p, ok := m.presets[name]
+	return p, ok
+}
+
+// Selection returns the selection for one client of the preset, identified
+// by session. Only sticky presets keep a proxy per session.
+func (p Preset) Selection(session string) Selection {
+	sel := Selection{Filter: p.Filter}
+	if p.Sticky {
+		sel.Session = session
+	}
+	return sel
+}
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/scraper"
+)
+
+func TestStickySessions(t *testing.T) {
+	m := &DBManager{
+		cachedProxies: []scraper.Proxy{
+			{Host: "10.0.0.1", Port: 80, Type: "http", Country: "US"},
+			{Host: "10.0.0.2", Port: 80, Type: "http", Country: "DE"},
+			{Host: "10.0.0.3", Port: 80, Type: "http", Country: "US"},
+		},
+		politeness: newPoliteness(config.PolitenessConfig{Window: time.Minute}),
+		reputation: newReputation(config.ReputationConfig{HalfLife: time.Hour, BlockCooldown: time.Minute, Candidates: 1}),
+		presets: newPresets([]config.PresetConfig{
+			{Name: "sticky-us", Filter: config.FilterConfig{Countries: []string{"US"}}, Sticky: true},
+			{Name: "de", Filter: config.FilterConfig{Countries: []string{"DE"}}},
+		}),
+	}
+	sticky, ok := m.Preset("sticky-us")
+	if !ok {
+		t.Fatal("preset not found")
+	}
+	if _, ok := m.Preset("missing"); ok {
+		t.Error("found an undeclared preset")
+	}
+	if de, _ := m.Preset("de"); de.Selection("port-1").Session != "" {
+		t.Error("non-sticky preset kept a session")
+	}
+
+	selectAddr := func(sel Selection) string {
+		t.Helper()
+		p, err := m.SelectProxy(sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Address()
+	}
+
+	first := selectAddr(sticky.Selection("port-1"))
+	second := selectAddr(sticky.Selection("port-2"))
+	if first != "10.0.0.1:80" || second != "10.0.0.3:80" {
+		t.Fatalf("sessions got %s and %s, want one US proxy each", first, second)
+	}
+	for range 3 {
+		selectAddr(Selection{}) // other traffic moves the round-robin on
+		if got := selectAddr(sticky.Selection("port-1")); got != first {
+			t.Fatalf("session moved from %s to %s", first, got)
+		}
+	}
+
+	// A session moves on once its proxy is blocked by the target or leaves the pool
+	m.ReportResult(scraper.Proxy{Host: "10.0.0.1", Port: 80}, "shop.example", OutcomeBlocked)
+	sel := sticky.Selection("port-1")
+	sel.Target = "shop.example"
+	if got := selectAddr(sel); got != second {
+		t.Errorf("blocked session proxy still selected: %s", got)
+	}
+	if got := selectAddr(sticky.Selection("port-1")); got != second {
+		t.Errorf("session went back to %s, want it to keep its new proxy", got)
+	}
+	m.removeFromCache(second)
+	if got := selectAddr(sticky.Selection("port-2")); got != first {
+		t.Errorf("session got %s after its proxy left the pool, want %s", got, first)
+	}
+}
+
+func TestStickySessionCooldown(t *testing.T) {
+	m := &DBManager{
+		cachedProxies: []scraper.Proxy{
+			{Host: "10.0.0.1", Port: 80, Type: "http"},
+			{Host: "10.0.0.2", Port: 80, Type: "http"},
+		},
+		politeness: newPoliteness(config.PolitenessConfig{Window: time.Minute, MinInterval: time.Minute}),
+		reputation: newReputation(config.ReputationConfig{HalfLife: time.Hour, BlockCooldown: time.Minute, Candidates: 1}),
+	}
+	selectAddr := func(target string) string {
+		t.Helper()
+		p, err := m.SelectProxy(Selection{Target: target, Session: "port-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Address()
+	}
+
+	first := selectAddr("shop.example")
+	m.RecordHit(scraper.Proxy{Host: "10.0.0.1", Port: 80}, "shop.example")
+
+	// Another proxy stands in while the session's cools down for the target
+	if got := selectAddr("shop.example"); got == first {
+		t.Fatalf("selected %s while it was cooling down", got)
+	}
+	// and the session keeps its own proxy for the next request
+	if got := selectAddr("other.example"); got != first {
+		t.Errorf("session moved from %s to %s during a cooldown", first, got)
+	}
+}
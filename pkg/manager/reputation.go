@@ -0,0 +1,232 @@
+package manager
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/database"
+	"aproxy/pkg/scraper"
+)
+
+// Outcome is the result of a real request through a proxy, as seen by the
+// proxy server.
+type Outcome int
+
+const (
+	OutcomeSuccess Outcome = iota
+	OutcomeFailure         // the proxy failed to deliver a response
+	OutcomeBlocked         // the target served a block page or challenge
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeFailure:
+		return "failure"
+	case OutcomeBlocked:
+		return "blocked"
+	default:
+		return "unknown"
+	}
+}
+
+type targetKey struct {
+	addr   string
+	target string
+}
+
+// targetScore is a proxy's decayed outcome counts for one target host.
+type targetScore struct {
+	proxyHost string
+	proxyPort int
+	successes float64
+	failures  float64
+	blockedAt time.Time
+	updated   time.Time
+	dirty     bool // changed since the last save
+}
+
+// reputation learns which proxies work against which target hosts. It is
+// guarded by DBManager.mu.
+type reputation struct {
+	halfLife      time.Duration
+	blockCooldown time.Duration
+	candidates    int
+
+	scores map[targetKey]*targetScore
+}
+
+func newReputation(cfg config.ReputationConfig) *reputation {
+	return &reputation{
+		halfLife:      cfg.HalfLife,
+		blockCooldown: cfg.BlockCooldown,
+		candidates:    max(1, cfg.Candidates),
+		scores:        make(map[targetKey]*targetScore),
+	}
+}
+
+// decay returns the factor counts last updated at then have shrunk by at now.
+func (r *reputation) decay(then, now time.Time) float64 {
+	if !now.After(then) {
+		return 1
+	}
+	return math.Exp2(-now.Sub(then).Seconds() / r.halfLife.Seconds())
+}
+
+// record adds an outcome for proxy against target.
+func (r *reputation) record(proxy scraper.Proxy, target string, outcome Outcome, now time.Time) {
+	key := targetKey{proxy.Address(), target}
+	s, ok := r.scores[key]
+	if !ok {
+		s = &targetScore{proxyHost: proxy.Host, proxyPort: proxy.Port, updated: now}
+		r.scores[key] = s
+	}
+
+	f := r.decay(s.updated, now)
+	s.successes *= f
+	s.failures *= f
+	s.updated = now
+	s.dirty = true
+
+	switch outcome {
+	case OutcomeSuccess:
+		s.successes++
+	case OutcomeBlocked:
+		s.failures++
+		s.blockedAt = now
+	default:
+		s.failures++
+	}
+}
+
+// score estimates how likely addr is to succeed against target, between 0 and
+// 1. Proxies with no history score 0.5, so new ones still get tried.
+func (r *reputation) score(addr, target string, now time.Time) float64 {
+	s, ok := r.scores[targetKey{addr, target}]
+	if !ok {
+		return 0.5
+	}
+	f := r.decay(s.updated, now)
+	return (s.successes*f + 1) / ((s.successes+s.failures)*f + 2)
+}
+
+// blocked reports whether target recently refused addr.
+func (r *reputation) blocked(addr, target string, now time.Time) bool {
+	s, ok := r.scores[targetKey{addr, target}]
+	return ok && !s.blockedAt.IsZero() && now.Sub(s.blockedAt) < r.blockCooldown
+}
+
+// retention is how long an untouched score is kept; by then it has decayed to
+// almost nothing.
+func (r *reputation) retention() time.Duration {
+	return max(10*r.halfLife, r.blockCooldown)
+}
+
+// dirtyStats returns the changed scores as rows to save, marking them clean,
+// and forgets scores past retention.
+func (r *reputation) dirtyStats(now time.Time) []database.ProxyTargetStat {
+	var stats []database.ProxyTargetStat
+	for key, s := range r.scores {
+		if now.Sub(s.updated) > r.retention() {
+			delete(r.scores, key)
+			continue
+		}
+		if !s.dirty {
+			continue
+		}
+		s.dirty = false
+
+		st := database.ProxyTargetStat{
+			Host:      s.proxyHost,
+			Port:      int64(s.proxyPort),
+			Target:    key.target,
+			Successes: s.successes,
+			Failures:  s.failures,
+			UpdatedAt: s.updated.UTC(),
+		}
+		if !s.blockedAt.IsZero() {
+			blockedAt := s.blockedAt.UTC()
+			st.BlockedAt = &blockedAt
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// load restores saved scores.
+func (r *reputation) load(stats []database.ProxyTargetStat) {
+	for _, st := range stats {
+		proxy := scraper.Proxy{Host: st.Host, Port: int(st.Port)}
+		s := &targetScore{
+			proxyHost: st.Host,
+			proxyPort: int(st.Port),
+			successes: st.Successes,
+			failures:  st.Failures,
+			updated:   st.UpdatedAt,
+		}
+		if st.BlockedAt != nil {
+			s.blockedAt = *st.BlockedAt
+		}
+		r.scores[targetKey{proxy.Address(), st.Target}] = s
+	}
+}
+
+// ReportResult records the outcome of a request through proxy to target, a
+// host name. Selections for that host favour proxies that have been working
+// there and avoid ones it recently blocked.
+func (m *DBManager) ReportResult(proxy scraper.Proxy, target string, outcome Outcome) {
+	if target == "" {
+		return
+	}
+	m.mu.Lock()
+	m.reputation.record(proxy, target, outcome, time.Now())
+	m.mu.Unlock()
+}
+
+// loadReputation restores scores saved by earlier runs.
+func (m *DBManager) loadReputation() error {
+	m.mu.RLock()
+	retention := m.reputation.retention()
+	m.mu.RUnlock()
+
+	stats, err := m.dbService.ListTargetStats(m.ctx, retention)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.reputation.load(stats)
+	m.mu.Unlock()
+	return nil
+}
+
+// saveReputation persists scores changed since the last save.
+func (m *DBManager) saveReputation(ctx context.Context) {
+	m.mu.Lock()
+	stats := m.reputation.dirtyStats(time.Now())
+	m.mu.Unlock()
+
+	if err := m.dbService.SaveTargetStats(ctx, stats); err != nil {
+		m.logger.WarnBg("Failed to save per-target proxy stats: %v", err)
+	}
+}
+
+// reputationLoop saves scores periodically and once more on shutdown.
+func (m *DBManager) reputationLoop(interval time.Duration) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.saveReputation(context.Background())
+			return
+		case <-ticker.C:
+			m.saveReputation(m.ctx)
+		}
+	}
+}
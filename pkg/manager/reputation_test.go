@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/scraper"
+)
+
+func TestSelectProxyReputation(t *testing.T) {
+	proxies := []scraper.Proxy{
+		{Host: "10.0.0.1", Port: 80, Type: "http", Country: "US"},
+		{Host: "10.0.0.2", Port: 80, Type: "http"},
+		{Host: "10.0.0.3", Port: 1080, Type: "socks5"},
+	}
+	m := &DBManager{
+		cachedProxies: proxies,
+		politeness:    newPoliteness(config.PolitenessConfig{Window: time.Minute}),
+		reputation: newReputation(config.ReputationConfig{
+			HalfLife:      time.Hour,
+			BlockCooldown: time.Minute,
+			Candidates:    3,
+		}),
+	}
+
+	m.ReportResult(proxies[0], "shop.example", OutcomeBlocked)
+	m.ReportResult(proxies[1], "shop.example", OutcomeFailure)
+	m.ReportResult(proxies[2], "shop.example", OutcomeSuccess)
+
+	cases := []struct {
+		sel  Selection
+		want string
+	}{
+		{Selection{Target: "shop.example"}, "10.0.0.3:1080"},
+		{Selection{Target: "shop.example"}, "10.0.0.3:1080"}, // still the best, despite round-robin
+		{Selection{Target: "other.example"}, "10.0.0.1:80"},  // no history, plain round-robin
+		{Selection{Target: "other.example"}, "10.0.0.2:80"},
+		// Blocked proxies are used only when nothing else matches
+		{Selection{Target: "shop.example", Filter: ProxyFilter{Types: []string{"http"}}}, "10.0.0.2:80"},
+		{Selection{Target: "shop.example", Filter: ProxyFilter{Countries: []string{"us"}}}, "10.0.0.1:80"},
+	}
+	for i, c := range cases {
+		p, err := m.SelectProxy(c.sel)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if p.Address() != c.want {
+			t.Errorf("case %d: selected %s, want %s", i, p.Address(), c.want)
+		}
+	}
+
+	m.pinned = "10.0.0.1:80"
+	if p, _ := m.SelectProxy(Selection{Target: "shop.example", Filter: ProxyFilter{Types: []string{"http"}}}); p.Address() != "10.0.0.2:80" {
+		t.Errorf("pinned proxy blocked by the target was selected")
+	}
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+)
+
+var (
+	errAtCapacity  = errors.New("server at connection limit")
+	errQueueFull   = errors.New("admission queue full")
+	errQueueWait   = errors.New("timed out waiting in admission queue")
+	errClientLimit = errors.New("client connection limit reached")
+)
+
+// admission enforces ServerConfig.MaxConnections on client connections. A
+// slot is held from accept until the connection closes, so idle keep-alive
+// connections and CONNECT tunnels keep theirs (see admissionListener).
+type admission struct {
+	slots        chan struct{}
+	queueSize    int
+	queueTimeout time.Duration
+	maxPerClient int
+
+	mu        sync.Mutex
+	perClient map[string]int // admitted or queued, by client IP
+	queued    int
+	rejected  int64
+}
+
+// admissionStats is a snapshot for /stats.
+type admissionStats struct {
+	Active   int
+	Limit    int
+	Queued   int
+	Rejected int64
+}
+
+func newAdmission(maxConnections int, cfg config.AdmissionConfig) *admission {
+	return &admission{
+		slots:        make(chan struct{}, maxConnections),
+		queueSize:    cfg.QueueSize,
+		queueTimeout: cfg.QueueTimeout,
+		maxPerClient: cfg.MaxPerClient,
+		perClient:    make(map[string]int),
+	}
+}
+
+// acquire admits a connection from clientIP, waiting in the queue if the
+// server is full. The returned release must be called when the connection
+// closes.
+func (a *admission) acquire(ctx context.Context, clientIP string) (func(), error) {
+	a.mu.Lock()
+	if a.maxPerClient > 0 && a.perClient[clientIP] >= a.maxPerClient {
+		a.rejected++
+		a.mu.Unlock()
+		return nil, errClientLimit
+	}
+	a.perClient[clientIP]++
+	a.mu.Unlock()
+
+	if err := a.wait(ctx); err != nil {
+		a.mu.Lock()
+		a.rejected++
+		a.mu.Unlock()
+		a.leave(clientIP)
+		return nil, err
+	}
+
+	return func() {
+		<-a.slots
+		a.leave(clientIP)
+	}, nil
+}
+
+// wait takes a slot, queueing if none is free.
+func (a *admission) wait(ctx context.Context) error {
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if a.queueSize == 0 {
+		return errAtCapacity
+	}
+
+	a.mu.Lock()
+	if a.queued >= a.queueSize {
+		a.mu.Unlock()
+		return errQueueFull
+	}
+	a.queued++
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.queued--
+		a.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(a.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errQueueWait
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *admission) leave(clientIP string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.perClient[clientIP] <= 1 {
+		delete(a.perClient, clientIP)
+	} else {
+		a.perClient[clientIP]--
+	}
+}
+
+func (a *admission) stats() admissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return admissionStats{
+		Active:   len(a.slots),
+		Limit:    cap(a.slots),
+		Queued:   a.queued,
+		Rejected: a.rejected,
+	}
+}
+
+// maxAcceptDelay caps the backoff after temporary Accept errors.
+const maxAcceptDelay = time.Second
+
+// acceptConns passes each connection ln accepts to handle until Accept fails
+// for good or done is closed. Like http.Server, it backs off and retries after
+// temporary errors such as running out of file descriptors, rather than
+// leaving the listener dead.
+func acceptConns(ln net.Listener, log *logger.Logger, done <-chan struct{}, handle func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err == nil {
+			delay = 0
+			handle(conn)
+			continue
+		}
+		var ne net.Error
+		if errors.Is(err, net.ErrClosed) || !errors.As(err, &ne) || !(ne.Timeout() || ne.Temporary()) {
+			return err
+		}
+
+		delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+		log.WarnBg("Accept error on %s: %v; retrying in %s", ln.Addr(), err, delay)
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return net.ErrClosed
+		}
+	}
+}
+
+// admissionListener admits each connection the wrapped listener accepts
+// before the http.Server sees it, so slow clients and SOCKS5 handshakes count
+// too. Connections are admitted concurrently, so one waiting in the queue
+// doesn't hold up the rest.
+type admissionListener struct {
+	net.Listener
+	server *Server
+	reply  bool // answer refused connections with an HTTP error
+
+	conns  chan net.Conn
+	err    chan error
+	ctx    context.Context // canceled by Close, ending queued waits
+	cancel context.CancelFunc
+}
+
+// admitListener wraps ln with s.admission. With reply, refused clients get a
+// 503 or 429 response; only plain HTTP listeners can send one.
+func (s *Server) admitListener(ln net.Listener, reply bool) net.Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &admissionListener{
+		Listener: ln,
+		server:   s,
+		reply:    reply,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *admissionListener) acceptLoop() {
+	l.err <- acceptConns(l.Listener, l.server.logger, l.ctx.Done(), func(conn net.Conn) {
+		go l.admit(conn)
+	})
+}
+
+func (l *admissionListener) admit(conn net.Conn) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	release, err := l.server.admission.acquire(l.ctx, ip)
+	if err != nil {
+		l.server.refuse(conn, err, l.reply)
+		return
+	}
+
+	admitted := &admittedConn{Conn: conn, release: release}
+	select {
+	case l.conns <- admitted:
+	case <-l.ctx.Done():
+		admitted.Close()
+	}
+}
+
+func (l *admissionListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		return nil, err
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *admissionListener) Close() error {
+	l.cancel()
+	return l.Listener.Close()
+}
+
+// admittedConn gives its admission slot back when closed.
+type admittedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *admittedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// refuse turns away a connection admission refused, answering with an HTTP
+// error first if reply is set.
+func (s *Server) refuse(conn net.Conn, err error, reply bool) {
+	defer conn.Close()
+	if errors.Is(err, context.Canceled) {
+		return // the listener is closing
+	}
+	s.logger.WarnBg("Refused connection from %s: %v", conn.RemoteAddr(), err)
+	s.incrementFailedRequests()
+	if !reply {
+		return
+	}
+
+	status, msg := http.StatusServiceUnavailable, "Proxy at capacity, try again later\n"
+	if errors.Is(err, errClientLimit) {
+		status, msg = http.StatusTooManyRequests, "Too many connections from this client\n"
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nRetry-After: 1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(msg), msg)
+	// Read what the client sent, so closing doesn't reset the connection
+	// before it reads the response
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+		io.Copy(io.Discard, io.LimitReader(conn, 64<<10))
+	}
+}
+
+// clientIP returns the IP part of r.RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+func TestAdmission(t *testing.T) {
+	ctx := context.Background()
+	a := newAdmission(1, config.AdmissionConfig{QueueSize: 1, QueueTimeout: 50 * time.Millisecond, MaxPerClient: 2})
+
+	release, err := a.acquire(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	// Second client queues and is admitted when the slot frees up
+	admitted := make(chan error, 1)
+	go func() {
+		release, err := a.acquire(ctx, "10.0.0.2")
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+	waitFor(t, func() bool { return a.stats().Queued == 1 })
+
+	// Queue is full now
+	if _, err := a.acquire(ctx, "10.0.0.3"); !errors.Is(err, errQueueFull) {
+		t.Errorf("acquire with full queue: err = %v, want %v", err, errQueueFull)
+	}
+
+	release()
+	if err := <-admitted; err != nil {
+		t.Errorf("queued acquire: %v", err)
+	}
+
+	// A queued request gives up after the timeout
+	release, _ = a.acquire(ctx, "10.0.0.1")
+	if _, err := a.acquire(ctx, "10.0.0.2"); !errors.Is(err, errQueueWait) {
+		t.Errorf("acquire past timeout: err = %v, want %v", err, errQueueWait)
+	}
+
+	// Per-client cap counts queued requests too
+	queued := make(chan error, 1)
+	go func() {
+		release, err := a.acquire(ctx, "10.0.0.1")
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	waitFor(t, func() bool { return a.stats().Queued == 1 })
+	if _, err := a.acquire(ctx, "10.0.0.1"); !errors.Is(err, errClientLimit) {
+		t.Errorf("acquire over client cap: err = %v, want %v", err, errClientLimit)
+	}
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("queued acquire: %v", err)
+	}
+
+	if got := a.stats().Rejected; got != 3 {
+		t.Errorf("rejected = %d, want 3", got)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdmissionListener(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	s := newDirectServer(t, config.ServerConfig{EnableHTTPS: true}, &http.Transport{})
+	s.admission = newAdmission(1, config.AdmissionConfig{})
+	addr := serve(t, s)
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	get := func(conn net.Conn) *http.Response {
+		t.Helper()
+		io.WriteString(conn, "GET "+target.URL+"/ HTTP/1.1\r\nHost: "+target.Listener.Addr().String()+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// A client that hasn't sent anything yet holds the only slot
+	idle := dial()
+	waitFor(t, func() bool { return s.admission.stats().Active == 1 })
+	refused := dial()
+	if resp := get(refused); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("connection over the limit got %s, want 503 with Retry-After", resp.Status)
+	}
+	refused.Close()
+
+	// So does a keep-alive connection between requests
+	if resp := get(idle); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admitted connection got %s", resp.Status)
+	}
+	if got := s.admission.stats().Active; got != 1 {
+		t.Errorf("active = %d after the request, want the idle connection counted", got)
+	}
+	idle.Close()
+	waitFor(t, func() bool { return s.admission.stats().Active == 0 })
+
+	// A tunnel keeps its slot until it closes
+	echo := newEchoTarget(t)
+	tunnel := dial()
+	io.WriteString(tunnel, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	reader := bufio.NewReader(tunnel)
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %v, %v", resp, err)
+	}
+	if got := s.admission.stats().Active; got != 1 {
+		t.Errorf("active = %d with a tunnel open, want 1", got)
+	}
+	tunnel.Close()
+	waitFor(t, func() bool { return s.admission.stats().Active == 0 })
+
+	if got := s.admission.stats().Rejected; got != 1 {
+		t.Errorf("rejected = %d, want 1", got)
+	}
+}
+
+func TestAdmissionListenerPerClient(t *testing.T) {
+	s := newDirectServer(t, config.ServerConfig{}, &http.Transport{})
+	s.admission = newAdmission(10, config.AdmissionConfig{MaxPerClient: 1})
+	l, err := s.Listener(config.ListenerConfig{Name: "socks", Protocol: "socks5"}, s.rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr, socksAddr := serve(t, s), serve(t, l)
+
+	first, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	waitFor(t, func() bool { return s.admission.stats().Active == 1 })
+
+	// Listeners share the limit, and a SOCKS5 client is refused before its
+	// handshake
+	dialer, _ := netproxy.SOCKS5("tcp", socksAddr, nil, netproxy.Direct)
+	if conn, err := dialer.Dial("tcp", newEchoTarget(t)); err == nil {
+		conn.Close()
+		t.Error("SOCKS5 tunnel opened over the per-client limit")
+	}
+
+	second, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(second, "GET http://127.0.0.1/ HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second connection got %s, want 429", resp.Status)
+	}
+}
+
+// timeoutError is a net.Error that reports a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyListener fails its first Accepts with errs before accepting for real.
+type flakyListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+// proxyGet fetches target through the HTTP proxy at addr.
+func proxyGet(t *testing.T, addr, target string) (*http.Response, error) {
+	t.Helper()
+	proxyURL := &url.URL{Scheme: "http", Host: addr}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	return client.Get(target)
+}
+
+func TestAdmissionListenerAcceptErrors(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	// Running out of file descriptors is temporary; the listener keeps going
+	s := newDirectServer(t, config.ServerConfig{}, &http.Transport{})
+	ln := &flakyListener{Listener: listen(t), errs: []error{
+		&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE},
+		timeoutError{},
+	}}
+	defer ln.Close()
+	go s.Serve(ln)
+	resp, err := proxyGet(t, ln.Addr().String(), target.URL)
+	if err != nil {
+		t.Fatalf("request after temporary Accept errors: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want 200", resp.StatusCode)
+	}
+
+	// Anything else stops Serve with the error
+	permanent := errors.New("listener broken")
+	ln = &flakyListener{Listener: listen(t), errs: []error{permanent}}
+	defer ln.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, permanent) {
+			t.Errorf("Serve = %v, want the Accept error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve kept running after a permanent Accept error")
+	}
+}
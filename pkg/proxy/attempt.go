@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// attemptResult is how one upstream attempt at a request ended. Only
+// attempts that sent nothing to the client may be retried; once the response
+// headers are written, the response is committed to that attempt.
+type attemptResult int
+
+const (
+	attemptFailed  attemptResult = iota // the route failed, nothing was sent to the client
+	attemptBlocked                      // the target served a block page, nothing was sent to the client
+	attemptDone                         // a response was sent to the client
+	attemptAborted                      // the response broke off after its headers were sent
+)
+
+// errUpstreamBroken wraps failures reading a response body from upstream, as
+// opposed to writing it to the client.
+var errUpstreamBroken = errors.New("upstream response broke off")
+
+// attemptBody shares a request body between attempts. The transport closes
+// the body of a failed request, so Close is left to the server, which owns
+// it. Once an attempt has read from it, the body can't be sent again.
+type attemptBody struct {
+	io.ReadCloser
+	read atomic.Bool
+}
+
+func (b *attemptBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *attemptBody) Close() error {
+	return nil
+}
+
+// shareBody prepares r's body, if it has one, to be offered to several attempts.
+func shareBody(r *http.Request) {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &attemptBody{ReadCloser: r.Body}
+	}
+}
+
+// replayable reports whether r can still be sent through another route:
+// no earlier attempt has consumed any of its body.
+func replayable(r *http.Request) bool {
+	b, ok := r.Body.(*attemptBody)
+	return !ok || !b.read.Load()
+}
+
+// sourceReader remembers whether reading failed, to tell upstream failures
+// from client ones during a copy.
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// abortResponse ends a response that failed after its headers were sent.
+// Nothing more can be said to the client, so its connection is closed
+// without finishing the response: the client sees a truncated response
+// rather than an error page spliced into the body.
+func (s *Server) abortResponse(w http.ResponseWriter, reqID string) {
+	skipCache(w)
+	s.incrementAbortedResponses()
+	s.httpLogger.Warn(reqID, "Aborting client connection after a mid-stream failure")
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"aproxy/internal/config"
+)
+
+func TestMidStreamFailureAbortsClient(t *testing.T) {
+	// The target promises more body than it sends, then hangs up
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		// More than the server buffers, so the client sees the headers
+		buffered.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100000\r\n\r\n")
+		buffered.WriteString(strings.Repeat("x", 16<<10))
+		buffered.Flush()
+		conn.Close()
+	}))
+	defer target.Close()
+
+	s := newDirectServer(t, config.ServerConfig{}, &http.Transport{})
+	front := httptest.NewServer(s)
+	defer front.Close()
+
+	proxyURL, _ := url.Parse(front.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want the upstream 200", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("read %q without error, want a truncated response", body)
+	}
+	if strings.Contains(string(body), "failed") {
+		t.Errorf("body %q has an error page spliced into it", body)
+	}
+
+	stats := s.getStats()
+	if stats.AbortedResponses != 1 || stats.FailedRequests != 0 {
+		t.Errorf("stats = %d aborted, %d failed; want 1 aborted, 0 failed", stats.AbortedResponses, stats.FailedRequests)
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("payload"))
+	shareBody(r)
+	if !replayable(r) {
+		t.Fatal("request with an unread body should be replayable")
+	}
+	io.ReadAll(r.Body)
+	if replayable(r) {
+		t.Error("request whose body was read should not be replayable")
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	shareBody(get)
+	if !replayable(get) {
+		t.Error("request without a body should be replayable")
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"aproxy/internal/config"
+)
+
+// errBlocked is returned for attempts whose response was a block page.
+var errBlocked = errors.New("target served a block page")
+
+// blockRule is a compiled config.BlockRuleConfig.
+type blockRule struct {
+	name    string
+	domains []string
+	status  []int
+	headers map[string]*regexp.Regexp
+	body    *regexp.Regexp
+}
+
+// blockDetector classifies upstream responses as content or block pages.
+type blockDetector struct {
+	bodyBytes int
+	rules     []blockRule
+}
+
+// newBlockDetector compiles cfg. Patterns are checked by config validation.
+func newBlockDetector(cfg config.BlockDetectionConfig) *blockDetector {
+	d := &blockDetector{bodyBytes: cfg.BodyBytes}
+	if !cfg.Enabled {
+		return d
+	}
+	for i, rc := range cfg.Rules {
+		rule := blockRule{
+			name:    rc.Name,
+			status:  rc.Status,
+			headers: make(map[string]*regexp.Regexp, len(rc.Headers)),
+		}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule %d", i+1)
+		}
+		for _, domain := range rc.Domains {
+			rule.domains = append(rule.domains, strings.TrimPrefix(strings.ToLower(domain), "."))
+		}
+		for name, pattern := range rc.Headers {
+			rule.headers[name] = regexp.MustCompile(pattern)
+		}
+		if rc.Body != "" {
+			rule.body = regexp.MustCompile(rc.Body)
+		}
+		d.rules = append(d.rules, rule)
+	}
+	return d
+}
+
+// appliesTo reports whether the rule covers host.
+func (r *blockRule) appliesTo(host string) bool {
+	return len(r.domains) == 0 || inDomains(host, r.domains)
+}
+
+// match reports whether resp, with body holding the start of its body,
+// satisfies every condition of the rule.
+func (r *blockRule) match(resp *http.Response, body []byte) bool {
+	if len(r.status) > 0 && !slices.Contains(r.status, resp.StatusCode) {
+		return false
+	}
+	for name, pattern := range r.headers {
+		if !pattern.MatchString(resp.Header.Get(name)) {
+			return false
+		}
+	}
+	return r.body == nil || r.body.Match(body)
+}
+
+// classify returns the name of the first rule that marks resp from host as a
+// block page, or "". When a body rule applies it reads the start of the body,
+// leaving resp.Body to return it again.
+func (d *blockDetector) classify(resp *http.Response, host string) (string, error) {
+	var applicable []*blockRule
+	peek := false
+	for i := range d.rules {
+		if rule := &d.rules[i]; rule.appliesTo(host) {
+			applicable = append(applicable, rule)
+			peek = peek || rule.body != nil
+		}
+	}
+
+	var body []byte
+	if peek && d.bodyBytes > 0 && resp.Header.Get("Content-Encoding") == "" {
+		var err error
+		if body, err = peekBody(resp, d.bodyBytes); err != nil {
+			return "", err
+		}
+	}
+
+	for _, rule := range applicable {
+		if rule.match(resp, body) {
+			return rule.name, nil
+		}
+	}
+	return "", nil
+}
+
+// peekBody reads up to n bytes of resp's body and puts them back in front of
+// the rest.
+func peekBody(resp *http.Response, n int) ([]byte, error) {
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+	return buf, nil
+}
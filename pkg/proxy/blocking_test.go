@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"aproxy/internal/config"
+)
+
+func TestBlockDetector(t *testing.T) {
+	d := newBlockDetector(config.BlockDetectionConfig{
+		Enabled:   true,
+		BodyBytes: 64,
+		Rules: []config.BlockRuleConfig{
+			{Name: "refused", Status: []int{403, 429}},
+			{Name: "challenge", Headers: map[string]string{"cf-mitigated": "^challenge$"}},
+			{Name: "captcha", Domains: []string{"shop.example"}, Status: []int{200}, Body: `(?i)captcha`},
+		},
+	})
+
+	cases := []struct {
+		host     string
+		status   int
+		header   http.Header
+		body     string
+		encoding string
+		want     string
+	}{
+		{"a.example", 200, nil, "hello", "", ""},
+		{"a.example", 429, nil, "", "", "refused"},
+		{"a.example", 503, http.Header{"Cf-Mitigated": {"challenge"}}, "", "", "challenge"},
+		{"a.example", 200, nil, "solve the CAPTCHA", "", ""}, // rule limited to shop.example
+		{"www.shop.example", 200, nil, "solve the CAPTCHA", "", "captcha"},
+		{"shop.example", 200, nil, strings.Repeat("x", 64) + "captcha", "", ""}, // past body_bytes
+		{"shop.example", 200, nil, "captcha", "gzip", ""},                       // not decoded
+	}
+
+	for i, c := range cases {
+		header := c.header
+		if header == nil {
+			header = http.Header{}
+		}
+		if c.encoding != "" {
+			header.Set("Content-Encoding", c.encoding)
+		}
+		resp := &http.Response{StatusCode: c.status, Header: header, Body: io.NopCloser(strings.NewReader(c.body))}
+
+		got, err := d.classify(resp, c.host)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if got != c.want {
+			t.Errorf("case %d: classify = %q, want %q", i, got, c.want)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != c.body {
+			t.Errorf("case %d: body after classify = %q, want %q", i, body, c.body)
+		}
+	}
+}
+
+func TestBlockDetectorDisabled(t *testing.T) {
+	d := newBlockDetector(config.BlockDetectionConfig{
+		Rules: []config.BlockRuleConfig{{Name: "refused", Status: []int{403}}},
+	})
+	resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}, Body: http.NoBody}
+	if got, err := d.classify(resp, "a.example"); err != nil || got != "" {
+		t.Errorf("classify = %q, %v; want no rule while disabled", got, err)
+	}
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+// cacheFileExt marks body files of the disk tier.
+const cacheFileExt = ".body"
+
+// cacheEntry is one stored response. Its body is held in memory, or in a
+// file of the disk tier once it has been pushed out of memory.
+type cacheEntry struct {
+	key      string
+	url      string
+	status   int
+	header   http.Header
+	storedAt time.Time     // when the response was received or last revalidated
+	ttl      time.Duration // freshness lifetime from storedAt
+	noCache  bool          // must be revalidated before every use
+	size     int64
+	body     []byte // nil while on disk
+	onDisk   bool
+	elem     *list.Element
+}
+
+// cachedResponse is a copy of an entry, safe to use without the cache lock.
+type cachedResponse struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	age      time.Duration
+	fresh    bool
+	etag     string
+	modified string
+}
+
+// cacheStats is a snapshot for /stats.
+type cacheStats struct {
+	Entries       int
+	MemoryBytes   int64
+	DiskBytes     int64
+	Hits          int64
+	Misses        int64
+	Revalidations int64
+	Stores        int64
+	Evictions     int64
+}
+
+// urlVariants tracks the stored variants of one URL.
+type urlVariants struct {
+	vary []string // header names the latest response varied on
+	n    int      // entries stored for the URL
+}
+
+// httpCache stores responses in a memory tier that overflows into a disk
+// tier, each bounded by size and evicting least recently used entries.
+type httpCache struct {
+	memMax  int64
+	diskMax int64
+	objMax  int64
+	dir     string // "" disables the disk tier
+
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+	urls      map[string]*urlVariants
+	mem       *list.List // front is most recently used
+	disk      *list.List
+	memBytes  int64
+	diskBytes int64
+	stats     cacheStats
+}
+
+// newHTTPCache returns a cache for cfg. If the disk tier can't be prepared
+// the cache still works in memory and the error is returned alongside it.
+func newHTTPCache(cfg config.CacheConfig) (*httpCache, error) {
+	c := &httpCache{
+		memMax:  int64(cfg.MemoryMaxMB) << 20,
+		diskMax: int64(cfg.DiskMaxMB) << 20,
+		objMax:  int64(cfg.MaxObjectMB) << 20,
+		entries: make(map[string]*cacheEntry),
+		urls:    make(map[string]*urlVariants),
+		mem:     list.New(),
+		disk:    list.New(),
+	}
+	if cfg.DiskPath == "" {
+		return c, nil
+	}
+	if err := clearCacheDir(cfg.DiskPath); err != nil {
+		return c, err
+	}
+	c.dir = cfg.DiskPath
+	return c, nil
+}
+
+// clearCacheDir creates dir, removing body files left by an earlier run.
+func clearCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+cacheFileExt))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to clear cache directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// cacheKey identifies the variant of url selected by the vary headers of h.
+func cacheKey(url string, vary []string, h http.Header) string {
+	sum := sha256.New()
+	sum.Write([]byte(url))
+	for _, name := range vary {
+		fmt.Fprintf(sum, "\x00%s=%s", name, strings.Join(h.Values(name), ","))
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// lookup returns the stored response for r, or nil.
+func (c *httpCache) lookup(r *http.Request, now time.Time) *cachedResponse {
+	url := r.URL.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	variants, ok := c.urls[url]
+	if !ok {
+		return nil
+	}
+	key := cacheKey(url, variants.vary, r.Header)
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	body := e.body
+	if e.onDisk {
+		var err error
+		if body, err = os.ReadFile(c.path(key)); err != nil {
+			c.remove(e)
+			return nil
+		}
+		c.disk.MoveToFront(e.elem)
+	} else {
+		c.mem.MoveToFront(e.elem)
+	}
+
+	age := now.Sub(e.storedAt)
+	return &cachedResponse{
+		key:      key,
+		status:   e.status,
+		header:   e.header.Clone(),
+		body:     body,
+		age:      age,
+		fresh:    !e.noCache && age < e.ttl,
+		etag:     e.header.Get("ETag"),
+		modified: e.header.Get("Last-Modified"),
+	}
+}
+
+// count records how a request was answered: from the cache, after
+// revalidating a stored copy, or from upstream.
+func (c *httpCache) count(counter *int64) {
+	c.mu.Lock()
+	*counter++
+	c.mu.Unlock()
+}
+
+// store saves a response to r. vary lists the request headers it varies on.
+func (c *httpCache) store(r *http.Request, status int, header http.Header, body []byte, vary []string, ttl time.Duration, noCache bool, now time.Time) {
+	size := int64(len(body))
+	for name, values := range header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	if size > c.objMax || size > c.memMax {
+		return
+	}
+
+	url := r.URL.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(url, vary, r.Header)
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	variants, ok := c.urls[url]
+	if !ok {
+		variants = &urlVariants{}
+		c.urls[url] = variants
+	}
+	variants.vary = vary
+	variants.n++
+
+	e := &cacheEntry{
+		key:      key,
+		url:      url,
+		status:   status,
+		header:   header,
+		storedAt: now,
+		ttl:      ttl,
+		noCache:  noCache,
+		size:     size,
+		body:     body,
+	}
+	e.elem = c.mem.PushFront(e)
+	c.entries[key] = e
+	c.memBytes += size
+	c.stats.Stores++
+	c.shrink()
+}
+
+// refresh updates a stored response after a 304 Not Modified.
+func (c *httpCache) refresh(key string, header http.Header, ttl time.Duration, noCache bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	for name, values := range header {
+		e.header[name] = values
+	}
+	e.storedAt = now
+	e.ttl = ttl
+	e.noCache = noCache
+}
+
+// shrink moves entries out of memory, and off disk, until both tiers fit.
+// Callers hold c.mu.
+func (c *httpCache) shrink() {
+	for c.memBytes > c.memMax {
+		e := c.mem.Back().Value.(*cacheEntry)
+		c.mem.Remove(e.elem)
+		c.memBytes -= e.size
+		if c.dir == "" || e.size > c.diskMax || os.WriteFile(c.path(e.key), e.body, 0644) != nil {
+			c.forget(e)
+			c.stats.Evictions++
+			continue
+		}
+		e.body = nil
+		e.onDisk = true
+		e.elem = c.disk.PushFront(e)
+		c.diskBytes += e.size
+	}
+	for c.diskBytes > c.diskMax {
+		c.remove(c.disk.Back().Value.(*cacheEntry))
+		c.stats.Evictions++
+	}
+}
+
+// remove drops e from its tier. Callers hold c.mu.
+func (c *httpCache) remove(e *cacheEntry) {
+	c.forget(e)
+	if e.onDisk {
+		c.disk.Remove(e.elem)
+		c.diskBytes -= e.size
+		os.Remove(c.path(e.key))
+	} else {
+		c.mem.Remove(e.elem)
+		c.memBytes -= e.size
+	}
+}
+
+// forget drops e from the index. Callers hold c.mu.
+func (c *httpCache) forget(e *cacheEntry) {
+	delete(c.entries, e.key)
+	if variants := c.urls[e.url]; variants != nil {
+		if variants.n--; variants.n <= 0 {
+			delete(c.urls, e.url)
+		}
+	}
+}
+
+func (c *httpCache) path(key string) string {
+	return filepath.Join(c.dir, key+cacheFileExt)
+}
+
+// purge removes every stored variant of url, or everything when url is "",
+// returning how many entries were removed.
+func (c *httpCache) purge(url string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, e := range c.entries {
+		if url == "" || e.url == url {
+			c.remove(e)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *httpCache) snapshot() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.MemoryBytes = c.memBytes
+	stats.DiskBytes = c.diskBytes
+	return stats
+}
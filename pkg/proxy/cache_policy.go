@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uncacheableHeaders mark requests that bypass the cache: credentials,
+// partial, conditional and upgrade requests.
+var uncacheableHeaders = []string{
+	"Authorization", "Cookie", "Range", "Upgrade",
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range",
+}
+
+// cacheableStatus lists the statuses stored when the response allows it.
+var cacheableStatus = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+	http.StatusNotFound, http.StatusGone,
+}
+
+// cacheableRequest reports whether r may be answered from, or stored in, the
+// cache: plain-HTTP GETs without credentials or conditions.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.URL.Scheme != "http" {
+		return false
+	}
+	for _, name := range uncacheableHeaders {
+		if r.Header.Get(name) != "" {
+			return false
+		}
+	}
+	_, noStore := parseCacheControl(r.Header)["no-store"]
+	return !noStore
+}
+
+// wantsRevalidation reports whether the client asked for a fresh response.
+func wantsRevalidation(r *http.Request) bool {
+	cc := parseCacheControl(r.Header)
+	_, noCache := cc["no-cache"]
+	return noCache || cc["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache"
+}
+
+// parseCacheControl returns the Cache-Control directives of h, lowercased,
+// with their unquoted values.
+func parseCacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for part := range strings.SplitSeq(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// responsePolicy decides whether a response may be stored by a shared cache,
+// and for how long it is fresh. Responses without explicit freshness are
+// stored only if they carry a validator, and are revalidated on every use.
+func responsePolicy(status int, h http.Header, now time.Time) (ttl time.Duration, noCache, ok bool) {
+	if !slices.Contains(cacheableStatus, status) || h.Get("Set-Cookie") != "" {
+		return 0, false, false
+	}
+	if slices.Contains(varyHeaders(h), "*") {
+		return 0, false, false
+	}
+
+	cc := parseCacheControl(h)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false, false
+		}
+	}
+	_, noCache = cc["no-cache"]
+
+	explicit := true
+	if seconds, ok := parseSeconds(cc["s-maxage"]); ok {
+		ttl = seconds
+	} else if seconds, ok := parseSeconds(cc["max-age"]); ok {
+		ttl = seconds
+	} else if expires := h.Get("Expires"); expires != "" {
+		// An invalid Expires means already expired
+		if t, err := http.ParseTime(expires); err == nil {
+			date, err := http.ParseTime(h.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			ttl = t.Sub(date)
+		}
+	} else {
+		explicit = false
+	}
+
+	if !explicit && h.Get("ETag") == "" && h.Get("Last-Modified") == "" {
+		return 0, false, false
+	}
+	if age, ok := parseSeconds(h.Get("Age")); ok {
+		ttl -= age
+	}
+	return max(ttl, 0), noCache, true
+}
+
+func parseSeconds(v string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// varyHeaders returns the canonical names in h's Vary header, sorted.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// cacheRecorder passes a response through to the client while keeping a copy
+// for the cache. When a stale copy is being revalidated, a 304 from upstream
+// is answered with that copy instead.
+type cacheRecorder struct {
+	http.ResponseWriter
+	cache *httpCache
+	req   *http.Request
+	stale *cachedResponse
+
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+	skip    bool // don't store: too big, incomplete or a block page
+	discard bool // the stale copy was served; drop upstream's 304 body
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+
+	if status == http.StatusNotModified && rec.stale != nil {
+		rec.serveRevalidated()
+		return
+	}
+
+	rec.header = rec.Header().Clone()
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.discard {
+		return len(p), nil
+	}
+	if !rec.skip {
+		if int64(rec.body.Len()+len(p)) > rec.cache.objMax {
+			rec.skip = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// serveRevalidated refreshes the stale copy with the 304's headers and sends
+// it to the client.
+func (rec *cacheRecorder) serveRevalidated() {
+	now := time.Now()
+	fresh := rec.Header().Clone()
+	fresh.Del("Content-Length") // describes the empty 304, not the stored body
+	for name, values := range fresh {
+		rec.stale.header[name] = values
+	}
+	if ttl, noCache, ok := responsePolicy(rec.stale.status, rec.stale.header, now); ok {
+		rec.cache.refresh(rec.stale.key, fresh, ttl, noCache, now)
+	}
+	rec.cache.count(&rec.cache.stats.Revalidations)
+
+	header := rec.Header()
+	clear(header)
+	for name, values := range rec.stale.header {
+		header[name] = values
+	}
+	header.Del("Age")
+	header.Set("Content-Length", strconv.Itoa(len(rec.stale.body)))
+	rec.ResponseWriter.WriteHeader(rec.stale.status)
+	rec.ResponseWriter.Write(rec.stale.body)
+	rec.discard = true
+}
+
+// finish stores the recorded response if it is complete and cacheable.
+func (rec *cacheRecorder) finish() {
+	if rec.discard || rec.status == 0 {
+		return
+	}
+	rec.cache.count(&rec.cache.stats.Misses)
+	if rec.skip {
+		return
+	}
+
+	now := time.Now()
+	ttl, noCache, ok := responsePolicy(rec.status, rec.header, now)
+	if !ok {
+		return
+	}
+	if cl, err := strconv.Atoi(rec.header.Get("Content-Length")); err == nil && cl != rec.body.Len() {
+		return
+	}
+	rec.cache.store(rec.req, rec.status, rec.header, rec.body.Bytes(), varyHeaders(rec.header), ttl, noCache, now)
+}
+
+// PurgeCache removes the cached responses for url, or every cached response
+// when url is "". It reports how many were removed, and false if the cache is
+// disabled.
+func (s *Server) PurgeCache(url string) (int, bool) {
+	if s.cache == nil {
+		return 0, false
+	}
+	return s.cache.purge(url), true
+}
+
+// skipCache keeps the response being written to w out of the cache.
+func skipCache(w http.ResponseWriter) {
+	if rec, ok := w.(*cacheRecorder); ok {
+		rec.skip = true
+	}
+}
+
+// serveFromCache answers r with a fresh cached response if there is one.
+// Otherwise it returns a recorder to write the upstream response through,
+// having made r conditional when a stale copy can be revalidated; the caller
+// must call its finish method once the response is written.
+func (s *Server) serveFromCache(w http.ResponseWriter, r *http.Request, reqID string) (*cacheRecorder, bool) {
+	cached := s.cache.lookup(r, time.Now())
+	if cached != nil && cached.fresh && !wantsRevalidation(r) {
+		s.cache.count(&s.cache.stats.Hits)
+		s.httpLogger.Debug(reqID, "Cache hit for %s", r.URL)
+
+		header := w.Header()
+		for name, values := range cached.header {
+			header[name] = values
+		}
+		header.Set("Age", strconv.Itoa(int(cached.age.Seconds())))
+		w.WriteHeader(cached.status)
+		written, _ := w.Write(cached.body)
+
+		s.incrementRequestsHandled()
+		s.addBytesTransferred(int64(written))
+		return nil, true
+	}
+
+	rec := &cacheRecorder{ResponseWriter: w, cache: s.cache, req: r}
+	if cached != nil && (cached.etag != "" || cached.modified != "") {
+		rec.stale = cached
+		if cached.etag != "" {
+			r.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.modified != "" {
+			r.Header.Set("If-Modified-Since", cached.modified)
+		}
+	}
+	return rec, false
+}
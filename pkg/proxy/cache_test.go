@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+)
+
+func TestResponsePolicy(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		status  int
+		header  http.Header
+		ttl     time.Duration
+		noCache bool
+		ok      bool
+	}{
+		{200, http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, false, true},
+		{200, http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, 10 * time.Second, false, true},
+		{200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"50"}}, 10 * time.Second, false, true},
+		{200, http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}, "Date": {now.UTC().Format(http.TimeFormat)}}, time.Hour, false, true},
+		{200, http.Header{"Expires": {"0"}}, 0, false, true},
+		{200, http.Header{"Etag": {`"v1"`}}, 0, false, true}, // validator only: revalidate each time
+		{200, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, 0, true, true},
+		{200, http.Header{}, 0, false, false},
+		{200, http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false, false},
+		{200, http.Header{"Cache-Control": {"no-store"}}, 0, false, false},
+		{200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 0, false, false},
+		{200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, 0, false, false},
+		{206, http.Header{"Cache-Control": {"max-age=60"}}, 0, false, false},
+	}
+	for i, c := range cases {
+		ttl, noCache, ok := responsePolicy(c.status, c.header, now)
+		if ttl != c.ttl || noCache != c.noCache || ok != c.ok {
+			t.Errorf("case %d: responsePolicy = (%s, %v, %v), want (%s, %v, %v)", i, ttl, noCache, ok, c.ttl, c.noCache, c.ok)
+		}
+	}
+}
+
+func TestHTTPCacheTiers(t *testing.T) {
+	c, err := newHTTPCache(config.CacheConfig{MemoryMaxMB: 1, DiskPath: t.TempDir(), DiskMaxMB: 1, MaxObjectMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	body := make([]byte, 400<<10)
+
+	get := func(url, lang string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		r.Header.Set("Accept-Language", lang)
+		return r
+	}
+	vary := []string{"Accept-Language"}
+	for _, url := range []string{"http://a.example/1", "http://a.example/2", "http://a.example/3", "http://a.example/4", "http://a.example/5"} {
+		c.store(get(url, "en"), 200, http.Header{}, body, vary, time.Minute, false, now)
+	}
+
+	// Two fit in memory, two more on disk, the oldest is gone
+	stats := c.snapshot()
+	if stats.Entries != 4 || stats.Evictions != 1 || stats.DiskBytes == 0 {
+		t.Fatalf("stats = %+v, want 4 entries with 1 eviction and some on disk", stats)
+	}
+	if c.lookup(get("http://a.example/1", "en"), now) != nil {
+		t.Error("evicted entry still found")
+	}
+	if got := c.lookup(get("http://a.example/2", "en"), now); got == nil || len(got.body) != len(body) || !got.fresh {
+		t.Error("entry on disk not returned intact")
+	}
+	if c.lookup(get("http://a.example/5", "de"), now) != nil {
+		t.Error("variant for another Accept-Language returned")
+	}
+	if c.lookup(get("http://a.example/5", "en"), now.Add(2*time.Minute)).fresh {
+		t.Error("entry fresh past its ttl")
+	}
+
+	if n := c.purge("http://a.example/2"); n != 1 {
+		t.Errorf("purge one URL removed %d", n)
+	}
+	if n := c.purge(""); n != 3 {
+		t.Errorf("purge all removed %d", n)
+	}
+	if stats := c.snapshot(); stats.MemoryBytes != 0 || stats.DiskBytes != 0 {
+		t.Errorf("bytes left after purge: %+v", stats)
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	cache, _ := newHTTPCache(config.CacheConfig{MemoryMaxMB: 1, DiskMaxMB: 1, MaxObjectMB: 1})
+	s := &Server{stats: &Stats{}, httpLogger: logger.New("http"), cache: cache}
+
+	// upstream writes a response the way writeResponse does
+	upstream := func(w http.ResponseWriter, status int, header http.Header, body string) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://a.example/page", nil)
+	rec, served := s.serveFromCache(httptest.NewRecorder(), r, "test")
+	if served {
+		t.Fatal("served from an empty cache")
+	}
+	upstream(rec, 200, http.Header{"Etag": {`"v1"`}, "Content-Length": {"5"}}, "hello")
+	rec.finish()
+
+	// Stored without freshness, so the next request is made conditional and a
+	// 304 is answered from the cache
+	r = httptest.NewRequest(http.MethodGet, "http://a.example/page", nil)
+	client := httptest.NewRecorder()
+	rec, served = s.serveFromCache(client, r, "test")
+	if served {
+		t.Fatal("stale response served without revalidation")
+	}
+	if got := r.Header.Get("If-None-Match"); got != `"v1"` {
+		t.Fatalf("If-None-Match = %q", got)
+	}
+	upstream(rec, http.StatusNotModified, http.Header{"Etag": {`"v1"`}, "Cache-Control": {"max-age=60"}}, "")
+	rec.finish()
+	if client.Code != 200 || client.Body.String() != "hello" {
+		t.Errorf("client got %d %q, want the cached 200", client.Code, client.Body.String())
+	}
+
+	// Now fresh for a minute
+	r = httptest.NewRequest(http.MethodGet, "http://a.example/page", nil)
+	client = httptest.NewRecorder()
+	if _, served = s.serveFromCache(client, r, "test"); !served || client.Body.String() != "hello" {
+		t.Errorf("fresh response not served from cache")
+	}
+
+	stats := cache.snapshot()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Revalidations != 1 {
+		t.Errorf("stats = %+v, want 1 hit, 1 miss, 1 revalidation", stats)
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"strings"
+
+	"aproxy/pkg/scraper"
+)
+
+// route is the path of one attempt: the exit proxy, reached through the
+// earlier hops of a chain. A plain pool or upstream route has a single hop.
+type route struct {
+	hops   []*scraper.Proxy
+	pooled bool // the exit proxy came from the scraped pool
+}
+
+// exit returns the last hop, the proxy that talks to the target.
+func (rt route) exit() *scraper.Proxy {
+	return rt.hops[len(rt.hops)-1]
+}
+
+func (rt route) String() string {
+	addrs := make([]string, len(rt.hops))
+	for i, p := range rt.hops {
+		addrs[i] = p.Address()
+	}
+	return strings.Join(addrs, " -> ")
+}
+
+// chainDialer returns a dialer that tunnels through hops in order.
+func chainDialer(hops []*scraper.Proxy) (UpstreamDialer, error) {
+	var dialer UpstreamDialer = directDialer
+	for _, hop := range hops {
+		var err error
+		if dialer, err = newUpstreamDialer(hop, dialer); err != nil {
+			return nil, err
+		}
+	}
+	return dialer, nil
+}
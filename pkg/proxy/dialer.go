@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aproxy/pkg/scraper"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// handshakeTimeout bounds the handshake with each upstream proxy.
+const handshakeTimeout = 10 * time.Second
+
+// UpstreamDialer opens connections to a target through an upstream proxy.
+// Tunnels and the HTTP transports of routes both dial through one, so each
+// proxy type is spoken in exactly one place.
+type UpstreamDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// directDialer reaches the first hop of every route.
+var directDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// newUpstreamDialer returns a dialer that connects through proxy p, reaching
+// p itself with forward.
+func newUpstreamDialer(p *scraper.Proxy, forward UpstreamDialer) (UpstreamDialer, error) {
+	switch {
+	case p.Type == "socks5":
+		d, err := netproxy.SOCKS5("tcp", p.Address(), nil, netDialer{forward})
+		if err != nil {
+			return nil, err
+		}
+		return d.(UpstreamDialer), nil
+	case p.Type == "socks4":
+		return &socks4Dialer{proxyAddr: p.Address(), forward: forward}, nil
+	case p.TLS:
+		tlsConfig := &tls.Config{ServerName: p.Host, InsecureSkipVerify: !p.VerifyTLS}
+		return &connectDialer{proxyAddr: p.Address(), forward: forward, tlsConfig: tlsConfig}, nil
+	default:
+		// Including pool proxies listed as "https" that don't expect TLS
+		return &connectDialer{proxyAddr: p.Address(), forward: forward}, nil
+	}
+}
+
+// netDialer adapts an UpstreamDialer to x/net/proxy, which needs Dial as well.
+type netDialer struct {
+	UpstreamDialer
+}
+
+func (d netDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// handshake runs fn on a fresh connection to a proxy under handshakeTimeout;
+// canceling ctx aborts it.
+func handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	err := fn()
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
+
+// connectDialer tunnels through an HTTP proxy with CONNECT, speaking TLS to
+// the proxy itself when tlsConfig is set.
+type connectDialer struct {
+	proxyAddr string
+	forward   UpstreamDialer
+	tlsConfig *tls.Config
+}
+
+// dialProxy connects to the proxy itself, for requests sent to it as
+// absolute URIs rather than tunneled.
+func (d *connectDialer) dialProxy(ctx context.Context, network string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.proxyAddr)
+	if err != nil || d.tlsConfig == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	if err := handshake(ctx, conn, func() error { return tlsConn.HandshakeContext(ctx) }); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS to proxy %s: %w", d.proxyAddr, err)
+	}
+	return tlsConn, nil
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialProxy(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	err = handshake(ctx, conn, func() error {
+		connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+		if _, err := io.WriteString(conn, connectReq); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT via %s: %w", d.proxyAddr, err)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// socks4Dialer tunnels through a SOCKS4 proxy, letting the proxy resolve
+// host names (SOCKS4a).
+type socks4Dialer struct {
+	proxyAddr string
+	forward   UpstreamDialer
+}
+
+func (d *socks4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS4 via %s: invalid port %q", d.proxyAddr, portStr)
+	}
+
+	// Version, CONNECT, port, address and an empty user ID. SOCKS4a marks a
+	// host name with the address 0.0.0.1 and sends it after the user ID.
+	req := binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(port))
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(req, ip...)
+		req = append(req, 0)
+	} else {
+		req = append(req, 0, 0, 0, 1, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	conn, err := d.forward.DialContext(ctx, network, d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, conn, func() error {
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		var reply [8]byte
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x5a {
+			return fmt.Errorf("request rejected (code %#x)", reply[1])
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS4 via %s: %w", d.proxyAddr, err)
+	}
+	return conn, nil
+}
+
+// bufferedConn returns bytes read past a CONNECT response before the rest of the stream.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"aproxy/pkg/scraper"
+)
+
+// newEchoTarget listens for connections that echo back what they receive.
+func newEchoTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveFakeUpstream accepts connections on ln and runs handshake on each,
+// which returns the address the client asked for. The connection is then
+// spliced to that address.
+func serveFakeUpstream(t *testing.T, ln net.Listener, handshake func(conn net.Conn, reader *bufio.Reader) (string, bool)) *scraper.Proxy {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				addr, ok := handshake(conn, reader)
+				if !ok {
+					return
+				}
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, reader)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return &scraper.Proxy{Host: host, Port: port}
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// connectHandshake answers an HTTP CONNECT request.
+func connectHandshake(conn net.Conn, reader *bufio.Reader) (string, bool) {
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != http.MethodConnect {
+		return "", false
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	return req.Host, true
+}
+
+// socks4Handshake answers a SOCKS4 or SOCKS4a CONNECT request.
+func socks4Handshake(conn net.Conn, reader *bufio.Reader) (string, bool) {
+	var head [8]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil || head[0] != 4 || head[1] != 1 {
+		return "", false
+	}
+	if _, err := reader.ReadString(0); err != nil { // user ID
+		return "", false
+	}
+	host := net.IP(head[4:8]).String()
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		name, err := reader.ReadString(0)
+		if err != nil {
+			return "", false
+		}
+		host = strings.TrimSuffix(name, "\x00")
+	}
+	conn.Write([]byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(head[2:4])))), true
+}
+
+// socks5Handshake answers a SOCKS5 CONNECT request without authentication.
+func socks5Handshake(conn net.Conn, reader *bufio.Reader) (string, bool) {
+	var greeting [2]byte
+	if _, err := io.ReadFull(reader, greeting[:]); err != nil || greeting[0] != 5 {
+		return "", false
+	}
+	if _, err := io.ReadFull(reader, make([]byte, greeting[1])); err != nil {
+		return "", false
+	}
+	conn.Write([]byte{5, 0})
+
+	var head [4]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil || head[1] != 1 {
+		return "", false
+	}
+	var host string
+	switch head[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", false
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n, err := reader.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", false
+		}
+		host = string(name)
+	default:
+		return "", false
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(reader, port[:]); err != nil {
+		return "", false
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), true
+}
+
+// assertEcho checks that conn reaches an echo target with nothing in between.
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v; want hello echoed", buf, err)
+	}
+}
+
+func TestUpstreamDialers(t *testing.T) {
+	target := newEchoTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	cases := []struct {
+		name      string
+		typ       string
+		handshake func(net.Conn, *bufio.Reader) (string, bool)
+		addr      string
+	}{
+		{"http", "http", connectHandshake, target},
+		{"pool https is plain CONNECT", "https", connectHandshake, target},
+		{"socks4", "socks4", socks4Handshake, target},
+		{"socks4a host name", "socks4", socks4Handshake, net.JoinHostPort("localhost", port)},
+		{"socks5", "socks5", socks5Handshake, target},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := serveFakeUpstream(t, listen(t), c.handshake)
+			p.Type = c.typ
+			dialer, err := chainDialer([]*scraper.Proxy{p})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.DialContext(context.Background(), "tcp", c.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEcho(t, conn)
+		})
+	}
+}
+
+func TestUpstreamDialerTLS(t *testing.T) {
+	target := newEchoTarget(t)
+
+	// httptest supplies a certificate the client can be told to trust
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	ln := tls.NewListener(listen(t), srv.TLS)
+
+	p := serveFakeUpstream(t, ln, connectHandshake)
+	dialer := &connectDialer{proxyAddr: p.Address(), forward: directDialer, tlsConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+	conn, err := dialer.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("got %T, want the tunnel inside TLS to the proxy", conn)
+	}
+	assertEcho(t, conn)
+
+	// An untrusted proxy certificate fails the handshake
+	dialer.tlsConfig = &tls.Config{ServerName: "example.com"}
+	if conn, err := dialer.DialContext(context.Background(), "tcp", target); err == nil {
+		conn.Close()
+		t.Error("dialed through a proxy with an untrusted certificate")
+	}
+
+	// unless verification is off for the proxy
+	p.Type, p.TLS = "https", true
+	unverified, err := chainDialer([]*scraper.Proxy{p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = unverified.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+}
+
+func TestUpstreamDialerChain(t *testing.T) {
+	target := newEchoTarget(t)
+	first := serveFakeUpstream(t, listen(t), socks5Handshake)
+	first.Type = "socks5"
+	second := serveFakeUpstream(t, listen(t), connectHandshake)
+	second.Type = "http"
+
+	dialer, err := chainDialer([]*scraper.Proxy{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+}
+
+func TestUpstreamDialerRefused(t *testing.T) {
+	p := serveFakeUpstream(t, listen(t), func(conn net.Conn, reader *bufio.Reader) (string, bool) {
+		http.ReadRequest(reader)
+		io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		return "", false
+	})
+	p.Type = "http"
+	dialer, _ := chainDialer([]*scraper.Proxy{p})
+	_, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("err = %v, want the proxy's 403", err)
+	}
+}
+
+func TestProxyTransport(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+	socks := serveFakeUpstream(t, listen(t), socks5Handshake)
+	socks.Type = "socks5"
+
+	cases := []struct {
+		name string
+		exit *scraper.Proxy
+	}{
+		{"socks5 tunnels", socks},
+		{"http gets absolute URIs", newForwardProxy(t)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			transport, err := proxyTransport(route{hops: []*scraper.Proxy{c.exit}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.CloseIdleConnections()
+			resp, err := (&http.Client{Transport: transport}).Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ok" {
+				t.Errorf("got %d %q, want 200 ok", resp.StatusCode, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"aproxy/pkg/manager"
+	"aproxy/pkg/scraper"
+)
+
+// proxyQuery is the parsed /proxies query string.
+type proxyQuery struct {
+	filter manager.ProxyFilter
+	sort   string
+	desc   bool
+	offset int
+	limit  int // 0 means no limit
+	format string
+}
+
+// proxySorters are the accepted ?sort= keys.
+var proxySorters = map[string]func(a, b scraper.Proxy) int{
+	"address":      func(a, b scraper.Proxy) int { return cmp.Compare(a.Address(), b.Address()) },
+	"type":         func(a, b scraper.Proxy) int { return cmp.Compare(a.Type, b.Type) },
+	"country":      func(a, b scraper.Proxy) int { return cmp.Compare(a.Country, b.Country) },
+	"latency":      func(a, b scraper.Proxy) int { return cmp.Compare(a.Latency, b.Latency) },
+	"success_rate": func(a, b scraper.Proxy) int { return cmp.Compare(a.SuccessRate, b.SuccessRate) },
+	"last_seen":    func(a, b scraper.Proxy) int { return a.LastSeen.Compare(b.LastSeen) },
+}
+
+// proxyFormats maps ?format= values to their writers and content types.
+var proxyFormats = map[string]struct {
+	contentType string
+	write       func(w io.Writer, proxies []scraper.Proxy, total int, q proxyQuery) error
+}{
+	"json":  {"application/json", writeProxiesJSON},
+	"txt":   {"text/plain; charset=utf-8", writeProxiesText},
+	"csv":   {"text/csv; charset=utf-8", writeProxiesCSV},
+	"clash": {"text/yaml; charset=utf-8", writeProxiesClash},
+	"surge": {"text/plain; charset=utf-8", writeProxiesSurge},
+	"pac":   {pacContentType, writeProxiesPAC},
+}
+
+// parseProxyQuery reads filters (type, country, anonymity, max_latency,
+// min_success_rate), sort (prefix "-" for descending), offset/limit and format.
+// List parameters take comma-separated or repeated values.
+func parseProxyQuery(values url.Values) (proxyQuery, error) {
+	q := proxyQuery{format: "json"}
+
+	q.filter.Types = listParam(values, "type")
+	q.filter.Countries = listParam(values, "country")
+	q.filter.Anonymity = listParam(values, "anonymity")
+
+	if v := values.Get("max_latency"); v != "" {
+		d, err := parseLatency(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid max_latency %q", v)
+		}
+		q.filter.MaxLatency = d
+	}
+	if v := values.Get("min_success_rate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return q, fmt.Errorf("min_success_rate must be between 0 and 1")
+		}
+		q.filter.MinSuccessRate = rate
+	}
+
+	if v := values.Get("sort"); v != "" {
+		key, desc := strings.CutPrefix(v, "-")
+		if _, ok := proxySorters[key]; !ok {
+			return q, fmt.Errorf("unknown sort key %q", key)
+		}
+		q.sort, q.desc = key, desc
+	}
+
+	var err error
+	if q.offset, err = intParam(values, "offset"); err != nil {
+		return q, err
+	}
+	if q.limit, err = intParam(values, "limit"); err != nil {
+		return q, err
+	}
+
+	if v := values.Get("format"); v != "" {
+		if v == "text" {
+			v = "txt"
+		}
+		if _, ok := proxyFormats[v]; !ok {
+			return q, fmt.Errorf("unknown format %q", v)
+		}
+		q.format = v
+	}
+
+	return q, nil
+}
+
+// apply filters, sorts and paginates, returning the page and the match count.
+func (q proxyQuery) apply(proxies []scraper.Proxy) ([]scraper.Proxy, int) {
+	matched := slices.Clone(q.filter.Apply(proxies))
+
+	if sorter := proxySorters[q.sort]; sorter != nil {
+		slices.SortStableFunc(matched, func(a, b scraper.Proxy) int {
+			if q.desc {
+				return sorter(b, a)
+			}
+			return sorter(a, b)
+		})
+	}
+
+	total := len(matched)
+	start := min(q.offset, total)
+	end := total
+	if q.limit > 0 {
+		end = min(start+q.limit, total)
+	}
+	return matched[start:end], total
+}
+
+func listParam(values url.Values, key string) []string {
+	var out []string
+	for _, v := range values[key] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+func intParam(values url.Values, key string) (int, error) {
+	v := values.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return n, nil
+}
+
+// parseLatency accepts a Go duration ("750ms") or a bare number of milliseconds.
+func parseLatency(v string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(v); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// proxyURL renders p as proto://host:port.
+func proxyURL(p scraper.Proxy) string {
+	return fmt.Sprintf("%s://%s", p.Type, p.Address())
+}
+
+func writeProxiesJSON(w io.Writer, proxies []scraper.Proxy, total int, q proxyQuery) error {
+	list := make([]map[string]any, len(proxies))
+	for i, p := range proxies {
+		list[i] = map[string]any{
+			"host":         p.Host,
+			"port":         p.Port,
+			"type":         p.Type,
+			"country":      p.Country,
+			"anonymity":    p.Anonymity,
+			"latency_ms":   p.Latency.Milliseconds(),
+			"success_rate": p.SuccessRate,
+			"last_seen":    p.LastSeen.Format("2006-01-02T15:04:05Z"),
+		}
+	}
+	return json.NewEncoder(w).Encode(map[string]any{
+		"proxies": list,
+		"count":   len(proxies),
+		"total":   total,
+		"offset":  q.offset,
+		"limit":   q.limit,
+	})
+}
+
+func writeProxiesText(w io.Writer, proxies []scraper.Proxy, _ int, _ proxyQuery) error {
+	for _, p := range proxies {
+		if _, err := fmt.Fprintln(w, proxyURL(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeProxiesCSV(w io.Writer, proxies []scraper.Proxy, _ int, _ proxyQuery) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"host", "port", "type", "country", "anonymity", "latency_ms", "success_rate", "last_seen"})
+	for _, p := range proxies {
+		cw.Write([]string{
+			p.Host,
+			strconv.Itoa(p.Port),
+			p.Type,
+			p.Country,
+			p.Anonymity,
+			strconv.FormatInt(p.Latency.Milliseconds(), 10),
+			strconv.FormatFloat(p.SuccessRate, 'f', 3, 64),
+			p.LastSeen.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// clientType maps a pool type onto the proxy types Clash and Surge know.
+// SOCKS4 has no equivalent in either and is skipped.
+func clientType(p scraper.Proxy) (string, bool) {
+	switch p.Type {
+	case "http", "https":
+		return "http", true
+	case "socks5":
+		return "socks5", true
+	default:
+		return "", false
+	}
+}
+
+func proxyName(p scraper.Proxy) string {
+	if p.Country != "" {
+		return fmt.Sprintf("%s-%s-%s-%d", p.Country, p.Type, p.Host, p.Port)
+	}
+	return fmt.Sprintf("%s-%s-%d", p.Type, p.Host, p.Port)
+}
+
+func writeProxiesClash(w io.Writer, proxies []scraper.Proxy, _ int, _ proxyQuery) error {
+	if _, err := fmt.Fprintln(w, "proxies:"); err != nil {
+		return err
+	}
+	for _, p := range proxies {
+		typ, ok := clientType(p)
+		if !ok {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "  - name: %q\n    type: %s\n    server: %q\n    port: %d\n",
+			proxyName(p), typ, p.Host, p.Port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeProxiesSurge(w io.Writer, proxies []scraper.Proxy, _ int, _ proxyQuery) error {
+	if _, err := fmt.Fprintln(w, "[Proxy]"); err != nil {
+		return err
+	}
+	for _, p := range proxies {
+		typ, ok := clientType(p)
+		if !ok {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s, %s, %d\n", proxyName(p), typ, p.Host, p.Port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeProxiesPAC(w io.Writer, proxies []scraper.Proxy, _ int, _ proxyQuery) error {
+	_, err := io.WriteString(w, poolPAC(proxies))
+	return err
+}
+
+// writeProxies renders the page in the requested format.
+func writeProxies(w http.ResponseWriter, proxies []scraper.Proxy, total int, q proxyQuery) error {
+	format := proxyFormats[q.format]
+	w.Header().Set("Content-Type", format.contentType)
+	return format.write(w, proxies, total, q)
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"aproxy/pkg/scraper"
+)
+
+func TestProxyQueryApply(t *testing.T) {
+	pool := []scraper.Proxy{
+		{Host: "1.1.1.1", Port: 80, Type: "http", Country: "US", Latency: 300 * time.Millisecond, SuccessRate: 0.9},
+		{Host: "2.2.2.2", Port: 1080, Type: "socks5", Country: "DE", Latency: 100 * time.Millisecond, SuccessRate: 0.5},
+		{Host: "3.3.3.3", Port: 8080, Type: "http", Country: "us", Latency: 900 * time.Millisecond, SuccessRate: 1},
+		{Host: "4.4.4.4", Port: 3128, Type: "https", Country: "FR", Anonymity: "elite", Latency: 200 * time.Millisecond, SuccessRate: 0.8},
+	}
+
+	cases := []struct {
+		query string
+		want  string // comma-joined hosts, in order
+		total int
+	}{
+		{"", "1.1.1.1,2.2.2.2,3.3.3.3,4.4.4.4", 4},
+		{"type=http", "1.1.1.1,3.3.3.3", 2},
+		{"type=socks5,https", "2.2.2.2,4.4.4.4", 2},
+		{"country=US", "1.1.1.1,3.3.3.3", 2},
+		{"anonymity=elite", "4.4.4.4", 1},
+		{"max_latency=300", "1.1.1.1,2.2.2.2,4.4.4.4", 3},
+		{"max_latency=250ms&min_success_rate=0.6", "4.4.4.4", 1},
+		{"sort=latency", "2.2.2.2,4.4.4.4,1.1.1.1,3.3.3.3", 4},
+		{"sort=-success_rate&limit=2", "3.3.3.3,1.1.1.1", 4},
+		{"sort=latency&offset=3&limit=5", "3.3.3.3", 4},
+		{"offset=10", "", 4},
+	}
+
+	for _, c := range cases {
+		values, _ := url.ParseQuery(c.query)
+		q, err := parseProxyQuery(values)
+		if err != nil {
+			t.Errorf("parseProxyQuery(%q): %v", c.query, err)
+			continue
+		}
+		page, total := q.apply(pool)
+		hosts := make([]string, len(page))
+		for i, p := range page {
+			hosts[i] = p.Host
+		}
+		if got := strings.Join(hosts, ","); got != c.want || total != c.total {
+			t.Errorf("query %q = %q (total %d), want %q (total %d)", c.query, got, total, c.want, c.total)
+		}
+	}
+
+	for _, bad := range []string{"sort=speed", "format=xml", "limit=-1", "min_success_rate=2", "max_latency=fast"} {
+		values, _ := url.ParseQuery(bad)
+		if _, err := parseProxyQuery(values); err == nil {
+			t.Errorf("parseProxyQuery(%q): expected error", bad)
+		}
+	}
+}
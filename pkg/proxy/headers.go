@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// hopHeaders apply to a single connection (RFC 7230 section 6.1) and are
+// never forwarded, along with any header a Connection header names.
+// Proxy-Connection and Keep-Alive are non-standard but widely sent.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// removeRequestHopHeaders deletes the hop-by-hop headers from a request to
+// be forwarded. The handshake of an upgrade request is kept, since it is
+// asking every hop to switch, and so is "TE: trailers", which says the
+// client understands trailers rather than anything about the connection.
+func removeRequestHopHeaders(h http.Header) {
+	upgrade := ""
+	if h.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(h["Connection"], "upgrade") {
+		upgrade = h.Get("Upgrade")
+	}
+	trailers := httpguts.HeaderValuesContainsToken(h["Te"], "trailers")
+
+	removeHopHeaders(h)
+
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// removeResponseHopHeaders deletes the hop-by-hop headers from a response to
+// be relayed, keeping the handshake of a 101 Switching Protocols.
+func removeResponseHopHeaders(resp *http.Response) {
+	upgrade := ""
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		upgrade = resp.Header.Get("Upgrade")
+	}
+
+	removeHopHeaders(resp.Header)
+
+	if upgrade != "" {
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", upgrade)
+	}
+}
+
+// applyVia handles the Via header of a message received over protoMajor.protoMinor
+// according to s.config.Via.
+func (s *Server) applyVia(h http.Header, protoMajor, protoMinor int) {
+	switch s.config.Via.Mode {
+	case "keep":
+	case "append":
+		h.Add("Via", viaProtocol(protoMajor, protoMinor)+" "+s.config.Via.Pseudonym)
+	default:
+		h.Del("Via")
+	}
+}
+
+// viaProtocol is the received-protocol of a Via entry: "1.1" for HTTP/1.1,
+// "2" for HTTP/2.
+func viaProtocol(major, minor int) string {
+	if major >= 2 {
+		return fmt.Sprintf("%d", major)
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+func TestHopByHopHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		h := w.Header()
+		h.Set("Connection", "X-Target-Hop")
+		h.Set("X-Target-Hop", "1")
+		h.Set("Keep-Alive", "timeout=5")
+		h.Set("Proxy-Authenticate", `Basic realm="upstream"`)
+		h.Set("Upgrade", "h2c")
+		h.Set("Trailer", "X-Checksum")
+		h.Set("Via", "1.1 origin-cache")
+		h.Set("X-End-To-End", "kept")
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+	host := strings.TrimPrefix(target.URL, "http://")
+
+	cases := []struct {
+		mode        string
+		wantReqVia  string
+		wantRespVia []string
+	}{
+		{"strip", "", nil},
+		{"keep", "1.0 client-proxy", []string{"1.1 origin-cache"}},
+		{"append", "1.0 client-proxy, 1.1 edge", []string{"1.1 origin-cache", "1.1 edge"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.mode, func(t *testing.T) {
+			s := newDirectServer(t, config.ServerConfig{Via: config.ViaConfig{Mode: c.mode, Pseudonym: "edge"}}, &http.Transport{})
+			front := httptest.NewServer(s)
+			defer front.Close()
+
+			conn, err := net.Dial("tcp", front.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, "GET "+target.URL+"/ HTTP/1.1\r\n"+
+				"Host: "+host+"\r\n"+
+				"Connection: keep-alive, X-Client-Hop\r\n"+
+				"X-Client-Hop: 1\r\n"+
+				"Keep-Alive: 300\r\n"+
+				"Proxy-Connection: keep-alive\r\n"+
+				"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n"+
+				"Upgrade: websocket\r\n"+ // not named in Connection, so not an upgrade
+				"Te: trailers, deflate\r\n"+
+				"Via: 1.0 client-proxy\r\n"+
+				"X-End-To-End: kept\r\n\r\n")
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			got := <-received
+			for _, name := range []string{"Connection", "X-Client-Hop", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Upgrade"} {
+				if v := got.Get(name); v != "" {
+					t.Errorf("target received %s: %q", name, v)
+				}
+			}
+			if v := got.Get("Te"); v != "trailers" {
+				t.Errorf("target received TE %q, want only trailers", v)
+			}
+			if v := got.Get("X-End-To-End"); v != "kept" {
+				t.Errorf("end-to-end request header lost: %q", v)
+			}
+			if v := strings.Join(got.Values("Via"), ", "); v != c.wantReqVia {
+				t.Errorf("target received Via %q, want %q", v, c.wantReqVia)
+			}
+
+			for _, name := range []string{"Connection", "X-Target-Hop", "Keep-Alive", "Proxy-Authenticate", "Upgrade", "Trailer"} {
+				if v := resp.Header.Get(name); v != "" {
+					t.Errorf("client received %s: %q", name, v)
+				}
+			}
+			if v := resp.Header.Get("X-End-To-End"); v != "kept" {
+				t.Errorf("end-to-end response header lost: %q", v)
+			}
+			if v := resp.Header.Values("Via"); strings.Join(v, ", ") != strings.Join(c.wantRespVia, ", ") {
+				t.Errorf("client received Via %q, want %q", v, c.wantRespVia)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"aproxy/pkg/manager"
+	"aproxy/pkg/rules"
+)
+
+// defaultHedgeDelay is used when no delay is configured and the pool has no
+// latency data yet.
+const defaultHedgeDelay = time.Second
+
+// maxHeldBlockPage bounds the block pages hedged attempts hold on to in case
+// every attempt is blocked. Larger ones are dropped.
+const maxHeldBlockPage = 1 << 20
+
+// hedgeable reports whether r may be sent to several upstreams at once: CONNECT
+// and bodiless safe methods.
+func hedgeable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodConnect:
+		return true
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.ContentLength == 0 && !isUpgrade(r)
+	default:
+		return false
+	}
+}
+
+// hedgeDelay returns how long to wait before starting another attempt.
+func (s *Server) hedgeDelay() time.Duration {
+	if s.config.Hedge.Delay > 0 {
+		return s.config.Hedge.Delay
+	}
+	if p90 := s.manager.LatencyPercentile(0.9); p90 > 0 {
+		return p90
+	}
+	return defaultHedgeDelay
+}
+
+// hedgeOutcome is the result of one hedged attempt.
+type hedgeOutcome[T any] struct {
+	idx int
+	val T
+	rt  route
+	err error
+}
+
+// hedgeResult is the winning attempt. stop releases its context once the caller
+// is done with val.
+type hedgeResult[T any] struct {
+	val    T
+	rt     route
+	stop   context.CancelFunc
+	failed []hedgeFailure // attempts that failed on their own, not by cancellation
+}
+
+// hedgeFailure is an attempt that failed on its own.
+type hedgeFailure struct {
+	rt  route
+	err error
+}
+
+// hedged races attempt over up to maxAttempts routes from pick. The first
+// attempt starts at once; another starts after each delay, or immediately when
+// every running attempt has failed. The first success wins and the others are
+// canceled, with any late successes passed to discard. Canceled attempts are
+// not reported in failed.
+func hedged[T any](ctx context.Context, maxAttempts int, delay time.Duration,
+	pick func() (route, error),
+	attempt func(ctx context.Context, rt route) (T, error),
+	discard func(T),
+) (hedgeResult[T], error) {
+	results := make(chan hedgeOutcome[T], maxAttempts)
+	var cancels []context.CancelFunc
+	var res hedgeResult[T]
+	lastErr := errors.New("no attempts made")
+	running := 0
+
+	launch := func() {
+		idx := len(cancels)
+		actx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+
+		rt, err := pick()
+		if err != nil {
+			cancel()
+			lastErr = err
+			return
+		}
+		running++
+		go func() {
+			val, err := attempt(actx, rt)
+			results <- hedgeOutcome[T]{idx: idx, val: val, rt: rt, err: err}
+		}()
+	}
+
+	// finish cancels every attempt but the winner and cleans up the rest.
+	finish := func(winner int) {
+		for i, cancel := range cancels {
+			if i != winner {
+				cancel()
+			}
+		}
+		go func(pending int) {
+			for range pending {
+				if o := <-results; o.err == nil {
+					discard(o.val)
+				}
+			}
+		}(running)
+	}
+
+	launch()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		if running == 0 {
+			if len(cancels) >= maxAttempts {
+				finish(-1)
+				return res, lastErr
+			}
+			launch()
+			timer.Reset(delay)
+			continue
+		}
+
+		select {
+		case <-timer.C:
+			if len(cancels) < maxAttempts {
+				launch()
+				timer.Reset(delay)
+			}
+		case o := <-results:
+			running--
+			if o.err == nil {
+				finish(o.idx)
+				res.val, res.rt, res.stop = o.val, o.rt, cancels[o.idx]
+				return res, nil
+			}
+			cancels[o.idx]()
+			lastErr = o.err
+			if ctx.Err() == nil {
+				res.failed = append(res.failed, hedgeFailure{rt: o.rt, err: o.err})
+			}
+		case <-ctx.Done():
+			finish(-1)
+			return res, ctx.Err()
+		}
+	}
+}
+
+// handleHedgedHTTP sends a plain HTTP request through racing upstreams and
+// relays the first response.
+func (s *Server) handleHedgedHTTP(w http.ResponseWriter, r *http.Request, d rules.Decision, reqID string) {
+	s.incrementActiveConnections()
+	defer s.decrementActiveConnections()
+
+	delay := s.hedgeDelay()
+	s.httpLogger.Debug(reqID, "Starting hedged HTTP attempts (max: %d, delay: %s)", s.config.Hedge.MaxAttempts, delay)
+
+	res, err := hedged(r.Context(), s.config.Hedge.MaxAttempts, delay,
+		func() (route, error) { return s.pickRoute(d, targetHost(r)) },
+		func(ctx context.Context, rt route) (*http.Response, error) {
+			transport, err := s.transports.get(rt)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := s.sendHTTP(ctx, r, transport)
+			if err == nil {
+				if err = s.checkBlocked(resp, r, rt, reqID); err != nil {
+					err = holdBlockPage(resp, err)
+					resp = nil
+				}
+			}
+			if err != nil {
+				s.httpLogger.Debug(reqID, "Hedged attempt via %s failed: %v", rt, err)
+			}
+			return resp, err
+		},
+		func(resp *http.Response) { resp.Body.Close() },
+	)
+	for _, f := range res.failed {
+		// Blocked attempts were recorded by checkBlocked; the proxy itself works
+		if !errors.Is(f.err, errBlocked) {
+			s.reportFailure(f.rt, targetHost(r))
+		}
+	}
+	if err != nil {
+		if s.rejectRateLimited(w, err) {
+			return
+		}
+		if page := lastBlockPage(res.failed); page != nil {
+			// As without hedging, the client gets the block page, uncached
+			s.httpLogger.Warn(reqID, "All hedged attempts were blocked by %s", r.URL.Host)
+			skipCache(w)
+			if err := s.writeResponse(w, page, reqID); err != nil {
+				s.abortResponse(w, reqID)
+			}
+			return
+		}
+		s.httpLogger.Error(reqID, "All hedged attempts failed: %v", err)
+		s.incrementFailedRequests()
+		http.Error(w, "All proxy attempts failed", http.StatusBadGateway)
+		return
+	}
+	defer res.stop()
+
+	if err := s.writeResponse(w, res.val, reqID); err != nil {
+		s.httpLogger.Warn(reqID, "Response via proxy %s broke off: %v", res.rt, err)
+		if errors.Is(err, errUpstreamBroken) {
+			s.reportFailure(res.rt, targetHost(r))
+		}
+		s.abortResponse(w, reqID)
+		return
+	}
+	s.httpLogger.Info(reqID, "Request successful via proxy %s (hedged)", res.rt)
+}
+
+// blockPageError is a hedged attempt's block page, read into memory so it
+// outlives the attempt's context.
+type blockPageError struct {
+	resp *http.Response
+}
+
+func (e *blockPageError) Error() string { return errBlocked.Error() }
+func (e *blockPageError) Unwrap() error { return errBlocked }
+
+// holdBlockPage closes resp and returns err, for a block page with the page
+// attached if it is small enough to keep.
+func holdBlockPage(resp *http.Response, err error) error {
+	defer resp.Body.Close()
+	if !errors.Is(err, errBlocked) {
+		return err
+	}
+	body, readErr := io.ReadAll(io.LimitReader(resp.Body, maxHeldBlockPage+1))
+	if readErr != nil || len(body) > maxHeldBlockPage {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return &blockPageError{resp: resp}
+}
+
+// lastBlockPage returns the block page of the last failed attempt that has
+// one, or nil.
+func lastBlockPage(failed []hedgeFailure) *http.Response {
+	for i := len(failed) - 1; i >= 0; i-- {
+		if page, ok := failed[i].err.(*blockPageError); ok {
+			return page.resp
+		}
+	}
+	return nil
+}
+
+// handleHedgedConnect opens tunnels through racing upstreams and relays the
+// first to connect.
+func (s *Server) handleHedgedConnect(w http.ResponseWriter, r *http.Request, d rules.Decision, reqID string) {
+	s.incrementActiveConnections()
+	defer s.decrementActiveConnections()
+
+	host := connectAddr(r)
+
+	delay := s.hedgeDelay()
+	s.httpsLogger.Debug(reqID, "Starting hedged CONNECT attempts (max: %d, delay: %s) for %s", s.config.Hedge.MaxAttempts, delay, host)
+
+	res, err := hedged(r.Context(), s.config.Hedge.MaxAttempts, delay,
+		func() (route, error) { return s.pickRoute(d, targetHost(r)) },
+		func(ctx context.Context, rt route) (net.Conn, error) {
+			dialer, err := chainDialer(rt.hops)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := dialer.DialContext(ctx, "tcp", host)
+			if err != nil {
+				s.httpsLogger.Debug(reqID, "Hedged attempt via %s failed: %v", rt, err)
+			}
+			return conn, err
+		},
+		func(conn net.Conn) { conn.Close() },
+	)
+	for _, f := range res.failed {
+		s.reportFailure(f.rt, targetHost(r))
+	}
+	if err != nil {
+		if s.rejectRateLimited(w, err) {
+			return
+		}
+		s.httpsLogger.Error(reqID, "All hedged CONNECT attempts failed: %v", err)
+		s.incrementFailedRequests()
+		http.Error(w, "All HTTPS proxy attempts failed", http.StatusBadGateway)
+		return
+	}
+	defer res.stop()
+	targetConn := res.val
+	defer targetConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.httpsLogger.Error(reqID, "Hijacking not supported")
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		s.httpsLogger.Error(reqID, "Hijacking failed: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	s.httpsLogger.Info(reqID, "CONNECT tunnel successful via proxy %s (hedged)", res.rt)
+	s.reportOutcome(res.rt, targetHost(r), manager.OutcomeSuccess)
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	s.relay(clientConn, targetConn)
+
+	s.incrementRequestsHandled()
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/rules"
+	"aproxy/pkg/scraper"
+)
+
+func TestHedged(t *testing.T) {
+	// Routes are numbered by port; each attempt behaves per its entry.
+	type behavior struct {
+		after time.Duration
+		fail  bool
+	}
+
+	cases := []struct {
+		name       string
+		attempts   []behavior
+		max        int
+		wantPort   int // 0 means expect an error
+		wantFailed int
+	}{
+		{"first fast", []behavior{{after: 0}, {after: 0}}, 2, 1, 0},
+		{"slow first is hedged", []behavior{{after: time.Second}, {after: 0}}, 2, 2, 0},
+		{"failure starts next at once", []behavior{{fail: true}, {after: 0}}, 2, 2, 1},
+		{"third attempt", []behavior{{after: time.Second}, {fail: true}, {after: 0}}, 3, 3, 1},
+		{"all fail", []behavior{{fail: true}, {fail: true}}, 2, 0, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var next atomic.Int32
+			pick := func() (route, error) {
+				n := int(next.Add(1))
+				return route{hops: []*scraper.Proxy{{Host: "p", Port: n}}, pooled: true}, nil
+			}
+			attempt := func(ctx context.Context, rt route) (int, error) {
+				b := c.attempts[rt.exit().Port-1]
+				select {
+				case <-time.After(b.after):
+				case <-ctx.Done():
+					return 0, ctx.Err()
+				}
+				if b.fail {
+					return 0, fmt.Errorf("attempt %d failed", rt.exit().Port)
+				}
+				return rt.exit().Port, nil
+			}
+
+			res, err := hedged(context.Background(), c.max, 50*time.Millisecond, pick, attempt, func(int) {})
+			if c.wantPort == 0 {
+				if err == nil {
+					t.Fatalf("expected error, got winner %d", res.val)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if res.val != c.wantPort {
+					t.Errorf("winner = %d, want %d", res.val, c.wantPort)
+				}
+				res.stop()
+			}
+			if len(res.failed) != c.wantFailed {
+				t.Errorf("failed = %d routes, want %d", len(res.failed), c.wantFailed)
+			}
+		})
+	}
+}
+
+func TestHedgedPickError(t *testing.T) {
+	errNone := errors.New("no proxies")
+	_, err := hedged(context.Background(), 2, time.Millisecond,
+		func() (route, error) { return route{}, errNone },
+		func(context.Context, route) (int, error) { return 1, nil },
+		func(int) {})
+	if !errors.Is(err, errNone) {
+		t.Fatalf("err = %v, want %v", err, errNone)
+	}
+}
+
+func TestHedgedHTTPBlockPage(t *testing.T) {
+	var hits atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "please solve the captcha")
+	}))
+	defer target.Close()
+
+	first, second := newForwardProxy(t), newForwardProxy(t)
+	engine, err := rules.NewEngine(
+		[]config.RuleConfig{{Action: "upstream", Upstream: "static"}},
+		[]config.UpstreamConfig{{Name: "static", Proxies: []string{first.Address(), second.Address()}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newHTTPCache(config.CacheConfig{MemoryMaxMB: 1, DiskMaxMB: 1, MaxObjectMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newDirectServer(t, config.ServerConfig{
+		Hedge: config.HedgeConfig{Enabled: true, Delay: 10 * time.Millisecond, MaxAttempts: 2},
+	}, &http.Transport{})
+	s.rules = engine
+	s.transports = newTransportCache(10, time.Minute)
+	s.blocks = newBlockDetector(config.BlockDetectionConfig{
+		Enabled:   true,
+		BodyBytes: 256,
+		Rules:     []config.BlockRuleConfig{{Name: "captcha", Body: "captcha"}},
+	})
+	s.cache = cache
+	defer s.transports.closeAll()
+
+	proxyURL := &url.URL{Scheme: "http", Host: serve(t, s)}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for i := range 2 {
+		resp, err := client.Get(target.URL + "/page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "please solve the captcha" {
+			t.Errorf("request %d: got %d %q, want the block page", i, resp.StatusCode, body)
+		}
+	}
+
+	// Every attempt of both requests reached the target: the page wasn't cached
+	if got := hits.Load(); got != 4 {
+		t.Errorf("target hit %d times, want 4", got)
+	}
+	if stats := s.getStats(); stats.FailedRequests != 0 {
+		t.Errorf("failed requests = %d, want the block page relayed", stats.FailedRequests)
+	}
+}
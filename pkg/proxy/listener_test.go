@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/database"
+	"aproxy/internal/logger"
+	"aproxy/pkg/manager"
+	"aproxy/pkg/rules"
+	"aproxy/pkg/scraper"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+func TestListenerPolicy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Policy"))
+	}))
+	defer target.Close()
+
+	s := newDirectServer(t, config.ServerConfig{
+		AuthToken:  "secret",
+		AddHeaders: map[string]string{"X-Policy": "main"},
+	}, &http.Transport{})
+	internal, err := s.Listener(config.ListenerConfig{
+		Name:       "internal",
+		AddHeaders: map[string]string{"X-Policy": "internal"},
+	}, s.rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		server *Server
+		user   *url.Userinfo
+		status int
+		body   string
+	}{
+		{"main port needs the token", s, nil, http.StatusProxyAuthRequired, ""},
+		{"token as the Basic password", s, url.UserPassword("alice", "secret"), http.StatusOK, "main"},
+		{"wrong Basic password", s, url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired, ""},
+		{"listener without auth", internal, nil, http.StatusOK, "internal"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxyURL := &url.URL{Scheme: "http", User: c.user, Host: serve(t, c.server)}
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			resp, err := client.Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != c.status || (c.body != "" && string(body) != c.body) {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, c.status, c.body)
+			}
+		})
+	}
+
+	// Listeners share the server's stats
+	if got := s.getStats().RequestsHandled; got != 2 {
+		t.Errorf("requests handled = %d, want the listener's request counted with the main port's", got)
+	}
+}
+
+func TestListenerDefaultFilter(t *testing.T) {
+	engine, err := rules.NewEngine([]config.RuleConfig{
+		{Domains: []string{"us.example"}, Action: "pool", Filter: config.FilterConfig{Countries: []string{"US"}}},
+		{Domains: []string{"any.example"}, Action: "pool"},
+		{Domains: []string{"local.example"}, Action: "direct"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{rules: engine}
+	l, err := s.Listener(config.ListenerConfig{Filter: config.FilterConfig{Anonymity: []string{"elite"}}}, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host      string
+		action    rules.Action
+		anonymity []string
+		countries []string
+	}{
+		{"us.example", rules.ActionPool, nil, []string{"US"}},
+		{"any.example", rules.ActionPool, []string{"elite"}, nil},
+		{"other.example", rules.ActionPool, []string{"elite"}, nil},
+		{"local.example", rules.ActionDirect, nil, nil},
+	}
+	for _, c := range cases {
+		d := l.match(httptest.NewRequest(http.MethodGet, "http://"+c.host+"/", nil), 80)
+		if d.Action != c.action || !slices.Equal(d.Filter.Anonymity, c.anonymity) || !slices.Equal(d.Filter.Countries, c.countries) {
+			t.Errorf("%s: got %s %+v, want %s anonymity %v countries %v", c.host, d.Action, d.Filter, c.action, c.anonymity, c.countries)
+		}
+	}
+	if d := s.match(httptest.NewRequest(http.MethodGet, "http://other.example/", nil), 80); !d.Filter.IsZero() {
+		t.Errorf("main port filter = %+v, want none", d.Filter)
+	}
+}
+
+func TestSOCKSListener(t *testing.T) {
+	echo := newEchoTarget(t)
+	engine, err := rules.NewEngine([]config.RuleConfig{
+		{Domains: []string{"blocked.example"}, Action: "reject"},
+		{CIDRs: []string{"127.0.0.0/8"}, Action: "direct"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newDirectServer(t, config.ServerConfig{EnableHTTPS: true}, &http.Transport{})
+	l, err := s.Listener(config.ListenerConfig{Name: "partner", Protocol: "socks5", AuthToken: "secret"}, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, l)
+
+	dial := func(auth *netproxy.Auth, target string) error {
+		dialer, err := netproxy.SOCKS5("tcp", addr, auth, netproxy.Direct)
+		if err != nil {
+			return err
+		}
+		conn, err := dialer.Dial("tcp", target)
+		if err == nil {
+			assertEcho(t, conn)
+		}
+		return err
+	}
+
+	if err := dial(&netproxy.Auth{User: "partner", Password: "secret"}, echo); err != nil {
+		t.Fatalf("tunnel with the token: %v", err)
+	}
+	if err := dial(&netproxy.Auth{User: "partner", Password: "wrong"}, echo); err == nil {
+		t.Error("tunnel opened with a wrong password")
+	}
+	if err := dial(nil, echo); err == nil {
+		t.Error("tunnel opened without authentication")
+	}
+	if err := dial(&netproxy.Auth{User: "partner", Password: "secret"}, "blocked.example:443"); err == nil {
+		t.Error("tunnel opened to a rejected host")
+	}
+}
+
+func TestSOCKSListenerAcceptErrors(t *testing.T) {
+	ln := &flakyListener{Listener: listen(t), errs: []error{
+		&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE},
+		timeoutError{},
+	}}
+	l := newSOCKSListener(ln, logger.New("server"))
+	defer l.Close()
+
+	go func() {
+		dialer, _ := netproxy.SOCKS5("tcp", ln.Addr().String(), nil, netproxy.Direct)
+		if conn, err := dialer.Dial("tcp", "example.com:443"); err == nil {
+			conn.Close()
+		}
+	}()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line != "CONNECT example.com:443 HTTP/1.1\r\n" {
+			t.Errorf("read %q, want the CONNECT request", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SOCKS5 listener stopped after temporary Accept errors")
+	}
+}
+
+func TestListenerPortPresets(t *testing.T) {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "aproxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mgr := manager.NewDBManager(db, &config.Config{Proxy: config.ProxyConfig{Presets: []config.PresetConfig{
+		{Name: "sticky", Sticky: true},
+		{Name: "us", Filter: config.FilterConfig{Countries: []string{"US"}}},
+	}}})
+	engine, err := rules.NewEngine([]config.RuleConfig{
+		{Domains: []string{"de.example"}, Action: "pool", Filter: config.FilterConfig{Countries: []string{"DE"}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{manager: mgr, rules: engine}
+
+	l, err := s.Listener(config.ListenerConfig{Name: "tools", Ports: []config.PortPresetConfig{
+		{Ports: "10000-10099", Preset: "sticky"},
+		{Ports: "11000", Preset: "us"},
+	}}, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.portPresets) != 101 {
+		t.Errorf("%d ports mapped, want 101", len(l.portPresets))
+	}
+
+	// on builds a request that arrived on port
+	on := func(port int, target string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+		return r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}))
+	}
+	cases := []struct {
+		port      int
+		target    string
+		session   string
+		countries []string
+	}{
+		{10000, "example.com", "tools:10000", nil},
+		{10099, "example.com", "tools:10099", nil},
+		{11000, "example.com", "", []string{"US"}},
+		{10000, "de.example", "", []string{"DE"}}, // a rule's own filter wins
+	}
+	for _, c := range cases {
+		d := l.match(on(c.port, c.target), 80)
+		if d.Session != c.session || !slices.Equal(d.Filter.Countries, c.countries) {
+			t.Errorf("port %d to %s: session %q countries %v, want %q %v", c.port, c.target, d.Session, d.Filter.Countries, c.session, c.countries)
+		}
+	}
+
+	for _, bad := range [][]config.PortPresetConfig{
+		{{Ports: "12000", Preset: "missing"}},
+		{{Ports: "12000-11000", Preset: "us"}},
+		{{Ports: "12000-12010", Preset: "us"}, {Ports: "12010", Preset: "sticky"}},
+	} {
+		if _, err := s.Listener(config.ListenerConfig{Name: "bad", Ports: bad}, engine); err == nil {
+			t.Errorf("ports %+v: expected error", bad)
+		}
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	s := newDirectServer(t, config.ServerConfig{}, &http.Transport{})
+	first, second := listen(t), listen(t)
+	defer first.Close()
+	defer second.Close()
+	go s.Serve(first, second)
+
+	for _, ln := range []net.Listener{first, second} {
+		proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", ln.Addr(), resp.StatusCode)
+		}
+	}
+}
+
+func TestListenerStopKeepsTransports(t *testing.T) {
+	s := newDirectServer(t, config.ServerConfig{}, &http.Transport{})
+	s.transports = newTransportCache(10, time.Minute)
+	l, err := s.Listener(config.ListenerConfig{Name: "extra"}, s.rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.transports.get(route{hops: []*scraper.Proxy{newForwardProxy(t)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.transports.len(); n != 1 {
+		t.Errorf("%d transports after a listener stopped, want the shared one kept", n)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.transports.len(); n != 0 {
+		t.Errorf("%d transports after the server stopped, want none", n)
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+)
+
+// tlsRecordHandshake is the first byte of a TLS ClientHello.
+const tlsRecordHandshake = 0x16
+
+// interceptor decrypts CONNECT tunnels so each request inside is proxied on
+// its own, like plain HTTP.
+type interceptor struct {
+	ca      *certAuthority
+	domains []string
+	bypass  []string
+}
+
+// EnableMITM turns on TLS interception of CONNECT tunnels, loading the CA
+// from cfg or generating one. Call it before Start.
+func (s *Server) EnableMITM(cfg config.MITMConfig) error {
+	cert, key, created, err := loadCA(cfg.CACert, cfg.CAKey)
+	if err != nil {
+		return err
+	}
+	ca, err := newCertAuthority(cert, key, cfg.CertCache)
+	if err != nil {
+		return err
+	}
+	if created {
+		s.logger.InfoBg("Generated interception CA in %s; clients must trust it", cfg.CACert)
+	}
+
+	s.mitm = &interceptor{ca: ca}
+	for _, domain := range cfg.Domains {
+		s.mitm.domains = append(s.mitm.domains, strings.TrimPrefix(strings.ToLower(domain), "."))
+	}
+	for _, domain := range cfg.Bypass {
+		s.mitm.bypass = append(s.mitm.bypass, strings.TrimPrefix(strings.ToLower(domain), "."))
+	}
+	return nil
+}
+
+// intercepts reports whether tunnels to host are decrypted.
+func (m *interceptor) intercepts(host string) bool {
+	if inDomains(host, m.bypass) {
+		return false
+	}
+	return len(m.domains) == 0 || inDomains(host, m.domains)
+}
+
+// inDomains reports whether host is one of domains or a subdomain of one.
+func inDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMITM accepts the CONNECT, terminates the client's TLS with a
+// certificate for the target, and proxies each request inside through
+// handleHTTP. A tunnel that doesn't start with TLS is read as plain HTTP.
+func (s *Server) handleMITM(w http.ResponseWriter, r *http.Request, reqID string) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.httpsLogger.Error(reqID, "Hijacking not supported")
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		s.httpsLogger.Error(reqID, "Hijacking failed: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	// The client may have sent its ClientHello along with the CONNECT
+	conn := &bufferedConn{Conn: clientConn, reader: buffered.Reader}
+	first, err := conn.reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	host := targetHost(r)
+	scheme := "http"
+	var tunnel net.Conn = conn
+	if first[0] == tlsRecordHandshake {
+		scheme = "https"
+		tlsConn := tls.Server(conn, &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName != "" {
+					return s.mitm.ca.certificate(strings.ToLower(hello.ServerName))
+				}
+				return s.mitm.ca.certificate(host)
+			},
+			NextProtos: []string{"http/1.1"},
+		})
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			// Usually a client that doesn't trust the CA
+			s.httpsLogger.Warn(reqID, "TLS handshake with client for %s failed: %v", host, err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		tunnel = tlsConn
+	}
+	s.httpsLogger.Debug(reqID, "Intercepting tunnel to %s", r.URL.Host)
+
+	// Requests inside the tunnel go to the CONNECT target, and carry the
+	// client's identity for rate limits
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		innerID := logger.GenerateID()
+		req.URL.Scheme = scheme
+		req.URL.Host = r.URL.Host
+		req.RemoteAddr = r.RemoteAddr
+		if auth := r.Header.Get("Proxy-Authorization"); auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+
+		if !s.applyRateLimits(w, req, innerID) {
+			return
+		}
+		s.logger.Info(innerID, "Intercepted %s request for %s", req.Method, req.URL.String())
+		s.handleHTTP(w, req, innerID)
+	})
+	s.serveConn(tunnel, handler)
+	s.httpsLogger.Info(reqID, "Intercepted tunnel to %s closed", r.URL.Host)
+}
+
+// serveConn serves HTTP requests on conn, returning once it is closed and,
+// if a handler took it over, that handler has returned.
+func (s *Server) serveConn(conn net.Conn, handler http.Handler) {
+	done := make(chan struct{})
+	var once sync.Once
+	var active sync.WaitGroup
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			active.Add(1)
+			defer active.Done()
+			handler.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: s.config.ReadTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+		MaxHeaderBytes:    1 << 20,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				once.Do(func() { close(done) })
+			}
+		},
+	}
+	srv.Serve(&connListener{conn: conn, closed: done})
+	active.Wait()
+}
+
+// connListener hands out one connection, then blocks until closed is closed.
+type connListener struct {
+	conn   net.Conn
+	closed <-chan struct{}
+	once   sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 397 * 24 * time.Hour // the longest clients accept for TLS servers
+	// leafRenewal is how long before expiry a cached leaf is replaced.
+	leafRenewal = 24 * time.Hour
+)
+
+// certAuthority signs leaf certificates for intercepted hosts, keeping the
+// most recently used ones.
+type certAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// leafKey is shared by every leaf; generating one per host would make
+	// each first handshake slow for no benefit to the client.
+	leafKey *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	max    int
+	leaves map[string]*list.Element
+	lru    *list.List // of *leafCert, front is most recently used
+}
+
+type leafCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+// loadCA reads the CA from certPath and keyPath, creating and saving a new
+// one if neither file exists. It reports whether the CA was created.
+func loadCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, bool, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		cert, key, err := createCA(certPath, keyPath)
+		return cert, key, true, err
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to load CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, nil, false, fmt.Errorf("certificate in %s is not a CA", certPath)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, false, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+	}
+	return cert, key, false, nil
+}
+
+// createCA generates a CA and writes it to certPath and keyPath.
+func createCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "aproxy interception CA", Organization: []string{"aproxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := savePEMs(certPath, der, keyPath, keyDER); err != nil {
+		return nil, nil, fmt.Errorf("failed to save CA: %w", err)
+	}
+	return cert, key, nil
+}
+
+// savePEMs writes a certificate and its PKCS #8 key as PEM files, keeping
+// the key private to the owner.
+func savePEMs(certPath string, certDER []byte, keyPath string, keyDER []byte) error {
+	for _, f := range []struct {
+		path  string
+		block *pem.Block
+		mode  os.FileMode
+	}{
+		{certPath, &pem.Block{Type: "CERTIFICATE", Bytes: certDER}, 0644},
+		{keyPath, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}, 0600},
+	} {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(f.path, pem.EncodeToMemory(f.block), f.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newCertAuthority(cert *x509.Certificate, key crypto.Signer, cacheSize int) (*certAuthority, error) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{
+		cert:    cert,
+		key:     key,
+		leafKey: leafKey,
+		max:     max(1, cacheSize),
+		leaves:  make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// certificate returns a certificate for host, signed by the CA.
+func (ca *certAuthority) certificate(host string) (*tls.Certificate, error) {
+	now := time.Now()
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if elem, ok := ca.leaves[host]; ok {
+		leaf := elem.Value.(*leafCert)
+		if now.Before(leaf.cert.Leaf.NotAfter.Add(-leafRenewal)) {
+			ca.lru.MoveToFront(elem)
+			return leaf.cert, nil
+		}
+		ca.lru.Remove(elem)
+		delete(ca.leaves, host)
+	}
+
+	cert, err := ca.sign(host, now)
+	if err != nil {
+		return nil, err
+	}
+	ca.leaves[host] = ca.lru.PushFront(&leafCert{host: host, cert: cert})
+	for ca.lru.Len() > ca.max {
+		oldest := ca.lru.Remove(ca.lru.Back()).(*leafCert)
+		delete(ca.leaves, oldest.host)
+	}
+	return cert, nil
+}
+
+// sign issues a leaf certificate for host, which may be an IP address.
+func (ca *certAuthority) sign(host string, now time.Time) (*tls.Certificate, error) {
+	notAfter := now.Add(leafValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
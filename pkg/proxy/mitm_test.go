@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+	"aproxy/pkg/rules"
+)
+
+func TestCertAuthority(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+
+	cert, key, created, err := loadCA(certPath, keyPath)
+	if err != nil || !created {
+		t.Fatalf("loadCA = created %v, %v; want a new CA", created, err)
+	}
+	reloaded, _, created, err := loadCA(certPath, keyPath)
+	if err != nil || created || !reloaded.Equal(cert) {
+		t.Fatalf("second loadCA did not reuse the saved CA: created %v, %v", created, err)
+	}
+
+	ca, err := newCertAuthority(cert, key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	for _, host := range []string{"a.example", "127.0.0.1"} {
+		leaf, err := ca.certificate(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("leaf for %s does not verify: %v", host, err)
+		}
+	}
+
+	first, _ := ca.certificate("a.example")
+	if again, _ := ca.certificate("a.example"); again != first {
+		t.Error("cached leaf not reused")
+	}
+	ca.certificate("b.example")
+	ca.certificate("c.example")
+	if again, _ := ca.certificate("a.example"); again == first {
+		t.Error("least recently used leaf was not dropped")
+	}
+}
+
+func TestMITMIntercept(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Policy")+" "+r.Header.Get("X-Drop"))
+	}))
+	defer target.Close()
+
+	s := newDirectServer(t, config.ServerConfig{
+		EnableHTTPS:  true,
+		StripHeaders: []string{"X-Drop"},
+		AddHeaders:   map[string]string{"X-Policy": "added"},
+	}, target.Client().Transport.(*http.Transport))
+	dir := t.TempDir()
+	if err := s.EnableMITM(config.MITMConfig{
+		CACert:    filepath.Join(dir, "ca.pem"),
+		CAKey:     filepath.Join(dir, "ca-key.pem"),
+		CertCache: 10,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(s)
+	defer front.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.mitm.ca.cert)
+	proxyURL, _ := url.Parse(front.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	// Two requests over one intercepted tunnel, both with the header policy
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+		req.Header.Set("X-Drop", "secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "added " {
+			t.Errorf("target saw headers %q, want policy applied inside TLS", body)
+		}
+	}
+
+	s.mitm.bypass = []string{"127.0.0.1"}
+	client.CloseIdleConnections()
+	if _, err := client.Get(target.URL); err == nil {
+		t.Error("bypassed host was intercepted instead of tunneled")
+	}
+}
+
+func TestMITMVerifiesTarget(t *testing.T) {
+	var hits atomic.Int32
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	upstream := serveFakeUpstream(t, listen(t), connectHandshake)
+	upstream.Type = "http"
+	viaUpstream, err := rules.NewEngine([]config.RuleConfig{{Action: "upstream", Upstream: "static"}},
+		[]config.UpstreamConfig{{Name: "static", Proxies: []string{"http://" + upstream.Address()}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		rules *rules.Engine
+	}{
+		{"direct", nil},
+		{"through a proxy", viaUpstream},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// The target's certificate is self-signed, so neither the system
+			// roots nor the server trust it
+			s := newDirectServer(t, config.ServerConfig{EnableHTTPS: true}, &http.Transport{})
+			if c.rules != nil {
+				s.rules = c.rules
+			}
+			s.transports = newTransportCache(10, time.Minute)
+			defer s.transports.closeAll()
+			dir := t.TempDir()
+			if err := s.EnableMITM(config.MITMConfig{
+				CACert:    filepath.Join(dir, "ca.pem"),
+				CAKey:     filepath.Join(dir, "ca-key.pem"),
+				CertCache: 10,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(s.mitm.ca.cert)
+			proxyURL := &url.URL{Scheme: "http", Host: serve(t, s)}
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}}
+			resp, err := client.Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status %d, want 502 for an untrusted target certificate", resp.StatusCode)
+			}
+			if n := hits.Load(); n != 0 {
+				t.Errorf("target got %d requests past a failed certificate check", n)
+			}
+		})
+	}
+}
+
+// newDirectServer returns a server that sends requests for 127.0.0.0/8
+// straight to the target through transport.
+func newDirectServer(t *testing.T, cfg config.ServerConfig, transport *http.Transport) *Server {
+	t.Helper()
+	engine, err := rules.NewEngine([]config.RuleConfig{{CIDRs: []string{"127.0.0.0/8"}, Action: "direct"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxRetries = 1
+	cfg.RateLimit.Policy = "reject"
+	return &Server{
+		config:          cfg,
+		stats:           &Stats{},
+		logger:          logger.New("server"),
+		httpLogger:      logger.New("http"),
+		httpsLogger:     logger.New("https"),
+		rules:           engine,
+		directTransport: transport,
+		admission:       newAdmission(10, cfg.Admission),
+		rateLimits:      newRateLimits(cfg.RateLimit),
+		blocks:          newBlockDetector(cfg.BlockDetection),
+		tunnels:         newTunnels(cfg.Tunnel),
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/scraper"
+)
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// pacDirective renders p as a PAC proxy directive ("PROXY h:p", "SOCKS5 h:p").
+func pacDirective(p scraper.Proxy) string {
+	switch {
+	case p.Type == "socks5":
+		return "SOCKS5 " + p.Address()
+	case p.Type == "socks4":
+		return "SOCKS " + p.Address()
+	case p.TLS:
+		return "HTTPS " + p.Address()
+	default:
+		return "PROXY " + p.Address()
+	}
+}
+
+// poolPAC returns a PAC file that sends everything through the given proxies
+// in order, falling back to DIRECT.
+func poolPAC(proxies []scraper.Proxy) string {
+	directives := make([]string, 0, len(proxies)+1)
+	for _, p := range proxies {
+		directives = append(directives, pacDirective(p))
+	}
+	directives = append(directives, "DIRECT")
+
+	return fmt.Sprintf("function FindProxyForURL(url, host) {\n  return %q;\n}\n", strings.Join(directives, "; "))
+}
+
+// buildPAC renders the configured PAC file. self is the directive clients use
+// to reach aproxy; failover proxies are tried after it, in order, if it's down.
+func buildPAC(cfg config.PACConfig, self string, failover []scraper.Proxy) string {
+	directives := []string{self}
+	for _, p := range failover {
+		directives = append(directives, pacDirective(p))
+	}
+	if cfg.FallbackDirect {
+		directives = append(directives, "DIRECT")
+	}
+	chain := strings.Join(directives, "; ")
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	if cfg.DirectPlain {
+		b.WriteString("  if (isPlainHostName(host)) return \"DIRECT\";\n")
+	}
+	if cond := pacCondition(cfg.DirectDomains); cond != "" {
+		fmt.Fprintf(&b, "  if (%s) return \"DIRECT\";\n", cond)
+	}
+	if cond := pacCondition(cfg.ProxyDomains); cond != "" {
+		fmt.Fprintf(&b, "  if (%s) return %q;\n", cond, chain)
+		b.WriteString("  return \"DIRECT\";\n")
+	} else {
+		fmt.Fprintf(&b, "  return %q;\n", chain)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// pacCondition ORs together the PAC tests for patterns. Name tests come before
+// CIDR tests, which need a DNS lookup in the browser.
+func pacCondition(patterns []string) string {
+	var names, nets []string
+	for _, pattern := range patterns {
+		if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+			// PAC's isInNet only handles IPv4
+			if ipnet.IP.To4() != nil {
+				nets = append(nets, fmt.Sprintf("isInNet(dnsResolve(host), %q, %q)",
+					ipnet.IP.String(), net.IP(ipnet.Mask).String()))
+			}
+			continue
+		}
+		if strings.ContainsAny(pattern, "*?") {
+			names = append(names, fmt.Sprintf("shExpMatch(host, %q)", pattern))
+			continue
+		}
+		domain := strings.TrimPrefix(pattern, ".")
+		names = append(names, fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", domain, "."+domain))
+	}
+	return strings.Join(append(names, nets...), " ||\n      ")
+}
+
+// handlePAC serves the generated PAC file (also as /wpad.dat).
+func (s *Server) handlePAC(w http.ResponseWriter, r *http.Request) {
+	self := s.config.PAC.ProxyAddr
+	if self == "" {
+		self = s.selfAddr(r)
+	}
+	if s.tlsConfig != nil {
+		self = "HTTPS " + self
+	} else {
+		self = "PROXY " + self
+	}
+
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "max-age=300")
+	io.WriteString(w, buildPAC(s.config.PAC, self, s.fastestProxies(s.config.PAC.FailoverCount)))
+}
+
+// selfAddr guesses the proxy address from the host the client used to fetch
+// the PAC file and the proxy listener's port.
+func (s *Server) selfAddr(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	_, port, err := net.SplitHostPort(s.config.ListenAddr)
+	if err != nil {
+		return r.Host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// fastestProxies returns up to n pool proxies with a known latency, fastest first.
+func (s *Server) fastestProxies(n int) []scraper.Proxy {
+	if n <= 0 {
+		return nil
+	}
+
+	var measured []scraper.Proxy
+	for _, p := range s.manager.GetHealthyProxies() {
+		if p.Latency > 0 {
+			measured = append(measured, p)
+		}
+	}
+	slices.SortFunc(measured, func(a, b scraper.Proxy) int {
+		return cmp.Compare(a.Latency, b.Latency)
+	})
+	return measured[:min(n, len(measured))]
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/scraper"
+)
+
+func TestBuildPAC(t *testing.T) {
+	failover := []scraper.Proxy{
+		{Host: "1.1.1.1", Port: 1080, Type: "socks5"},
+		{Host: "2.2.2.2", Port: 8080, Type: "http"},
+		{Host: "3.3.3.3", Port: 443, Type: "https", TLS: true},
+		{Host: "4.4.4.4", Port: 1080, Type: "socks4"},
+	}
+
+	cases := []struct {
+		name     string
+		cfg      config.PACConfig
+		failover []scraper.Proxy
+		want     string
+	}{
+		{
+			name: "everything through aproxy",
+			want: "function FindProxyForURL(url, host) {\n" +
+				"  return \"PROXY aproxy.lan:8080\";\n" +
+				"}\n",
+		},
+		{
+			name: "direct domains and CIDRs",
+			cfg: config.PACConfig{
+				DirectPlain:   true,
+				DirectDomains: []string{"10.0.0.0/8", ".corp.internal", "*.lan", "2001:db8::/32"},
+			},
+			want: "function FindProxyForURL(url, host) {\n" +
+				"  if (isPlainHostName(host)) return \"DIRECT\";\n" +
+				"  if (host == \"corp.internal\" || dnsDomainIs(host, \".corp.internal\") ||\n" +
+				"      shExpMatch(host, \"*.lan\") ||\n" +
+				"      isInNet(dnsResolve(host), \"10.0.0.0\", \"255.0.0.0\")) return \"DIRECT\";\n" +
+				"  return \"PROXY aproxy.lan:8080\";\n" +
+				"}\n",
+		},
+		{
+			name: "only proxy domains go through aproxy",
+			cfg: config.PACConfig{
+				DirectDomains: []string{"localhost"},
+				ProxyDomains:  []string{"example.com", "*.target.*"},
+			},
+			want: "function FindProxyForURL(url, host) {\n" +
+				"  if (host == \"localhost\" || dnsDomainIs(host, \".localhost\")) return \"DIRECT\";\n" +
+				"  if (host == \"example.com\" || dnsDomainIs(host, \".example.com\") ||\n" +
+				"      shExpMatch(host, \"*.target.*\")) return \"PROXY aproxy.lan:8080\";\n" +
+				"  return \"DIRECT\";\n" +
+				"}\n",
+		},
+		{
+			name:     "failover in order, then direct",
+			cfg:      config.PACConfig{FallbackDirect: true},
+			failover: failover,
+			want: "function FindProxyForURL(url, host) {\n" +
+				"  return \"PROXY aproxy.lan:8080; SOCKS5 1.1.1.1:1080; PROXY 2.2.2.2:8080; HTTPS 3.3.3.3:443; SOCKS 4.4.4.4:1080; DIRECT\";\n" +
+				"}\n",
+		},
+		{
+			name:     "failover without direct",
+			failover: failover[:1],
+			want: "function FindProxyForURL(url, host) {\n" +
+				"  return \"PROXY aproxy.lan:8080; SOCKS5 1.1.1.1:1080\";\n" +
+				"}\n",
+		},
+	}
+	for _, c := range cases {
+		if got := buildPAC(c.cfg, "PROXY aproxy.lan:8080", c.failover); got != c.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPoolPAC(t *testing.T) {
+	got := poolPAC([]scraper.Proxy{{Host: "1.1.1.1", Port: 1080, Type: "socks5"}, {Host: "2.2.2.2", Port: 80, Type: "http"}})
+	want := "function FindProxyForURL(url, host) {\n  return \"SOCKS5 1.1.1.1:1080; PROXY 2.2.2.2:80; DIRECT\";\n}\n"
+	if got != want {
+		t.Errorf("poolPAC:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandlePAC(t *testing.T) {
+	s := newDirectServer(t, config.ServerConfig{
+		ListenAddr: ":8080",
+		PAC:        config.PACConfig{Enabled: true},
+	}, &http.Transport{})
+
+	cases := []struct {
+		proxyAddr string
+		host      string
+		want      string
+	}{
+		{"", "aproxy.lan:8080", "PROXY aproxy.lan:8080"},
+		{"", "aproxy.lan", "PROXY aproxy.lan:8080"},
+		{"", "[2001:db8::1]:9000", "PROXY [2001:db8::1]:8080"},
+		{"proxy.example:3128", "aproxy.lan:8080", "PROXY proxy.example:3128"},
+	}
+	for _, c := range cases {
+		s.config.PAC.ProxyAddr = c.proxyAddr
+		r := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+		r.Host = c.host
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		want := "function FindProxyForURL(url, host) {\n  return \"" + c.want + "\";\n}\n"
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("host %s, proxy_addr %q: %d\n%s\nwant:\n%s", c.host, c.proxyAddr, w.Code, w.Body, want)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != pacContentType {
+			t.Errorf("Content-Type = %q", ct)
+		}
+	}
+}
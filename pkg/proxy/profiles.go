@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+// sessionHeader lets a client name its session for "session" rotation. It is
+// never forwarded.
+const sessionHeader = "X-Aproxy-Session"
+
+// builtinProfiles are used when the config lists none.
+var builtinProfiles = []config.HeaderProfileConfig{
+	{Name: "chrome-windows", Headers: map[string]string{
+		"User-Agent":                "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36",
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
+		"Accept-Language":           "en-US,en;q=0.9",
+		"Sec-Ch-Ua":                 `"Google Chrome";v="129", "Not=A?Brand";v="8", "Chromium";v="129"`,
+		"Sec-Ch-Ua-Mobile":          "?0",
+		"Sec-Ch-Ua-Platform":        `"Windows"`,
+		"Upgrade-Insecure-Requests": "1",
+	}},
+	{Name: "chrome-macos", Headers: map[string]string{
+		"User-Agent":                "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36",
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
+		"Accept-Language":           "en-US,en;q=0.9",
+		"Sec-Ch-Ua":                 `"Google Chrome";v="129", "Not=A?Brand";v="8", "Chromium";v="129"`,
+		"Sec-Ch-Ua-Mobile":          "?0",
+		"Sec-Ch-Ua-Platform":        `"macOS"`,
+		"Upgrade-Insecure-Requests": "1",
+	}},
+	{Name: "edge-windows", Headers: map[string]string{
+		"User-Agent":                "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36 Edg/129.0.0.0",
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
+		"Accept-Language":           "en-US,en;q=0.9",
+		"Sec-Ch-Ua":                 `"Microsoft Edge";v="129", "Not=A?Brand";v="8", "Chromium";v="129"`,
+		"Sec-Ch-Ua-Mobile":          "?0",
+		"Sec-Ch-Ua-Platform":        `"Windows"`,
+		"Upgrade-Insecure-Requests": "1",
+	}},
+	{Name: "firefox-windows", Headers: map[string]string{
+		"User-Agent":                "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0",
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Language":           "en-US,en;q=0.5",
+		"Upgrade-Insecure-Requests": "1",
+	}},
+	{Name: "firefox-linux", Headers: map[string]string{
+		"User-Agent":                "Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0",
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Language":           "en-US,en;q=0.5",
+		"Upgrade-Insecure-Requests": "1",
+	}},
+	{Name: "safari-macos", Headers: map[string]string{
+		"User-Agent":      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Safari/605.1.15",
+		"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Language": "en-US,en;q=0.9",
+	}},
+}
+
+// headerProfile is a config.HeaderProfileConfig with canonical header names.
+type headerProfile struct {
+	name    string
+	headers http.Header
+}
+
+// headerProfiles assigns browser profiles to requests.
+type headerProfiles struct {
+	profiles []headerProfile
+	sticky   bool
+	ttl      time.Duration
+	keepUA   bool
+
+	mu        sync.Mutex
+	sessions  map[string]*profileSession
+	lastSweep time.Time
+}
+
+type profileSession struct {
+	profile  int
+	lastUsed time.Time
+}
+
+// newHeaderProfiles returns nil, which leaves requests alone, unless cfg is
+// enabled.
+func newHeaderProfiles(cfg config.HeaderProfilesConfig) *headerProfiles {
+	if !cfg.Enabled {
+		return nil
+	}
+	configured := cfg.Profiles
+	if len(configured) == 0 {
+		configured = builtinProfiles
+	}
+
+	p := &headerProfiles{
+		sticky:   cfg.Rotation == "session",
+		ttl:      cfg.SessionTTL,
+		keepUA:   cfg.KeepUserAgent,
+		sessions: make(map[string]*profileSession),
+	}
+	for _, pc := range configured {
+		profile := headerProfile{name: pc.Name, headers: make(http.Header, len(pc.Headers))}
+		for name, value := range pc.Headers {
+			profile.headers.Set(name, value)
+		}
+		p.profiles = append(p.profiles, profile)
+	}
+	return p
+}
+
+// pick returns the profile for a request from session.
+func (p *headerProfiles) pick(session string, now time.Time) *headerProfile {
+	if !p.sticky {
+		return &p.profiles[rand.IntN(len(p.profiles))]
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sweep(now)
+	s, ok := p.sessions[session]
+	if !ok || now.Sub(s.lastUsed) > p.ttl {
+		s = &profileSession{profile: rand.IntN(len(p.profiles))}
+		p.sessions[session] = s
+	}
+	s.lastUsed = now
+	return &p.profiles[s.profile]
+}
+
+// sweep forgets idle sessions, at most once a minute. Callers hold p.mu.
+func (p *headerProfiles) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < time.Minute {
+		return
+	}
+	p.lastSweep = now
+	for key, s := range p.sessions {
+		if now.Sub(s.lastUsed) > p.ttl {
+			delete(p.sessions, key)
+		}
+	}
+}
+
+// apply replaces the browser-identifying headers of req with a profile's.
+// clientUA is the User-Agent the client sent, kept along with its client
+// hints when keepUA is set, and user the proxy user it authenticated as. A
+// specific Accept from the client is kept, since the response format depends
+// on it.
+func (p *headerProfiles) apply(req *http.Request, clientUA, user string) {
+	if p == nil {
+		return
+	}
+	session := req.Header.Get(sessionHeader)
+	req.Header.Del(sessionHeader)
+	if session == "" {
+		if session = user; session == "" {
+			session = clientIP(req)
+		}
+	}
+	profile := p.pick(session, time.Now())
+
+	keepUA := p.keepUA && clientUA != ""
+	if !keepUA {
+		for name := range req.Header {
+			if strings.HasPrefix(name, "Sec-Ch-Ua") {
+				req.Header.Del(name)
+			}
+		}
+	}
+	accept := req.Header.Get("Accept")
+	for name, values := range profile.headers {
+		switch {
+		case keepUA && (name == "User-Agent" || strings.HasPrefix(name, "Sec-Ch-Ua")):
+			continue
+		case name == "Accept" && accept != "" && accept != "*/*":
+			continue
+		}
+		req.Header.Set(name, values[0])
+	}
+	if keepUA {
+		req.Header.Set("User-Agent", clientUA)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+func TestHeaderProfiles(t *testing.T) {
+	firefox := config.HeaderProfileConfig{Name: "firefox", Headers: map[string]string{
+		"user-agent": "Firefox/131.0", "accept": "text/html", "accept-language": "en-US,en;q=0.5",
+	}}
+
+	cases := []struct {
+		name    string
+		keepUA  bool
+		header  http.Header
+		want    http.Header
+		removed []string
+	}{
+		{
+			name:    "replaces browser headers",
+			header:  http.Header{"User-Agent": {"curl/8.0"}, "Accept": {"*/*"}, "Sec-Ch-Ua-Platform": {`"Linux"`}, sessionHeader: {"s1"}},
+			want:    http.Header{"User-Agent": {"Firefox/131.0"}, "Accept": {"text/html"}, "Accept-Language": {"en-US,en;q=0.5"}},
+			removed: []string{"Sec-Ch-Ua-Platform", sessionHeader},
+		},
+		{
+			name:   "keeps a specific Accept",
+			header: http.Header{"Accept": {"application/json"}},
+			want:   http.Header{"User-Agent": {"Firefox/131.0"}, "Accept": {"application/json"}},
+		},
+		{
+			name:   "keeps the client's UA and hints",
+			keepUA: true,
+			header: http.Header{"User-Agent": {"MyBrowser/1.0"}, "Sec-Ch-Ua": {`"MyBrowser";v="1"`}},
+			want:   http.Header{"User-Agent": {"MyBrowser/1.0"}, "Sec-Ch-Ua": {`"MyBrowser";v="1"`}, "Accept-Language": {"en-US,en;q=0.5"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newHeaderProfiles(config.HeaderProfilesConfig{
+				Enabled: true, Rotation: "request", KeepUserAgent: c.keepUA,
+				Profiles: []config.HeaderProfileConfig{firefox},
+			})
+			req := httptest.NewRequest(http.MethodGet, "http://a.example/", nil)
+			req.Header = c.header
+			p.apply(req, c.header.Get("User-Agent"), "")
+
+			for name := range c.want {
+				if got := req.Header.Get(name); got != c.want.Get(name) {
+					t.Errorf("%s = %q, want %q", name, got, c.want.Get(name))
+				}
+			}
+			for _, name := range c.removed {
+				if got := req.Header.Get(name); got != "" {
+					t.Errorf("%s = %q, want it removed", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderProfileSessions(t *testing.T) {
+	p := newHeaderProfiles(config.HeaderProfilesConfig{Enabled: true, Rotation: "session", SessionTTL: time.Minute})
+	now := time.Now()
+
+	first := p.pick("client-a", now)
+	for i := range 20 {
+		if got := p.pick("client-a", now.Add(time.Duration(i)*time.Second)); got != first {
+			t.Fatalf("session switched profile from %s to %s", first.name, got.name)
+		}
+	}
+
+	// Idle past the TTL, the session starts over with a random profile
+	changed := false
+	for i := range 50 {
+		at := now.Add(time.Duration(i+1) * 2 * time.Minute)
+		if p.pick("client-a", at) != first {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		t.Error("expired session never got a new profile")
+	}
+}
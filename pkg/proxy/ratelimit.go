@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/manager"
+	"aproxy/pkg/rules"
+)
+
+// rateLimitedError is returned when every candidate route is over its limit.
+type rateLimitedError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.retryAfter)
+}
+
+// maxRatePicks bounds how many proxies pickRoute tries when some are over
+// their per-domain limit.
+const maxRatePicks = 5
+
+// rateLimiter is a set of token buckets keyed by string.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil, which allows everything, when cfg.Rate is 0.
+func newRateLimiter(cfg config.RateConfig) *rateLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    cfg.Rate,
+		burst:   math.Max(1, float64(cfg.Burst)),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take charges one request to key. If no token is available it reserves the
+// next one when that is at most maxWait away, returning how long to wait;
+// otherwise nothing is charged and ok is false, with the time until a token
+// would be available.
+func (l *rateLimiter) take(key string, now time.Time, maxWait time.Duration) (wait time.Duration, ok bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	wait = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens-- // reserved; the bucket goes negative until refilled
+	return wait, true
+}
+
+// refund returns a token charged by take.
+func (l *rateLimiter) refund(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+	l.mu.Unlock()
+}
+
+// sweep drops buckets that have refilled completely, at most once a minute.
+// Callers hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type domainLimit struct {
+	domain  string
+	limiter *rateLimiter
+}
+
+// rateLimits holds the configured limiters.
+type rateLimits struct {
+	maxWait     time.Duration // 0 under the reject policy
+	client      *rateLimiter
+	user        *rateLimiter
+	domain      *rateLimiter
+	domainProxy *rateLimiter
+	domains     []domainLimit
+}
+
+func newRateLimits(cfg config.RateLimitConfig) *rateLimits {
+	rl := &rateLimits{
+		client:      newRateLimiter(cfg.PerClient),
+		user:        newRateLimiter(cfg.PerUser),
+		domain:      newRateLimiter(cfg.PerDomain),
+		domainProxy: newRateLimiter(cfg.PerDomainProxy),
+	}
+	if cfg.Policy == "delay" {
+		rl.maxWait = cfg.MaxDelay
+	}
+	for _, d := range cfg.Domains {
+		rl.domains = append(rl.domains, domainLimit{
+			domain:  strings.TrimPrefix(strings.ToLower(d.Domain), "."),
+			limiter: newRateLimiter(d.RateConfig),
+		})
+	}
+	return rl
+}
+
+// domainLimiter returns the limiter and bucket key for a target host.
+func (rl *rateLimits) domainLimiter(host string) (*rateLimiter, string) {
+	for _, d := range rl.domains {
+		if host == d.domain || strings.HasSuffix(host, "."+d.domain) {
+			return d.limiter, d.domain
+		}
+	}
+	return rl.domain, host
+}
+
+// admit charges a request against the client, user and domain limits. It
+// returns how long to hold the request, or ok=false with a Retry-After if any
+// limit refuses it, in which case nothing is charged.
+func (rl *rateLimits) admit(client, user, host string, now time.Time) (time.Duration, bool) {
+	domainLimiter, domainKey := rl.domainLimiter(host)
+	checks := []struct {
+		limiter *rateLimiter
+		key     string
+	}{
+		{rl.client, client},
+		{rl.user, user},
+		{domainLimiter, domainKey},
+	}
+
+	var wait time.Duration
+	for i, c := range checks {
+		if c.key == "" {
+			continue
+		}
+		w, ok := c.limiter.take(c.key, now, rl.maxWait)
+		if !ok {
+			for _, charged := range checks[:i] {
+				if charged.key != "" {
+					charged.limiter.refund(charged.key)
+				}
+			}
+			return w, false
+		}
+		wait = max(wait, w)
+	}
+	return wait, true
+}
+
+// allowProxy charges a request to host through proxyAddr. Proxies over their
+// limit are skipped rather than waited for.
+func (rl *rateLimits) allowProxy(host, proxyAddr string, now time.Time) (time.Duration, bool) {
+	return rl.domainProxy.take(host+"|"+proxyAddr, now, 0)
+}
+
+// applyRateLimits charges r against the client, user and domain limits,
+// holding it under the delay policy. It answers refused requests itself.
+func (s *Server) applyRateLimits(w http.ResponseWriter, r *http.Request, reqID string) bool {
+	wait, ok := s.rateLimits.admit(clientIP(r), s.userID(r), targetHost(r), time.Now())
+	if !ok {
+		s.logger.Warn(reqID, "Rate limited %s %s from %s", r.Method, r.URL.Host, r.RemoteAddr)
+		s.writeRateLimited(w, wait)
+		return false
+	}
+	if wait > 0 {
+		s.logger.Debug(reqID, "Delaying request to %s by %s for rate limit", r.URL.Host, wait)
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	return true
+}
+
+// rejectRateLimited answers 429 if err is a rate limit or a politeness
+// cooldown, reporting whether it did.
+func (s *Server) rejectRateLimited(w http.ResponseWriter, err error) bool {
+	var limited *rateLimitedError
+	if errors.As(err, &limited) {
+		s.writeRateLimited(w, limited.retryAfter)
+		return true
+	}
+	var cooling *manager.CooldownError
+	if errors.As(err, &cooling) {
+		s.writeRateLimited(w, cooling.RetryAfter)
+		return true
+	}
+	return false
+}
+
+func (s *Server) writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	s.incrementFailedRequests()
+	seconds := max(1, int(math.Ceil(retryAfter.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+}
+
+// targetHost returns the request's lowercased target host without port.
+func targetHost(r *http.Request) string {
+	host, _ := rules.SplitHostPort(r.URL.Host, 0)
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// userID identifies who a request counts against for per-user limits: the
+// Basic auth username or a digest of the bearer token once they match the
+// auth token, or the subject of a verified client certificate. Anyone else,
+// including every client when no auth token is set, falls back to its IP.
+func (s *Server) userID(r *http.Request) string {
+	if s.config.AuthToken != "" {
+		if user, ok := s.authenticate(r); ok {
+			return user
+		}
+	}
+	if hasClientCert(r) {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return "ip:" + clientIP(r)
+}
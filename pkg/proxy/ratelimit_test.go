@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(config.RateConfig{Rate: 1, Burst: 2})
+	now := time.Now()
+
+	steps := []struct {
+		after   time.Duration // since the previous step
+		maxWait time.Duration
+		ok      bool
+		wait    time.Duration
+	}{
+		{0, 0, true, 0},
+		{0, 0, true, 0},
+		{0, 0, false, time.Second},              // burst used up, nothing charged
+		{0, 2 * time.Second, true, time.Second}, // delay policy reserves the next token
+		{0, 0, false, 2 * time.Second},          // behind the reservation
+		{2 * time.Second, 0, true, 0},           // refilled
+		{10 * time.Second, 0, true, 0},          // capped at burst
+		{0, 0, true, 0},
+		{0, 0, false, time.Second},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.after)
+		wait, ok := l.take("k", now, step.maxWait)
+		if ok != step.ok || wait != step.wait {
+			t.Errorf("step %d: take = (%s, %v), want (%s, %v)", i, wait, ok, step.wait, step.ok)
+		}
+	}
+
+	if wait, ok := newRateLimiter(config.RateConfig{}).take("k", now, 0); !ok || wait != 0 {
+		t.Error("zero rate should not limit")
+	}
+}
+
+func TestRateLimitsAdmitRefunds(t *testing.T) {
+	rl := newRateLimits(config.RateLimitConfig{
+		Policy:    "reject",
+		PerClient: config.RateConfig{Rate: 1, Burst: 1},
+		Domains:   []config.DomainRateConfig{{Domain: "example.com", RateConfig: config.RateConfig{Rate: 1, Burst: 1}}},
+	})
+	now := time.Now()
+
+	if _, ok := rl.admit("10.0.0.1", "", "a.example.com", now); !ok {
+		t.Fatal("first request refused")
+	}
+	// Subdomains share the example.com bucket; the client's token is refunded
+	if _, ok := rl.admit("10.0.0.2", "", "b.example.com", now); ok {
+		t.Fatal("second request to example.com admitted")
+	}
+	if _, ok := rl.admit("10.0.0.2", "", "other.org", now); !ok {
+		t.Error("refused client 10.0.0.2 after its token was refunded")
+	}
+}
+
+func TestUserID(t *testing.T) {
+	cases := []struct {
+		token  string
+		header string
+		want   string
+	}{
+		{"secret", "", "ip:192.0.2.1"},
+		{"secret", "Basic YWxpY2U6c2VjcmV0", "user:alice"},
+		{"secret", "Basic YWxpY2U6d3Jvbmc=", "ip:192.0.2.1"}, // wrong password
+		{"secret", "Bearer secret", "token:2bb80d537b1da3e3"},
+		{"secret", "Bearer abc", "ip:192.0.2.1"},
+		{"secret", "Digest x", "ip:192.0.2.1"},
+		// Without an auth token nothing is verified, so names aren't trusted
+		{"", "Basic YWxpY2U6c2VjcmV0", "ip:192.0.2.1"},
+		{"", "Bearer secret", "ip:192.0.2.1"},
+	}
+	for _, c := range cases {
+		s := &Server{config: config.ServerConfig{AuthToken: c.token}}
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		if c.header != "" {
+			r.Header.Set("Proxy-Authorization", c.header)
+		}
+		if got := s.userID(r); got != c.want {
+			t.Errorf("token %q: userID(%q) = %q, want %q", c.token, c.header, got, c.want)
+		}
+	}
+}
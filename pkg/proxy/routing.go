@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"aproxy/pkg/manager"
+	"aproxy/pkg/rules"
+	"aproxy/pkg/scraper"
+)
+
+// match routes r by the server's rules. Pool selection for a rule without a
+// filter uses the preset of the port r arrived on, or the server's default
+// filter.
+func (s *Server) match(r *http.Request, defaultPort int) rules.Decision {
+	d := s.rules.MatchHostPort(r.URL.Host, defaultPort)
+	if d.Action != rules.ActionPool || !d.Filter.IsZero() {
+		return d
+	}
+	if sel, ok := s.portPresets[localPort(r)]; ok {
+		d.Filter, d.Session = sel.Filter, sel.Session
+	} else {
+		d.Filter = s.filter
+	}
+	return d
+}
+
+// localPort returns the port of the listener r arrived on, or 0.
+func localPort(r *http.Request) int {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// applyDecision logs the routing decision and answers rejected requests. It
+// reports whether the request should continue.
+func (s *Server) applyDecision(w http.ResponseWriter, r *http.Request, d rules.Decision, reqID string) bool {
+	if d.Rule != "" {
+		s.logger.Debug(reqID, "Rule %q matched %s: %s", d.Rule, r.URL.Host, d.Action)
+	}
+	if d.Action == rules.ActionReject {
+		s.logger.Warn(reqID, "Rejected request to %s by rule %q", r.URL.Host, d.Rule)
+		s.incrementFailedRequests()
+		http.Error(w, "Destination blocked by proxy policy", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// pickRoute selects the route for one attempt at host, skipping exit proxies
+// that are over their per-domain rate limit. Only the route it returns counts
+// against the exit proxy's politeness cooldown.
+func (s *Server) pickRoute(d rules.Decision, host string) (route, error) {
+	var retryAfter time.Duration
+	for range maxRatePicks {
+		rt, err := s.selectRoute(d, host)
+		if err != nil {
+			return route{}, err
+		}
+		wait, ok := s.rateLimits.allowProxy(host, rt.exit().Address(), time.Now())
+		if ok {
+			if rt.pooled {
+				s.manager.RecordHit(*rt.exit(), host)
+			}
+			return rt, nil
+		}
+		if retryAfter == 0 || wait < retryAfter {
+			retryAfter = wait
+		}
+	}
+	return route{}, &rateLimitedError{retryAfter: retryAfter}
+}
+
+// selectRoute selects the proxies for one attempt: a single pool proxy, or one
+// proxy from each upstream group of the decision's chain. Only the exit proxy
+// is subject to politeness for host, since it is the one the target sees.
+func (s *Server) selectRoute(d rules.Decision, host string) (route, error) {
+	if d.Action != rules.ActionUpstream && d.Action != rules.ActionChain {
+		proxy, err := s.manager.SelectProxy(manager.Selection{Filter: d.Filter, Target: host, Session: d.Session})
+		if err != nil {
+			return route{}, err
+		}
+		return route{hops: []*scraper.Proxy{proxy}, pooled: true}, nil
+	}
+
+	var rt route
+	for i, group := range d.Chain {
+		target := ""
+		if i == len(d.Chain)-1 {
+			target = host
+		}
+		proxy, err := s.pickFromGroup(group, target)
+		if err != nil {
+			return route{}, err
+		}
+		rt.hops = append(rt.hops, proxy)
+		rt.pooled = group.Pool
+	}
+	return rt, nil
+}
+
+// pickFromGroup selects the next proxy of an upstream group. Static groups
+// are not tracked for politeness.
+func (s *Server) pickFromGroup(group *rules.Upstream, target string) (*scraper.Proxy, error) {
+	if group.Pool {
+		return s.manager.SelectProxy(manager.Selection{Filter: group.Filter, Target: target})
+	}
+	return group.Next()
+}
+
+// reportFailure drops a failing exit proxy from the cache if it came from the
+// pool, recording the failure against host. Static upstreams, and the earlier
+// hops of a chain, are left alone since the failing hop is unknown.
+func (s *Server) reportFailure(rt route, host string) {
+	if rt.pooled {
+		s.manager.ReportResult(*rt.exit(), host, manager.OutcomeFailure)
+		s.manager.ReportProxyFailure(*rt.exit())
+	}
+}
+
+// reportOutcome records how a request to host went through a pool exit proxy.
+func (s *Server) reportOutcome(rt route, host string, outcome manager.Outcome) {
+	if rt.pooled {
+		s.manager.ReportResult(*rt.exit(), host, outcome)
+	}
+}
+
+// checkBlocked classifies a response to r through rt, recording the outcome
+// against the exit proxy. It returns errBlocked for block pages, or an error
+// if the body could not be read; resp is left intact either way.
+func (s *Server) checkBlocked(resp *http.Response, r *http.Request, rt route, reqID string) error {
+	host := targetHost(r)
+	rule, err := s.blocks.classify(resp, host)
+	if err != nil {
+		return err
+	}
+	if rule == "" {
+		s.reportOutcome(rt, host, manager.OutcomeSuccess)
+		return nil
+	}
+	s.logger.Warn(reqID, "Block rule %q matched %d response from %s via %s", rule, resp.StatusCode, host, rt)
+	s.reportOutcome(rt, host, manager.OutcomeBlocked)
+	return errBlocked
+}
+
+// handleDirectHTTP forwards a plain HTTP request straight to the target.
+func (s *Server) handleDirectHTTP(w http.ResponseWriter, r *http.Request, reqID string) {
+	s.incrementActiveConnections()
+	defer s.decrementActiveConnections()
+
+	switch s.forwardHTTP(w, r, s.directTransport, "direct", reqID) {
+	case attemptAborted:
+		s.abortResponse(w, reqID)
+	case attemptFailed:
+		s.incrementFailedRequests()
+		http.Error(w, "Direct request failed", http.StatusBadGateway)
+	default:
+		s.httpLogger.Info(reqID, "Request to %s successful via direct connection", r.URL.Host)
+	}
+}
+
+// handleDirectConnect opens a tunnel straight to the target.
+func (s *Server) handleDirectConnect(w http.ResponseWriter, r *http.Request, reqID string) {
+	s.incrementActiveConnections()
+	defer s.decrementActiveConnections()
+
+	host := connectAddr(r)
+
+	targetConn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		s.httpsLogger.Warn(reqID, "Direct connection to %s failed: %v", host, err)
+		s.incrementFailedRequests()
+		http.Error(w, "Direct connection failed", http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.httpsLogger.Error(reqID, "Hijacking not supported")
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		s.httpsLogger.Error(reqID, "Hijacking failed: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	s.relay(clientConn, targetConn)
+
+	s.incrementRequestsHandled()
+	s.httpsLogger.Info(reqID, "Direct tunnel to %s closed", host)
+}
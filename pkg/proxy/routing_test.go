@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/database"
+	"aproxy/pkg/checker"
+	"aproxy/pkg/manager"
+	"aproxy/pkg/rules"
+	"aproxy/pkg/scraper"
+)
+
+func TestRuleDecisions(t *testing.T) {
+	var hits atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+	echo := newEchoTarget(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+
+	// localhost is rejected by name; the same targets by IP go direct
+	engine, err := rules.NewEngine([]config.RuleConfig{
+		{Name: "blocked", Domains: []string{"localhost"}, Action: "reject"},
+		{Name: "loopback", CIDRs: []string{"127.0.0.0/8"}, Action: "direct"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newDirectServer(t, config.ServerConfig{EnableHTTPS: true}, &http.Transport{})
+	s.rules = engine
+	front := httptest.NewServer(s)
+	defer front.Close()
+	proxyURL, _ := url.Parse(front.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	_, targetPort, _ := net.SplitHostPort(target.Listener.Addr().String())
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{target.URL, http.StatusOK},
+		{"http://localhost:" + targetPort + "/", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		resp, err := client.Get(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("GET %s: status %d, want %d", c.url, resp.StatusCode, c.status)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("target got %d requests, want only the direct one", hits.Load())
+	}
+
+	connect := func(addr string) int {
+		t.Helper()
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			io.WriteString(conn, "ping")
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("CONNECT %s: read %q, %v through the tunnel", addr, buf, err)
+			}
+		}
+		return resp.StatusCode
+	}
+	if got := connect(echo); got != http.StatusOK {
+		t.Errorf("CONNECT %s: status %d, want a direct tunnel", echo, got)
+	}
+	if got := connect("localhost:" + echoPort); got != http.StatusForbidden {
+		t.Errorf("CONNECT localhost: status %d, want 403", got)
+	}
+
+	if failed := s.getStats().FailedRequests; failed != 2 {
+		t.Errorf("FailedRequests = %d, want the 2 rejections", failed)
+	}
+}
+
+// newPoolManager returns a manager with a pool of one healthy proxy, an
+// HTTP server that answers every request itself.
+func newPoolManager(t *testing.T, proxyCfg config.ProxyConfig) (*manager.DBManager, scraper.Proxy) {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "aproxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	proxyCfg.Reputation = config.ReputationConfig{HalfLife: time.Hour, BlockCooldown: time.Minute, Candidates: 1}
+	mgr := manager.NewDBManager(db, &config.Config{Proxy: proxyCfg, Checker: config.CheckerConfig{
+		TestURL:    "http://check.example/",
+		Timeout:    5 * time.Second,
+		MaxWorkers: 1,
+		UserAgent:  "aproxy-test",
+	}})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "203.0.113.1")
+	}))
+	t.Cleanup(srv.Close)
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p := scraper.Proxy{Host: host, Type: "http"}
+	p.Port, _ = strconv.Atoi(port)
+	results := mgr.AddProxies(context.Background(), []scraper.Proxy{p})
+	if len(results) != 1 || results[0].Status != checker.StatusHealthy {
+		t.Fatalf("AddProxies(%s) = %+v, want one healthy result", p.Address(), results)
+	}
+	return mgr, p
+}
+
+func TestPickRouteRateLimitedSkipsPoliteness(t *testing.T) {
+	mgr, p := newPoolManager(t, config.ProxyConfig{Politeness: config.PolitenessConfig{Window: time.Minute, MinInterval: time.Minute}})
+	s := &Server{manager: mgr, rateLimits: newRateLimits(config.RateLimitConfig{PerDomainProxy: config.RateConfig{Rate: 0.001, Burst: 1}})}
+
+	// The proxy is over its rate limit for the host, so no route is taken
+	s.rateLimits.allowProxy("example.com", p.Address(), time.Now())
+	_, err := s.pickRoute(rules.Decision{}, "example.com")
+	var limited *rateLimitedError
+	if !errors.As(err, &limited) {
+		t.Fatalf("pickRoute = %v, want a rate limit error", err)
+	}
+	// and the pick it dropped doesn't start a cooldown
+	if _, err := mgr.SelectProxy(manager.Selection{Target: "example.com"}); err != nil {
+		t.Fatalf("proxy cooling down after a rate-limited pick: %v", err)
+	}
+
+	// A route that is taken does
+	rt, err := s.pickRoute(rules.Decision{}, "other.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.exit().Address() != p.Address() {
+		t.Errorf("picked %s, want %s", rt.exit().Address(), p.Address())
+	}
+	var cooling *manager.CooldownError
+	if _, err := mgr.SelectProxy(manager.Selection{Target: "other.example"}); !errors.As(err, &cooling) {
+		t.Errorf("SelectProxy after a taken route = %v, want a cooldown", err)
+	}
+}
@@ -1,15 +1,21 @@
 package proxy
 
 import (
-	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,9 +23,7 @@ import (
 	"aproxy/internal/config"
 	"aproxy/internal/logger"
 	"aproxy/pkg/manager"
-	"aproxy/pkg/scraper"
-
-	netproxy "golang.org/x/net/proxy"
+	"aproxy/pkg/rules"
 )
 
 type Server struct {
@@ -30,6 +34,45 @@ type Server struct {
 	logger      *logger.Logger
 	httpLogger  *logger.Logger
 	httpsLogger *logger.Logger
+
+	// rules routes each request to the pool, an upstream, direct, or rejects it.
+	rules *rules.Engine
+	// directTransport is shared by requests routed direct.
+	directTransport *http.Transport
+	// transports caches one transport per upstream route.
+	transports *transportCache
+	// listener marks a server made by Listener, which leaves the transports
+	// it shares to its owner to close.
+	listener bool
+	// admission enforces MaxConnections and the per-client limit on the
+	// connections Serve accepts.
+	admission *admission
+	// rateLimits are the token-bucket limits on requests.
+	rateLimits *rateLimits
+	// blocks recognizes block pages served in place of content.
+	blocks *blockDetector
+	// tunnels times out relayed tunnels and records how long they last.
+	tunnels *tunnels
+	// cache stores responses to plain-HTTP GETs; nil when disabled.
+	cache *httpCache
+	// mitm decrypts CONNECT tunnels; nil when interception is disabled.
+	mitm *interceptor
+	// profiles dress requests as browsers; nil when disabled.
+	profiles *headerProfiles
+	// tlsConfig serves the proxy port over TLS; nil for plain HTTP.
+	tlsConfig *tls.Config
+	// socks serves SOCKS5 instead of HTTP proxy requests.
+	socks bool
+	// filter narrows pool selection when the matching rule sets none.
+	filter manager.ProxyFilter
+	// portPresets, when set, replaces ListenAddr: each port is bound on
+	// listenHost and selects from the pool with its preset (see match).
+	portPresets map[int]manager.Selection
+	listenHost  string
+
+	// serveManagement keeps /stats and /proxies on the proxy port, for setups
+	// without a dedicated management listener.
+	serveManagement bool
 }
 
 type Stats struct {
@@ -37,34 +80,179 @@ type Stats struct {
 	BytesTransferred  int64
 	ActiveConnections int32
 	FailedRequests    int64
-	mu                sync.RWMutex
+	// AbortedResponses counts responses that broke off after their headers
+	// were sent, too late to retry or to report an error to the client.
+	AbortedResponses int64
+	mu               sync.RWMutex
 }
 
-func NewServer(mgr *manager.DBManager, config config.ServerConfig) *Server {
-	return &Server{
+func NewServer(mgr *manager.DBManager, config config.ServerConfig, engine *rules.Engine) *Server {
+	s := &Server{
 		manager:     mgr,
 		config:      config,
 		stats:       &Stats{},
 		logger:      logger.New("server"),
 		httpLogger:  logger.New("http"),
 		httpsLogger: logger.New("https"),
+		rules:       engine,
+		directTransport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		transports: newTransportCache(config.Transport.MaxCached, config.Transport.IdleTimeout),
+		admission:  newAdmission(config.MaxConnections, config.Admission),
+		rateLimits: newRateLimits(config.RateLimit),
+		blocks:     newBlockDetector(config.BlockDetection),
+		tunnels:    newTunnels(config.Tunnel),
+		profiles:   newHeaderProfiles(config.HeaderProfiles),
+
+		serveManagement: true,
+	}
+	if config.Cache.Enabled {
+		cache, err := newHTTPCache(config.Cache)
+		if err != nil {
+			s.logger.ErrorBg("Response cache disk tier disabled: %v", err)
+		}
+		s.cache = cache
 	}
+	// Close connections through proxies as soon as they leave the pool
+	mgr.OnEvict(s.transports.evict)
+	return s
+}
+
+// DisableManagement stops serving /stats and /proxies on the proxy port, for
+// when a dedicated management listener serves ManagementHandler instead.
+func (s *Server) DisableManagement() {
+	s.serveManagement = false
+}
+
+// ManagementHandler serves /health, /stats, /proxies and, if enabled, the PAC
+// file without authentication; the management listener wraps it with its own auth.
+func (s *Server) ManagementHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", s.handleHealth)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("GET /proxies", s.handleProxies)
+	if s.config.PAC.Enabled {
+		mux.HandleFunc("GET /proxy.pac", s.handlePAC)
+		mux.HandleFunc("GET /wpad.dat", s.handlePAC)
+	}
+	return mux
 }
 
 func (s *Server) Start() error {
+	if s.portPresets == nil {
+		ln, err := net.Listen("tcp", s.config.ListenAddr)
+		if err != nil {
+			return err
+		}
+		return s.Serve(ln)
+	}
+
+	lns := make([]net.Listener, 0, len(s.portPresets))
+	for _, port := range slices.Sorted(maps.Keys(s.portPresets)) {
+		ln, err := net.Listen("tcp", net.JoinHostPort(s.listenHost, strconv.Itoa(port)))
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+	return s.Serve(lns...)
+}
+
+// Serve accepts proxy clients on each of lns until Stop, and returns the
+// first error from any of them.
+func (s *Server) Serve(lns ...net.Listener) error {
 	s.server = &http.Server{
-		Addr:           s.config.ListenAddr,
 		Handler:        s, // Use the server itself as the handler
 		ReadTimeout:    s.config.ReadTimeout,
 		WriteTimeout:   s.config.WriteTimeout,
 		IdleTimeout:    s.config.IdleTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
+	if s.tlsConfig != nil {
+		s.server.TLSConfig = s.tlsConfig
+		// A non-nil empty map keeps HTTP/2 off, so CONNECT can hijack
+		s.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		ln := s.admitListener(ln, !s.socks && s.tlsConfig == nil)
+		go func() {
+			switch {
+			case s.socks:
+				errs <- s.server.Serve(newSOCKSListener(ln, s.logger))
+			case s.tlsConfig != nil:
+				errs <- s.server.ServeTLS(ln, "", "")
+			default:
+				errs <- s.server.Serve(ln)
+			}
+		}()
+	}
+	return <-errs
+}
 
-	return s.server.ListenAndServe()
+// Listener returns a server for an extra proxy port described by cfg, routed
+// by engine. It shares the pool, stats, limits, caches and transports with s
+// but has its own auth token, header policy and default pool filter, and
+// serves neither TLS nor the management endpoints. With cfg.Ports, it binds
+// every port of each range instead of one, resolving their presets with the
+// manager. Start it like s, and stop it before s.
+func (s *Server) Listener(cfg config.ListenerConfig, engine *rules.Engine) (*Server, error) {
+	l := *s
+	l.server = nil
+	l.tlsConfig = nil
+	l.serveManagement = false
+	l.listener = true
+	l.rules = engine
+	l.socks = cfg.Protocol == "socks5"
+	l.filter = manager.NewProxyFilter(cfg.Filter)
+
+	l.config.ListenAddr = cfg.ListenAddr
+	l.config.AuthToken = cfg.AuthToken
+	l.config.StripHeaders = cfg.StripHeaders
+	l.config.AddHeaders = cfg.AddHeaders
+	if cfg.Via != nil {
+		l.config.Via = *cfg.Via
+	}
+
+	if len(cfg.Ports) > 0 {
+		l.listenHost = cfg.ListenHost
+		l.portPresets = make(map[int]manager.Selection)
+		for _, pc := range cfg.Ports {
+			preset, ok := s.manager.Preset(pc.Preset)
+			if !ok {
+				return nil, fmt.Errorf("listener %q: unknown preset %q", cfg.Name, pc.Preset)
+			}
+			lo, hi, err := rules.ParsePortRange(pc.Ports)
+			if err != nil {
+				return nil, fmt.Errorf("listener %q: %w", cfg.Name, err)
+			}
+			for port := lo; port <= hi; port++ {
+				if _, dup := l.portPresets[port]; dup {
+					return nil, fmt.Errorf("listener %q: port %d has two presets", cfg.Name, port)
+				}
+				// Each port of a sticky preset is its own session
+				l.portPresets[port] = preset.Selection(fmt.Sprintf("%s:%d", cfg.Name, port))
+			}
+		}
+	}
+	return &l, nil
 }
 
 func (s *Server) Stop(ctx context.Context) error {
+	if !s.listener {
+		defer s.transports.closeAll()
+	}
 	if s.server != nil {
 		return s.server.Shutdown(ctx)
 	}
@@ -75,26 +263,39 @@ func (s *Server) Stop(ctx context.Context) error {
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	reqID := logger.GenerateID()
 
-	// Handle special endpoints
-	if r.Method == "GET" {
+	// Handle special endpoints. Only relative URLs are addressed to aproxy
+	// itself; absolute ones are proxied even if their path is /health.
+	if r.Method == "GET" && r.URL.Host == "" {
 		switch r.URL.Path {
 		case "/health":
-			s.handleHealth(w, r)
-			return
+			if s.config.HealthEndpoint {
+				s.handleHealth(w, r)
+				return
+			}
+		case "/proxy.pac", "/wpad.dat":
+			// Browsers fetch PAC files without credentials
+			if s.config.PAC.Enabled {
+				s.handlePAC(w, r)
+				return
+			}
 		case "/stats":
-			// Check auth for protected endpoints
-			if !s.checkAuth(w, r, reqID) {
+			if s.serveManagement {
+				// Check auth for protected endpoints
+				if !s.checkAuth(w, r, reqID) {
+					return
+				}
+				s.handleStats(w, r)
 				return
 			}
-			s.handleStats(w, r)
-			return
 		case "/proxies":
-			// Check auth for protected endpoints
-			if !s.checkAuth(w, r, reqID) {
+			if s.serveManagement {
+				// Check auth for protected endpoints
+				if !s.checkAuth(w, r, reqID) {
+					return
+				}
+				s.handleProxies(w, r)
 				return
 			}
-			s.handleProxies(w, r)
-			return
 		}
 	}
 
@@ -110,6 +311,10 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.applyRateLimits(w, r, reqID) {
+		return
+	}
+
 	s.logger.Info(reqID, "Received %s request for %s", r.Method, r.URL.String())
 
 	// Handle proxy requests (both HTTP and HTTPS CONNECT)
@@ -118,10 +323,9 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // checkAuth validates authentication for protected endpoints
 func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, reqID string) bool {
-	if s.config.AuthToken != "" {
-		authHeader := r.Header.Get("Proxy-Authorization")
-		expectedAuth := "Bearer " + s.config.AuthToken
-		if authHeader != expectedAuth {
+	// A verified client certificate authenticates as well as the token
+	if s.config.AuthToken != "" && !hasClientCert(r) {
+		if _, ok := s.authenticate(r); !ok {
 			s.logger.Warn(reqID, "Unauthorized request from %s to %s", r.RemoteAddr, r.URL.Path)
 			http.Error(w, "Proxy authorization required", http.StatusProxyAuthRequired)
 			return false
@@ -130,6 +334,37 @@ func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, reqID string)
 	return true
 }
 
+// authenticate checks the Proxy-Authorization header against the auth
+// token, sent as a Bearer token or as the Basic auth password. It returns who
+// the client authenticated as: the Basic username, which lets clients sharing
+// a token be told apart, or a digest of the token.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok {
+		return "", false
+	}
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", false
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		if password != s.config.AuthToken {
+			return "", false
+		}
+		return "user:" + username, true
+	case "bearer":
+		if credentials != s.config.AuthToken {
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(credentials))
+		return "token:" + hex.EncodeToString(sum[:8]), true
+	default:
+		return "", false
+	}
+}
+
 // isValidProxyRequest checks if the request is a valid proxy request
 func (s *Server) isValidProxyRequest(r *http.Request) bool {
 	// CONNECT requests are always valid proxy requests
@@ -152,6 +387,31 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request, reqID string
 		return
 	}
 
+	defaultPort := 80
+	if r.URL.Scheme == "https" {
+		defaultPort = 443
+	}
+	decision := s.match(r, defaultPort)
+	if !s.applyDecision(w, r, decision, reqID) {
+		return
+	}
+	if s.cache != nil && cacheableRequest(r) {
+		rec, served := s.serveFromCache(w, r, reqID)
+		if served {
+			return
+		}
+		defer rec.finish()
+		w = rec
+	}
+	if decision.Action == rules.ActionDirect {
+		s.handleDirectHTTP(w, r, reqID)
+		return
+	}
+	if s.config.Hedge.Enabled && hedgeable(r) {
+		s.handleHedgedHTTP(w, r, decision, reqID)
+		return
+	}
+
 	// Retry logic for HTTP requests
 	maxRetries := s.config.MaxRetries
 	if maxRetries <= 0 {
@@ -160,10 +420,15 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request, reqID string
 
 	s.httpLogger.Debug(reqID, "Starting HTTP proxy attempts (max: %d)", maxRetries)
 
+	shareBody(r)
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		proxy, err := s.manager.GetNextProxy()
+		rt, err := s.pickRoute(decision, targetHost(r))
 		if err != nil {
 			if attempt == maxRetries-1 {
+				if s.rejectRateLimited(w, err) {
+					s.httpLogger.Warn(reqID, "Every proxy is over its rate limit for %s", r.URL.Host)
+					return
+				}
 				s.httpLogger.Error(reqID, "No proxies available after %d attempts", maxRetries)
 				s.incrementFailedRequests()
 				http.Error(w, "No proxy available", http.StatusServiceUnavailable)
@@ -173,16 +438,28 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request, reqID string
 			continue
 		}
 
-		s.httpLogger.Debug(reqID, "Attempt %d/%d using proxy %s", attempt+1, maxRetries, proxy.Address())
+		s.httpLogger.Debug(reqID, "Attempt %d/%d using proxy %s", attempt+1, maxRetries, rt)
 
-		if s.tryProxyHTTPRequest(w, r, proxy, reqID) {
-			s.httpLogger.Info(reqID, "Request successful via proxy %s", proxy.Address())
+		switch s.tryProxyHTTPRequest(w, r, rt, attempt == maxRetries-1, reqID) {
+		case attemptDone:
+			s.httpLogger.Info(reqID, "Request successful via proxy %s", rt)
 			return // Success
+		case attemptAborted:
+			s.abortResponse(w, reqID)
+			return
+		case attemptBlocked:
+			s.httpLogger.Warn(reqID, "Proxy %s blocked by %s, trying next", rt, r.URL.Host)
+		default:
+			// Report failure and try next proxy
+			s.reportFailure(rt, targetHost(r))
+			if !replayable(r) {
+				s.httpLogger.Error(reqID, "Proxy %s failed after reading the request body, not retrying", rt)
+				s.incrementFailedRequests()
+				http.Error(w, "Proxy attempt failed", http.StatusBadGateway)
+				return
+			}
+			s.httpLogger.Warn(reqID, "Proxy %s failed, trying next", rt)
 		}
-
-		// Report failure and try next proxy
-		s.manager.ReportProxyFailure(*proxy)
-		s.httpLogger.Warn(reqID, "Proxy %s failed, trying next", proxy.Address())
 	}
 
 	// All attempts failed
@@ -204,12 +481,33 @@ func (s *Server) handleHTTPSConnect(w http.ResponseWriter, r *http.Request, reqI
 		maxRetries = 1
 	}
 
+	decision := s.match(r, 443)
+	if !s.applyDecision(w, r, decision, reqID) {
+		return
+	}
+	if s.mitm != nil && s.mitm.intercepts(targetHost(r)) {
+		s.handleMITM(w, r, reqID)
+		return
+	}
+	if decision.Action == rules.ActionDirect {
+		s.handleDirectConnect(w, r, reqID)
+		return
+	}
+	if s.config.Hedge.Enabled {
+		s.handleHedgedConnect(w, r, decision, reqID)
+		return
+	}
+
 	s.httpsLogger.Debug(reqID, "Starting HTTPS CONNECT attempts (max: %d) for %s", maxRetries, r.URL.Host)
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		proxy, err := s.manager.GetNextProxy()
+		rt, err := s.pickRoute(decision, targetHost(r))
 		if err != nil {
 			if attempt == maxRetries-1 {
+				if s.rejectRateLimited(w, err) {
+					s.httpsLogger.Warn(reqID, "Every proxy is over its rate limit for %s", r.URL.Host)
+					return
+				}
 				s.httpsLogger.Error(reqID, "No proxies available after %d attempts", maxRetries)
 				s.incrementFailedRequests()
 				http.Error(w, "No proxy available", http.StatusServiceUnavailable)
@@ -219,23 +517,17 @@ func (s *Server) handleHTTPSConnect(w http.ResponseWriter, r *http.Request, reqI
 			continue
 		}
 
-		s.httpsLogger.Debug(reqID, "Attempt %d/%d using proxy %s", attempt+1, maxRetries, proxy.Address())
-
-		// Try CONNECT tunnel first, fallback to HTTP proxy method
-		if s.tryHTTPSConnect(w, r, proxy, reqID) {
-			s.httpsLogger.Info(reqID, "CONNECT tunnel successful via proxy %s", proxy.Address())
-			return
-		}
+		s.httpsLogger.Debug(reqID, "Attempt %d/%d using proxy %s", attempt+1, maxRetries, rt)
 
-		s.httpsLogger.Debug(reqID, "CONNECT tunnel failed, trying HTTP fallback")
-		if s.tryHTTPSViaHTTPProxy(w, r, proxy, reqID) {
-			s.httpsLogger.Info(reqID, "HTTP fallback successful via proxy %s", proxy.Address())
+		if s.tryHTTPSConnect(w, r, rt, reqID) {
+			s.reportOutcome(rt, targetHost(r), manager.OutcomeSuccess)
+			s.httpsLogger.Info(reqID, "CONNECT tunnel successful via proxy %s", rt)
 			return
 		}
 
 		// Report failure and try next proxy
-		s.manager.ReportProxyFailure(*proxy)
-		s.httpsLogger.Warn(reqID, "Proxy %s failed for HTTPS, trying next", proxy.Address())
+		s.reportFailure(rt, targetHost(r))
+		s.httpsLogger.Warn(reqID, "Proxy %s failed for HTTPS, trying next", rt)
 	}
 
 	// All attempts failed
@@ -244,55 +536,115 @@ func (s *Server) handleHTTPSConnect(w http.ResponseWriter, r *http.Request, reqI
 	http.Error(w, "All HTTPS proxy attempts failed", http.StatusBadGateway)
 }
 
-func (s *Server) tryProxyHTTPRequest(w http.ResponseWriter, r *http.Request, proxy *scraper.Proxy, reqID string) bool {
+// tryProxyHTTPRequest sends r through rt. A block page is relayed to the
+// client only on the final attempt, or when r can't be sent again; otherwise
+// it is dropped for a retry.
+func (s *Server) tryProxyHTTPRequest(w http.ResponseWriter, r *http.Request, rt route, final bool, reqID string) attemptResult {
+	proxy := rt.exit()
 	s.httpLogger.Info(reqID, "Using proxy type: %s (%s:%d)", proxy.Type, proxy.Host, proxy.Port)
 	s.incrementActiveConnections()
 	defer s.decrementActiveConnections()
 
-	var transport *http.Transport
-
-	if proxy.Type == "socks4" || proxy.Type == "socks5" {
-		// Use golang.org/x/net/proxy for SOCKS proxies
-		proxyAddr := fmt.Sprintf("%s:%d", proxy.Host, proxy.Port)
-		dialer, err := netproxy.SOCKS5("tcp", proxyAddr, nil, netproxy.Direct)
-		if err != nil {
-			s.httpLogger.Error(reqID, "Failed to create SOCKS dialer for %s: %v", proxyAddr, err)
-			return false
+	transport, err := s.transports.get(rt)
+	if err != nil {
+		s.httpLogger.Error(reqID, "Failed to build transport for %s: %v", rt, err)
+		return attemptFailed
+	}
+
+	resp, err := s.send(r, transport)
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		s.reportOutcome(rt, targetHost(r), manager.OutcomeSuccess)
+		s.relayUpgrade(w, resp, reqID)
+		return attemptDone
+	}
+	if err == nil {
+		err = s.checkBlocked(resp, r, rt, reqID)
+	}
+	switch {
+	case errors.Is(err, errBlocked) && !final && replayable(r):
+		resp.Body.Close()
+		return attemptBlocked
+	case errors.Is(err, errBlocked):
+		// Out of attempts; the client gets the block page
+		skipCache(w)
+	case err != nil:
+		s.httpLogger.Warn(reqID, "HTTP request to %s via proxy %s failed: %v", r.URL.String(), rt, err)
+		if resp != nil {
+			resp.Body.Close()
 		}
-		transport = &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return dialer.Dial(network, addr)
-			},
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			MaxIdleConns:        100,
-			IdleConnTimeout:     90 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
+		return attemptFailed
+	}
+
+	if err := s.writeResponse(w, resp, reqID); err != nil {
+		s.httpLogger.Warn(reqID, "Response from %s via proxy %s broke off: %v", r.URL.Host, rt, err)
+		if errors.Is(err, errUpstreamBroken) {
+			s.reportFailure(rt, targetHost(r))
 		}
-	} else {
-		// HTTP/HTTPS proxy (default)
-		proxyURL := fmt.Sprintf("http://%s:%d", proxy.Host, proxy.Port)
-		proxyURLParsed, err := url.Parse(proxyURL)
-		if err != nil {
-			s.httpLogger.Error(reqID, "Invalid proxy URL %s: %v", proxyURL, err)
-			return false
+		return attemptAborted
+	}
+	return attemptDone
+}
+
+// proxyTransport builds a transport that sends requests through rt's exit
+// proxy, reached through the earlier hops of a chain. Use s.transports to
+// share one per route. HTTPS targets, such as intercepted requests, must
+// present a certificate the system trusts for their host; one that doesn't
+// fails the attempt.
+func proxyTransport(rt route) (*http.Transport, error) {
+	dialer, err := chainDialer(rt.hops)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	// Plain-HTTP requests go to an HTTP exit proxy as absolute URIs rather
+	// than through a tunnel; HTTPS ones are tunneled by the dialer.
+	if exit, ok := dialer.(*connectDialer); ok {
+		proxyURL := &url.URL{Scheme: "http", Host: exit.proxyAddr}
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "http" {
+				return proxyURL, nil
+			}
+			return nil, nil
 		}
-		transport = &http.Transport{
-			Proxy: http.ProxyURL(proxyURLParsed),
-			DialContext: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			MaxIdleConns:        100,
-			IdleConnTimeout:     90 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == exit.proxyAddr {
+				return exit.dialProxy(ctx, network)
+			}
+			return exit.DialContext(ctx, network, addr)
 		}
 	}
+	return transport, nil
+}
+
+// forwardHTTP sends r through transport and copies the response to w. via
+// names the route for logging.
+func (s *Server) forwardHTTP(w http.ResponseWriter, r *http.Request, transport http.RoundTripper, via, reqID string) attemptResult {
+	resp, err := s.send(r, transport)
+	if err != nil {
+		s.httpLogger.Warn(reqID, "HTTP request to %s via %s failed: %v", r.URL.String(), via, err)
+		return attemptFailed
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		s.relayUpgrade(w, resp, reqID)
+		return attemptDone
+	}
+	if err := s.writeResponse(w, resp, reqID); err != nil {
+		s.httpLogger.Warn(reqID, "Response from %s via %s broke off: %v", r.URL.Host, via, err)
+		return attemptAborted
+	}
+	return attemptDone
+}
 
+// sendHTTP sends a sanitized copy of r through transport, bound to ctx.
+func (s *Server) sendHTTP(ctx context.Context, r *http.Request, transport http.RoundTripper) (*http.Response, error) {
 	client := &http.Client{
 		Transport: transport,
 		Timeout:   30 * time.Second,
@@ -301,205 +653,89 @@ func (s *Server) tryProxyHTTPRequest(w http.ResponseWriter, r *http.Request, pro
 		},
 	}
 
-	req := r.Clone(r.Context())
+	req := r.Clone(ctx)
 	req.RequestURI = "" // Clear RequestURI for client requests
 	s.sanitizeRequest(req)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		s.httpLogger.Warn(reqID, "HTTP request to %s via proxy %s failed: %v", req.URL.String(), proxy.Address(), err)
-		return false
-	}
+	return client.Do(req)
+}
+
+// writeResponse copies an upstream response to the client and closes its
+// body. An error means the response broke off after its headers were sent;
+// it wraps errUpstreamBroken if reading from upstream failed.
+func (s *Server) writeResponse(w http.ResponseWriter, resp *http.Response, reqID string) error {
 	defer resp.Body.Close()
 
 	s.sanitizeResponse(resp)
 	s.copyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 
-	written, err := io.Copy(w, resp.Body)
+	body := &sourceReader{Reader: resp.Body}
+	written, err := io.Copy(w, body)
+	s.addBytesTransferred(written)
 	if err != nil {
-		s.httpLogger.Error(reqID, "Error copying response: %v", err)
-		return false
+		if body.err != nil {
+			return fmt.Errorf("%w: %v", errUpstreamBroken, err)
+		}
+		return err
 	}
 
 	s.incrementRequestsHandled()
-	s.addBytesTransferred(written)
 	s.httpLogger.Debug(reqID, "HTTP request successful, %d bytes transferred", written)
-	return true
+	return nil
 }
 
-func (s *Server) tryHTTPSConnect(w http.ResponseWriter, r *http.Request, proxy *scraper.Proxy, reqID string) bool {
+// tryHTTPSConnect opens a tunnel to the target through rt and relays it.
+func (s *Server) tryHTTPSConnect(w http.ResponseWriter, r *http.Request, rt route, reqID string) bool {
+	proxy := rt.exit()
 	s.httpsLogger.Info(reqID, "Using proxy type: %s (%s:%d)", proxy.Type, proxy.Host, proxy.Port)
 	s.incrementActiveConnections()
 	defer s.decrementActiveConnections()
 
-	var targetConn net.Conn
-	var err error
-
-	if proxy.Type == "socks4" || proxy.Type == "socks5" {
-		proxyAddr := fmt.Sprintf("%s:%d", proxy.Host, proxy.Port)
-		dialer, errDial := netproxy.SOCKS5("tcp", proxyAddr, nil, netproxy.Direct)
-		if errDial != nil {
-			s.manager.ReportProxyFailure(*proxy)
-			return false
-		}
-		targetConn, err = dialer.Dial("tcp", r.URL.Host)
-	} else {
-		targetConn, err = net.DialTimeout("tcp", net.JoinHostPort(proxy.Host, fmt.Sprintf("%d", proxy.Port)), 10*time.Second)
-	}
+	dialer, err := chainDialer(rt.hops)
 	if err != nil {
-		s.manager.ReportProxyFailure(*proxy)
 		return false
 	}
-	defer targetConn.Close()
-
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", r.URL.Host, r.URL.Host)
-	_, err = targetConn.Write([]byte(connectReq))
+	targetConn, err := dialer.DialContext(r.Context(), "tcp", connectAddr(r))
 	if err != nil {
-		s.manager.ReportProxyFailure(*proxy)
-		return false
-	}
-
-	response, err := http.ReadResponse(bufio.NewReader(targetConn), r)
-	if err != nil || response.StatusCode != http.StatusOK {
-		s.manager.ReportProxyFailure(*proxy)
-		if response != nil {
-			s.httpsLogger.Warn(reqID, "CONNECT to %s via proxy %s failed with status %d %s", r.URL.Host, proxy.Address(), response.StatusCode, response.Status)
-		} else {
-			s.httpsLogger.Warn(reqID, "CONNECT to %s via proxy %s failed with error: %v", r.URL.Host, proxy.Address(), err)
-		}
+		s.httpsLogger.Warn(reqID, "CONNECT to %s via proxy %s failed: %v", r.URL.Host, rt, err)
 		return false
 	}
+	defer targetConn.Close()
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		s.manager.ReportProxyFailure(*proxy)
+		s.httpsLogger.Error(reqID, "Hijacking not supported")
 		return false
 	}
-
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
-		s.manager.ReportProxyFailure(*proxy)
+		s.httpsLogger.Error(reqID, "Hijacking failed: %v", err)
 		return false
 	}
 	defer clientConn.Close()
 
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
-	// Use channels to coordinate bidirectional copying
-	done := make(chan struct{}, 2)
-
-	// Copy client -> target
-	go func() {
-		defer func() { done <- struct{}{} }()
-		io.Copy(targetConn, clientConn)
-		targetConn.Close()
-	}()
-
-	// Copy target -> client
-	go func() {
-		defer func() { done <- struct{}{} }()
-		written, _ := io.Copy(clientConn, targetConn)
-		s.addBytesTransferred(written)
-		clientConn.Close()
-	}()
-
-	// Wait for both goroutines to complete
-	<-done
-	<-done
+	s.relay(clientConn, targetConn)
 
 	s.incrementRequestsHandled()
 	return true
 }
 
-func (s *Server) tryHTTPSViaHTTPProxy(w http.ResponseWriter, r *http.Request, proxy *scraper.Proxy, reqID string) bool {
-	s.incrementActiveConnections()
-	defer s.decrementActiveConnections()
-
-	// Extract the target host and port from CONNECT request
-	host := r.URL.Host
-	if !strings.Contains(host, ":") {
-		host += ":443" // Default HTTPS port
+// connectAddr returns the host:port a CONNECT request asks for, defaulting
+// to the HTTPS port.
+func connectAddr(r *http.Request) string {
+	if _, _, err := net.SplitHostPort(r.URL.Host); err != nil {
+		return net.JoinHostPort(r.URL.Host, "443")
 	}
-
-	s.httpsLogger.Debug(reqID, "Fallback HTTPS via HTTP proxy %s for host %s", proxy.Address(), host)
-
-	// Create a simple tunnel by proxying the raw TCP connection
-	proxyAddr := net.JoinHostPort(proxy.Host, fmt.Sprintf("%d", proxy.Port))
-	proxyConn, err := net.DialTimeout("tcp", proxyAddr, 10*time.Second)
-	if err != nil {
-		s.httpsLogger.Warn(reqID, "Failed to connect to proxy %s: %v", proxy.Address(), err)
-		return false
-	}
-	defer proxyConn.Close()
-
-	// Send HTTP CONNECT request to proxy
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", host, host)
-	_, err = proxyConn.Write([]byte(connectReq))
-	if err != nil {
-		s.httpsLogger.Warn(reqID, "Failed to send CONNECT to proxy %s: %v", proxy.Address(), err)
-		return false
-	}
-
-	// Read the proxy response
-	reader := bufio.NewReader(proxyConn)
-	resp, err := http.ReadResponse(reader, r)
-	if err != nil {
-		s.httpsLogger.Warn(reqID, "Error reading proxy response from %s: %v", proxy.Address(), err)
-		return false
-	}
-
-	// If proxy doesn't support CONNECT, report failure
-	if resp.StatusCode != http.StatusOK {
-		s.httpsLogger.Warn(reqID, "Proxy %s doesn't support CONNECT (status %d)", proxy.Address(), resp.StatusCode)
-		return false
-	}
-
-	// Success! Establish the tunnel
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		s.httpsLogger.Error(reqID, "Hijacking not supported")
-		return false
-	}
-
-	clientConn, _, err := hijacker.Hijack()
-	if err != nil {
-		s.httpsLogger.Error(reqID, "Hijacking failed: %v", err)
-		return false
-	}
-	defer clientConn.Close()
-
-	// Send success response to client
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
-	// Use channels to coordinate bidirectional copying
-	done := make(chan struct{}, 2)
-
-	// Copy client -> proxy
-	go func() {
-		defer func() { done <- struct{}{} }()
-		io.Copy(proxyConn, clientConn)
-		proxyConn.Close()
-	}()
-
-	// Copy proxy -> client
-	go func() {
-		defer func() { done <- struct{}{} }()
-		written, _ := io.Copy(clientConn, proxyConn)
-		s.addBytesTransferred(written)
-		clientConn.Close()
-	}()
-
-	// Wait for both goroutines to complete
-	<-done
-	<-done
-
-	s.incrementRequestsHandled()
-	s.httpsLogger.Debug(reqID, "HTTPS via HTTP proxy %s successful", proxy.Address())
-	return true
+	return r.URL.Host
 }
 
 func (s *Server) sanitizeRequest(req *http.Request) {
+	clientUA := req.Header.Get("User-Agent")
+	user := s.userID(req)
+	removeRequestHopHeaders(req.Header)
+
 	for _, header := range s.config.StripHeaders {
 		req.Header.Del(header)
 	}
@@ -507,15 +743,15 @@ func (s *Server) sanitizeRequest(req *http.Request) {
 	for key, value := range s.config.AddHeaders {
 		req.Header.Set(key, value)
 	}
-
-	req.Header.Del("Proxy-Connection")
-	req.Header.Del("Proxy-Authorization")
+	s.profiles.apply(req, clientUA, user)
+	s.applyVia(req.Header, req.ProtoMajor, req.ProtoMinor)
 }
 
 func (s *Server) sanitizeResponse(resp *http.Response) {
+	removeResponseHopHeaders(resp)
 	resp.Header.Del("Server")
 	resp.Header.Del("X-Powered-By")
-	resp.Header.Del("Via")
+	s.applyVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
 }
 
 func (s *Server) copyHeaders(dst, src http.Header) {
@@ -534,6 +770,8 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 
 	managerStats := s.manager.GetStats()
 	serverStats := s.getStats()
+	admissionStats := s.admission.stats()
+	tunnelStats := s.tunnels.stats()
 
 	resp := map[string]any{
 		"proxy_stats": map[string]any{
@@ -543,13 +781,42 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 			"proxy_countries": managerStats.CountryCount,
 		},
 		"server_stats": map[string]any{
-			"requests_handled":   serverStats.RequestsHandled,
-			"bytes_transferred":  serverStats.BytesTransferred,
-			"active_connections": serverStats.ActiveConnections,
-			"failed_requests":    serverStats.FailedRequests,
+			"requests_handled":    serverStats.RequestsHandled,
+			"bytes_transferred":   serverStats.BytesTransferred,
+			"active_connections":  serverStats.ActiveConnections,
+			"failed_requests":     serverStats.FailedRequests,
+			"aborted_responses":   serverStats.AbortedResponses,
+			"upstream_transports": s.transports.len(),
+		},
+		"admission_stats": map[string]any{
+			"active":      admissionStats.Active,
+			"limit":       admissionStats.Limit,
+			"queue_depth": admissionStats.Queued,
+			"rejected":    admissionStats.Rejected,
+		},
+		"tunnel_stats": map[string]any{
+			"closed":               tunnelStats.Closed,
+			"idle_timeouts":        tunnelStats.IdleTimeouts,
+			"lifetime_timeouts":    tunnelStats.LifetimeTimeouts,
+			"avg_duration_seconds": tunnelStats.AvgDuration.Seconds(),
+			"max_duration_seconds": tunnelStats.MaxDuration.Seconds(),
+			"durations":            tunnelStats.Durations,
 		},
 		"database_stats": "not_available",
 	}
+	if s.cache != nil {
+		cacheStats := s.cache.snapshot()
+		resp["cache_stats"] = map[string]any{
+			"entries":       cacheStats.Entries,
+			"memory_bytes":  cacheStats.MemoryBytes,
+			"disk_bytes":    cacheStats.DiskBytes,
+			"hits":          cacheStats.Hits,
+			"misses":        cacheStats.Misses,
+			"revalidations": cacheStats.Revalidations,
+			"stores":        cacheStats.Stores,
+			"evictions":     cacheStats.Evictions,
+		}
+	}
 	if dbStats, err := s.manager.GetDBStats(context.Background()); err == nil {
 		resp["database_stats"] = map[string]any{
 			"total_in_db":   dbStats.Total,
@@ -578,12 +845,20 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK - %d healthy proxies available", managerStats.HealthyCount)
 }
 
+// handleProxies lists the pool, filtered, sorted and paginated per the query
+// string, in one of the export formats (see parseProxyQuery).
 func (s *Server) handleProxies(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	q, err := parseProxyQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	proxies := s.manager.GetHealthyProxies()
 
 	if len(proxies) == 0 {
@@ -591,19 +866,10 @@ func (s *Server) handleProxies(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	list := make([]map[string]any, len(proxies))
-	for i, p := range proxies {
-		list[i] = map[string]any{
-			"host":      p.Host,
-			"port":      p.Port,
-			"type":      p.Type,
-			"country":   p.Country,
-			"last_seen": p.LastSeen.Format("2006-01-02T15:04:05Z"),
-		}
+	page, total := q.apply(proxies)
+	if err := writeProxies(w, page, total, q); err != nil {
+		s.logger.WarnBg("Failed to write proxy list: %v", err)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{"proxies": list, "count": len(proxies)})
 }
 
 func (s *Server) getStats() Stats {
@@ -614,6 +880,7 @@ func (s *Server) getStats() Stats {
 		BytesTransferred:  s.stats.BytesTransferred,
 		ActiveConnections: s.stats.ActiveConnections,
 		FailedRequests:    s.stats.FailedRequests,
+		AbortedResponses:  s.stats.AbortedResponses,
 	}
 }
 
@@ -629,6 +896,12 @@ func (s *Server) incrementFailedRequests() {
 	s.stats.mu.Unlock()
 }
 
+func (s *Server) incrementAbortedResponses() {
+	s.stats.mu.Lock()
+	s.stats.AbortedResponses++
+	s.stats.mu.Unlock()
+}
+
 func (s *Server) incrementActiveConnections() {
 	s.stats.mu.Lock()
 	s.stats.ActiveConnections++
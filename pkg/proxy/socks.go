@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"aproxy/internal/logger"
+)
+
+// SOCKS5 (RFC 1928) and username/password authentication (RFC 1929).
+const (
+	socksVersion     = 5
+	socksNoAuth      = 0x00
+	socksPassword    = 0x02
+	socksNoMethods   = 0xff
+	socksConnect     = 0x01
+	socksAddrIPv4    = 0x01
+	socksAddrDomain  = 0x03
+	socksAddrIPv6    = 0x04
+	socksPasswordVer = 0x01
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksNotAllowed         = 0x02
+	socksHostUnreachable    = 0x04
+	socksCommandUnsupported = 0x07
+	socksAddrUnsupported    = 0x08
+)
+
+// socksListener accepts SOCKS5 clients and hands each to the http.Server as
+// an HTTP CONNECT request for the address it asked for, so SOCKS tunnels take
+// the same path as CONNECT: auth, rate limits, rules, retries and relaying.
+// The password a client authenticates with is sent as the Bearer token.
+type socksListener struct {
+	net.Listener
+	logger *logger.Logger
+
+	conns     chan net.Conn
+	err       chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSOCKSListener(ln net.Listener, logger *logger.Logger) *socksListener {
+	l := &socksListener{
+		Listener: ln,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop runs handshakes concurrently, so a slow client doesn't hold up
+// the others.
+func (l *socksListener) acceptLoop() {
+	l.err <- acceptConns(l.Listener, l.logger, l.done, func(conn net.Conn) {
+		go l.handshake(conn)
+	})
+}
+
+func (l *socksListener) handshake(conn net.Conn) {
+	sc, err := socksHandshake(conn)
+	if err != nil {
+		l.logger.DebugBg("SOCKS5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- sc:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *socksListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *socksListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// socksHandshake negotiates authentication and reads the client's request.
+// The returned connection reads as the equivalent CONNECT request followed
+// by the client's stream.
+func socksHandshake(conn net.Conn) (*socksConn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	// Prefer a password, which carries the token, over no authentication
+	var password string
+	switch {
+	case bytes.IndexByte(methods, socksPassword) >= 0:
+		if _, err := conn.Write([]byte{socksVersion, socksPassword}); err != nil {
+			return nil, err
+		}
+		var err error
+		if password, err = readSOCKSPassword(conn); err != nil {
+			return nil, err
+		}
+	case bytes.IndexByte(methods, socksNoAuth) >= 0:
+		if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+			return nil, err
+		}
+	default:
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return nil, errors.New("no supported authentication method")
+	}
+
+	addr, code, err := readSOCKSRequest(conn)
+	if err != nil {
+		if code != socksSucceeded {
+			writeSOCKSReply(conn, code)
+		}
+		return nil, err
+	}
+
+	var req strings.Builder
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if password != "" {
+		fmt.Fprintf(&req, "Proxy-Authorization: Bearer %s\r\n", password)
+	}
+	req.WriteString("\r\n")
+	return &socksConn{Conn: conn, request: strings.NewReader(req.String())}, nil
+}
+
+// readSOCKSPassword reads a username/password subnegotiation and accepts it;
+// the password is checked as a token along with the request. The username
+// is ignored.
+func readSOCKSPassword(conn net.Conn) (string, error) {
+	var fields [2]string
+	var ver [1]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return "", err
+	}
+	if ver[0] != socksPasswordVer {
+		return "", fmt.Errorf("unsupported password auth version %d", ver[0])
+	}
+	for i := range fields {
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		field := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, field); err != nil {
+			return "", err
+		}
+		fields[i] = string(field)
+	}
+
+	password := fields[1]
+	if !validHeaderValue(password) {
+		conn.Write([]byte{socksPasswordVer, 1})
+		return "", errors.New("invalid characters in password")
+	}
+	if _, err := conn.Write([]byte{socksPasswordVer, 0}); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// readSOCKSRequest reads a request and returns the host:port it asks to
+// connect to. On failure, a non-zero code is the reply to send.
+func readSOCKSRequest(conn net.Conn) (string, byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", socksSucceeded, err
+	}
+	if head[0] != socksVersion {
+		return "", socksGeneralFailure, fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+
+	var host string
+	switch head[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", socksSucceeded, err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", socksSucceeded, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", socksSucceeded, err
+		}
+		host = string(name)
+		if host == "" || strings.ContainsAny(host, " /") || !validHeaderValue(host) {
+			return "", socksGeneralFailure, fmt.Errorf("invalid host name %q", host)
+		}
+	default:
+		return "", socksAddrUnsupported, fmt.Errorf("unsupported address type %d", head[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", socksSucceeded, err
+	}
+
+	// Only CONNECT has a CONNECT equivalent
+	if head[1] != socksConnect {
+		return "", socksCommandUnsupported, fmt.Errorf("unsupported command %d", head[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), socksSucceeded, nil
+}
+
+// validHeaderValue reports whether s can be sent in a request line or header
+// as is: no control characters.
+func validHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSOCKSReply answers a request. The bound address is left unspecified;
+// clients don't need it for CONNECT.
+func writeSOCKSReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode translates the status the server answered CONNECT with.
+func socksReplyCode(status int) byte {
+	switch status {
+	case http.StatusOK:
+		return socksSucceeded
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socksNotAllowed
+	case http.StatusMethodNotAllowed:
+		return socksCommandUnsupported
+	case http.StatusBadGateway:
+		return socksHostUnreachable
+	default:
+		return socksGeneralFailure
+	}
+}
+
+// socksConn is a SOCKS client connection as the http.Server sees it. Reads
+// return the CONNECT request before the client's stream. The HTTP response
+// to it is translated to a SOCKS reply; after a success, writes go through
+// untouched, and after a failure the connection is closed.
+type socksConn struct {
+	net.Conn
+	request *strings.Reader
+
+	mu      sync.Mutex
+	replied bool
+	head    []byte // response written so far, until the reply is sent
+}
+
+func (c *socksConn) Read(b []byte) (int, error) {
+	if c.request.Len() > 0 {
+		return c.request.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *socksConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+
+	c.head = append(c.head, b...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(b), nil
+	}
+	c.replied = true
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.head[:end+4])), nil)
+	if err != nil {
+		c.Conn.Close()
+		return 0, err
+	}
+	code := socksReplyCode(resp.StatusCode)
+	if err := writeSOCKSReply(c.Conn, code); err != nil {
+		return 0, err
+	}
+	if code != socksSucceeded {
+		// The rest is an error page the client has no use for
+		c.Conn.Close()
+		return len(b), nil
+	}
+	if rest := c.head[end+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.head = nil
+	return len(b), nil
+}
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *socksConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
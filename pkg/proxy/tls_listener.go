@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+)
+
+// certCheckInterval is how often handshakes look for a renewed certificate.
+const certCheckInterval = 10 * time.Second
+
+// listenerCert holds the proxy port's certificate, reloading it when its
+// files change so renewals need no restart.
+type listenerCert struct {
+	certFile, keyFile string
+	logger            *logger.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // newest of the two files when cert was loaded
+	checked time.Time
+}
+
+// EnableTLS serves the proxy port over TLS, optionally asking clients for
+// certificates. Call it before Start.
+func (s *Server) EnableTLS(cfg config.TLSListenerConfig) error {
+	if cfg.SelfSigned {
+		created, err := ensureSelfSigned(cfg.CertFile, cfg.KeyFile, s.config.ListenAddr)
+		if err != nil {
+			return err
+		}
+		if created {
+			s.logger.InfoBg("Generated self-signed certificate in %s; clients must trust it", cfg.CertFile)
+		}
+	}
+
+	lc := &listenerCert{certFile: cfg.CertFile, keyFile: cfg.KeyFile, logger: s.logger}
+	if err := lc.reload(); err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: lc.getCertificate,
+		// CONNECT needs to hijack the connection, which HTTP/2 doesn't allow
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch cfg.ClientAuth {
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if tlsConfig.ClientAuth != tls.NoClientCert {
+		pemCerts, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pemCerts) {
+			return fmt.Errorf("no certificates found in %s", cfg.ClientCA)
+		}
+	}
+
+	s.tlsConfig = tlsConfig
+	return nil
+}
+
+// hasClientCert reports whether r came over TLS with a client certificate
+// that verified against the client CA.
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+func (c *listenerCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if modTime, err := c.newestModTime(); err == nil && modTime.After(c.modTime) {
+			// Keep serving the old certificate until both files are in place
+			if err := c.load(); err != nil {
+				c.logger.WarnBg("Keeping current TLS certificate: %v", err)
+			} else {
+				c.logger.InfoBg("Reloaded TLS certificate from %s", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *listenerCert) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+	return c.load()
+}
+
+// load reads the certificate and key. Callers hold mu.
+func (c *listenerCert) load() error {
+	modTime, err := c.newestModTime()
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+func (c *listenerCert) newestModTime() (time.Time, error) {
+	var newest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// ensureSelfSigned writes a self-signed certificate for localhost and the
+// listen address to certPath and keyPath if neither exists. It reports
+// whether one was created.
+func ensureSelfSigned(certPath, keyPath, listenAddr string) (bool, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return false, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "aproxy", Organization: []string{"aproxy"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, err := net.SplitHostPort(listenAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to create self-signed certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, err
+	}
+	if err := savePEMs(certPath, der, keyPath, keyDER); err != nil {
+		return false, fmt.Errorf("failed to save self-signed certificate: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+)
+
+// serve starts s on a loopback port and returns its address.
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	ln := listen(t)
+	go s.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// trustFile returns a pool with the certificates in path.
+func trustFile(t *testing.T, path string) *x509.CertPool {
+	t.Helper()
+	pemCerts, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pemCerts)
+	return pool
+}
+
+// clientCert signs a client certificate with the CA at certPath and keyPath.
+func clientCert(t *testing.T, certPath, keyPath string) tls.Certificate {
+	t.Helper()
+	ca, caKey, _, err := loadCA(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSListener(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	dir := t.TempDir()
+	clientCAPath, clientKeyPath := filepath.Join(dir, "client-ca.pem"), filepath.Join(dir, "client-ca-key.pem")
+	if _, _, err := createCA(clientCAPath, clientKeyPath); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.TLSListenerConfig{
+		Enabled:    true,
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+		ClientAuth: "optional",
+		ClientCA:   clientCAPath,
+	}
+
+	s := newDirectServer(t, config.ServerConfig{
+		AuthToken:   "secret",
+		EnableHTTPS: true,
+		PAC:         config.PACConfig{Enabled: true},
+	}, &http.Transport{})
+	if err := s.EnableTLS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	proxyURL := &url.URL{Scheme: "https", Host: serve(t, s)}
+	roots := trustFile(t, cfg.CertFile)
+
+	cases := []struct {
+		name   string
+		token  string
+		cert   []tls.Certificate
+		status int
+	}{
+		{"no credentials", "", nil, http.StatusProxyAuthRequired},
+		{"token", "secret", nil, http.StatusOK},
+		{"client certificate", "", []tls.Certificate{clientCert(t, clientCAPath, clientKeyPath)}, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			transport := &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: c.cert},
+			}
+			defer transport.CloseIdleConnections()
+
+			req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+			if c.token != "" {
+				req.Header.Set("Proxy-Authorization", "Bearer "+c.token)
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != c.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, c.status)
+			}
+		})
+	}
+
+	// Tunnels are hijacked from the TLS connection
+	conn, err := tls.Dial("tcp", proxyURL.Host, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := newEchoTarget(t)
+	io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\nProxy-Authorization: Bearer secret\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %v, %v; want 200", resp, err)
+	}
+	assertEcho(t, conn)
+
+	// The PAC file points browsers at the TLS listener
+	pacClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err = pacClient.Get(proxyURL.String() + "/proxy.pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "HTTPS " + proxyURL.Host; !strings.Contains(string(pac), want) {
+		t.Errorf("PAC file %q doesn't contain %q", pac, want)
+	}
+
+	// A certificate from another CA doesn't verify, so the handshake fails
+	otherCA, otherKey := filepath.Join(dir, "other-ca.pem"), filepath.Join(dir, "other-ca-key.pem")
+	if _, _, err := createCA(otherCA, otherKey); err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert(t, otherCA, otherKey)},
+	}}
+	defer transport.CloseIdleConnections()
+	if resp, err := (&http.Client{Transport: transport}).Get(target.URL); err == nil {
+		resp.Body.Close()
+		t.Error("accepted a client certificate from an untrusted CA")
+	}
+}
+
+func TestListenerCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if created, err := ensureSelfSigned(certPath, keyPath, "127.0.0.1:0"); err != nil || !created {
+		t.Fatalf("ensureSelfSigned = %v, %v; want a new certificate", created, err)
+	}
+	if created, err := ensureSelfSigned(certPath, keyPath, "127.0.0.1:0"); err != nil || created {
+		t.Fatalf("ensureSelfSigned replaced an existing certificate: %v, %v", created, err)
+	}
+
+	c := &listenerCert{certFile: certPath, keyFile: keyPath, logger: logger.New("server")}
+	if err := c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.getCertificate(nil)
+
+	// Replace the files, as a renewal would
+	os.Remove(certPath)
+	os.Remove(keyPath)
+	if _, err := ensureSelfSigned(certPath, keyPath, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	os.Chtimes(keyPath, later, later)
+
+	if got, _ := c.getCertificate(nil); got != first {
+		t.Error("certificate reloaded before the check interval")
+	}
+	c.checked = time.Now().Add(-certCheckInterval)
+	if got, _ := c.getCertificate(nil); got == first {
+		t.Error("renewed certificate was not loaded")
+	}
+
+	// A half-written renewal keeps the current certificate
+	current, _ := c.getCertificate(nil)
+	os.WriteFile(keyPath, []byte("partial"), 0600)
+	os.Chtimes(keyPath, later.Add(time.Minute), later.Add(time.Minute))
+	c.checked = time.Now().Add(-certCheckInterval)
+	if got, err := c.getCertificate(nil); err != nil || got != current {
+		t.Errorf("getCertificate = %v; want the current certificate kept", err)
+	}
+}
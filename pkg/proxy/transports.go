@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"container/list"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transportCache keeps one http.Transport per upstream route so repeat
+// requests through the same proxy reuse its keep-alive connections. It holds
+// at most max transports, dropping the least recently used, and drops any
+// unused for longer than idle.
+type transportCache struct {
+	mu      sync.Mutex
+	max     int
+	idle    time.Duration
+	entries map[string]*list.Element
+	lru     *list.List // of *transportEntry, most recently used first
+}
+
+type transportEntry struct {
+	key       string
+	hops      []string // proxy addresses on the route
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+func newTransportCache(max int, idle time.Duration) *transportCache {
+	return &transportCache{
+		max:     max,
+		idle:    idle,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// routeKey identifies a route by its hops' types and addresses.
+func routeKey(rt route) string {
+	parts := make([]string, len(rt.hops))
+	for i, p := range rt.hops {
+		parts[i] = proxyURL(*p)
+	}
+	return strings.Join(parts, ",")
+}
+
+// get returns the cached transport for rt, building one if needed.
+func (c *transportCache) get(rt route) (*http.Transport, error) {
+	key := routeKey(rt)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*transportEntry)
+		entry.lastUsed = now
+		c.lru.MoveToFront(el)
+		return entry.transport, nil
+	}
+
+	transport, err := proxyTransport(rt)
+	if err != nil {
+		return nil, err
+	}
+	transport.IdleConnTimeout = c.idle
+
+	entry := &transportEntry{key: key, transport: transport, lastUsed: now}
+	for _, p := range rt.hops {
+		entry.hops = append(entry.hops, p.Address())
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+	return transport, nil
+}
+
+// evict drops every transport whose route goes through addr. It is registered
+// with the manager so connections through evicted proxies are closed.
+func (c *transportCache) evict(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if slices.Contains(el.Value.(*transportEntry).hops, addr) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// closeAll drops every transport.
+func (c *transportCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// len returns the number of cached transports.
+func (c *transportCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// expire drops transports unused since before now-idle. Callers hold c.mu.
+func (c *transportCache) expire(now time.Time) {
+	for el := c.lru.Back(); el != nil; el = c.lru.Back() {
+		if now.Sub(el.Value.(*transportEntry).lastUsed) < c.idle {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+// remove drops an entry and closes its idle connections; requests in flight
+// finish normally. Callers hold c.mu.
+func (c *transportCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*transportEntry)
+	delete(c.entries, entry.key)
+	entry.transport.CloseIdleConnections()
+}
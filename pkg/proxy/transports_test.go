@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"aproxy/pkg/scraper"
+)
+
+// newForwardProxy starts a minimal HTTP forward proxy for absolute-URL requests.
+func newForwardProxy(t testing.TB) *scraper.Proxy {
+	t.Helper()
+	transport := &http.Transport{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := r.Clone(r.Context())
+		req.RequestURI = ""
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(func() {
+		upstream.Close()
+		transport.CloseIdleConnections()
+	})
+
+	host, portStr, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return &scraper.Proxy{Host: host, Port: port, Type: "http"}
+}
+
+func TestTransportCache(t *testing.T) {
+	a := route{hops: []*scraper.Proxy{{Host: "10.0.0.1", Port: 80, Type: "http"}}}
+	b := route{hops: []*scraper.Proxy{{Host: "10.0.0.2", Port: 80, Type: "http"}}}
+	chain := route{hops: []*scraper.Proxy{a.hops[0], {Host: "10.0.0.3", Port: 1080, Type: "socks5"}}}
+
+	cache := newTransportCache(2, time.Minute)
+	ta, _ := cache.get(a)
+	if again, _ := cache.get(a); again != ta {
+		t.Fatal("repeat get built a new transport")
+	}
+
+	cache.get(b)
+	cache.get(a) // a is now most recently used
+	cache.get(chain)
+	if cache.len() != 2 {
+		t.Fatalf("len = %d, want 2", cache.len())
+	}
+	if _, ok := cache.entries[routeKey(b)]; ok {
+		t.Error("least recently used route b was not dropped")
+	}
+
+	cache.evict("10.0.0.1:80")
+	if cache.len() != 0 {
+		t.Errorf("evicting a shared hop left %d transports", cache.len())
+	}
+}
+
+// BenchmarkUpstreamTransport compares building a transport per request, as
+// requests used to, with reusing a cached one through the same upstream.
+func BenchmarkUpstreamTransport(b *testing.B) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	rt := route{hops: []*scraper.Proxy{newForwardProxy(b)}}
+	s := &Server{}
+	req := httptest.NewRequest(http.MethodGet, target.URL, nil)
+
+	fetch := func(b *testing.B, transport *http.Transport) {
+		resp, err := s.sendHTTP(context.Background(), req, transport)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	b.Run("per-request", func(b *testing.B) {
+		for b.Loop() {
+			transport, err := proxyTransport(rt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			fetch(b, transport)
+			transport.CloseIdleConnections()
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		cache := newTransportCache(16, time.Minute)
+		defer cache.closeAll()
+		for b.Loop() {
+			transport, err := cache.get(rt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			fetch(b, transport)
+		}
+	})
+}
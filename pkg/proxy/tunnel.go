@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+// tunnelBuckets are the upper bounds of the tunnel duration histogram in /stats.
+var tunnelBuckets = []time.Duration{time.Second, 10 * time.Second, time.Minute, 10 * time.Minute, time.Hour}
+
+// tunnelCloseReason is why a relayed tunnel ended.
+type tunnelCloseReason int
+
+const (
+	tunnelClosed   tunnelCloseReason = iota // both sides finished or one failed
+	tunnelIdle                              // nothing was sent either way for the idle timeout
+	tunnelLifetime                          // the tunnel reached its maximum lifetime
+)
+
+// tunnels bounds relayed tunnels, CONNECT and upgraded connections alike, and
+// measures how long they last.
+type tunnels struct {
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	mu           sync.Mutex
+	closed       int64
+	idleClosed   int64
+	lifetimeHits int64
+	total        time.Duration
+	longest      time.Duration
+	buckets      []int64 // by tunnelBuckets, plus one for longer tunnels
+}
+
+// tunnelStats is a snapshot for /stats.
+type tunnelStats struct {
+	Closed           int64
+	IdleTimeouts     int64
+	LifetimeTimeouts int64
+	AvgDuration      time.Duration
+	MaxDuration      time.Duration
+	Durations        map[string]int64
+}
+
+func newTunnels(cfg config.TunnelConfig) *tunnels {
+	return &tunnels{
+		idleTimeout: cfg.IdleTimeout,
+		maxLifetime: cfg.MaxLifetime,
+		buckets:     make([]int64, len(tunnelBuckets)+1),
+	}
+}
+
+// record counts a tunnel that lasted d and ended for reason.
+func (t *tunnels) record(d time.Duration, reason tunnelCloseReason) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed++
+	switch reason {
+	case tunnelIdle:
+		t.idleClosed++
+	case tunnelLifetime:
+		t.lifetimeHits++
+	}
+	t.total += d
+	t.longest = max(t.longest, d)
+	i := 0
+	for i < len(tunnelBuckets) && d > tunnelBuckets[i] {
+		i++
+	}
+	t.buckets[i]++
+}
+
+func (t *tunnels) stats() tunnelStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := tunnelStats{
+		Closed:           t.closed,
+		IdleTimeouts:     t.idleClosed,
+		LifetimeTimeouts: t.lifetimeHits,
+		MaxDuration:      t.longest,
+		Durations:        make(map[string]int64, len(t.buckets)),
+	}
+	if t.closed > 0 {
+		st.AvgDuration = t.total / time.Duration(t.closed)
+	}
+	for i, n := range t.buckets {
+		label := "+Inf"
+		if i < len(tunnelBuckets) {
+			label = tunnelBuckets[i].String()
+		}
+		st.Durations[label] = n
+	}
+	return st
+}
+
+// closeWriter is a connection that can half-close, telling the peer no more
+// data is coming while still reading its reply.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies between the client and the upstream until both directions
+// finish, counting bytes sent to the client. When one side stops sending, the
+// other is half-closed so it can still answer. The tunnel is torn down if
+// nothing moves either way for the idle timeout, or when it reaches its
+// maximum lifetime.
+func (s *Server) relay(clientConn net.Conn, upstreamConn io.ReadWriteCloser) {
+	start := time.Now()
+	var lastActive atomic.Int64
+	lastActive.Store(start.UnixNano())
+
+	var (
+		once   sync.Once
+		reason = tunnelClosed
+	)
+	teardown := func(why tunnelCloseReason) {
+		once.Do(func() {
+			reason = why
+			clientConn.Close()
+			upstreamConn.Close()
+		})
+	}
+
+	if s.tunnels.maxLifetime > 0 {
+		lifetime := time.AfterFunc(s.tunnels.maxLifetime, func() { teardown(tunnelLifetime) })
+		defer lifetime.Stop()
+	}
+	if idle := s.tunnels.idleTimeout; idle > 0 {
+		var watchdog *time.Timer
+		watchdog = time.AfterFunc(idle, func() {
+			quiet := time.Since(time.Unix(0, lastActive.Load()))
+			if quiet >= idle {
+				teardown(tunnelIdle)
+				return
+			}
+			watchdog.Reset(idle - quiet)
+		})
+		defer watchdog.Stop()
+	}
+
+	// Use channels to coordinate bidirectional copying
+	done := make(chan struct{}, 2)
+	pipe := func(dst io.WriteCloser, src io.Reader, written *int64) {
+		defer func() { done <- struct{}{} }()
+		n, err := io.Copy(dst, &activityReader{Reader: src, last: &lastActive})
+		*written = n
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		// Without half-close, or after a failure, the whole tunnel is done
+		teardown(tunnelClosed)
+	}
+
+	var sent, received int64
+	go pipe(upstreamConn, clientConn, &sent)
+	go pipe(clientConn, upstreamConn, &received)
+
+	// Wait for both goroutines to complete
+	<-done
+	<-done
+	teardown(tunnelClosed)
+
+	s.addBytesTransferred(received)
+	s.tunnels.record(time.Since(start), reason)
+}
+
+// activityReader stamps the time of every successful read into last.
+type activityReader struct {
+	io.Reader
+	last *atomic.Int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { dialed.Close(); conn.Close() })
+	return dialed, conn
+}
+
+// startRelay relays between two fresh connections and returns the client's
+// and upstream's far ends, and a channel closed when the relay returns.
+func startRelay(t *testing.T, s *Server) (client, upstream net.Conn, done chan struct{}) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+	done = make(chan struct{})
+	go func() {
+		s.relay(clientSide, upstreamSide)
+		close(done)
+	}()
+	return client, upstream, done
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	s := &Server{stats: &Stats{}, tunnels: newTunnels(config.TunnelConfig{IdleTimeout: time.Minute})}
+	client, upstream, done := startRelay(t, s)
+	upstream.SetDeadline(time.Now().Add(5 * time.Second))
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The client sends its request and stops writing
+	io.WriteString(client, "request")
+	client.(*net.TCPConn).CloseWrite()
+
+	got, err := io.ReadAll(upstream)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("upstream read %q, %v; want the request then EOF", got, err)
+	}
+	// The reply still reaches the client after its half-close
+	io.WriteString(upstream, "reply")
+	upstream.Close()
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "reply" {
+		t.Fatalf("client read %q, %v; want the reply", got, err)
+	}
+
+	<-done
+	if st := s.tunnels.stats(); st.Closed != 1 || st.IdleTimeouts != 0 || st.Durations["1s"] != 1 {
+		t.Errorf("stats = %+v, want one short tunnel closed normally", st)
+	}
+	if got := s.getStats().BytesTransferred; got != int64(len("reply")) {
+		t.Errorf("bytes transferred = %d, want %d", got, len("reply"))
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	s := &Server{stats: &Stats{}, tunnels: newTunnels(config.TunnelConfig{IdleTimeout: 100 * time.Millisecond})}
+	client, upstream, done := startRelay(t, s)
+
+	// Traffic keeps the tunnel open past the idle timeout
+	buf := make([]byte, 4)
+	for range 4 {
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(client, "ping")
+		upstream.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(upstream, buf); err != nil {
+			t.Fatalf("tunnel closed while active: %v", err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle tunnel was not closed")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(buf); err == nil {
+		t.Error("client connection still open after idle timeout")
+	}
+	if st := s.tunnels.stats(); st.Closed != 1 || st.IdleTimeouts != 1 {
+		t.Errorf("stats = %+v, want one idle timeout", st)
+	}
+}
+
+func TestRelayMaxLifetime(t *testing.T) {
+	s := &Server{stats: &Stats{}, tunnels: newTunnels(config.TunnelConfig{IdleTimeout: time.Minute, MaxLifetime: 100 * time.Millisecond})}
+	_, _, done := startRelay(t, s)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel outlived its maximum lifetime")
+	}
+	if st := s.tunnels.stats(); st.LifetimeTimeouts != 1 {
+		t.Errorf("stats = %+v, want one lifetime timeout", st)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// upgradeTimeout bounds the handshake of an upgrade request; the upgraded
+// connection is bounded like a tunnel.
+const upgradeTimeout = 30 * time.Second
+
+// isUpgrade reports whether r asks to switch protocols, as WebSocket
+// handshakes do.
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// send sends a sanitized copy of r through transport: upgrade requests
+// without the client timeout, since a 101 response carries the upgraded
+// connection as its body.
+func (s *Server) send(r *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	if !isUpgrade(r) {
+		return s.sendHTTP(r.Context(), r, transport)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	handshake := time.AfterFunc(upgradeTimeout, cancel)
+	defer handshake.Stop()
+
+	req := r.Clone(ctx)
+	req.RequestURI = ""
+	s.sanitizeRequest(req)
+	return transport.RoundTrip(req)
+}
+
+// relayUpgrade answers the client with a 101 response from upstream and
+// relays both directions of the upgraded connection.
+func (s *Server) relayUpgrade(w http.ResponseWriter, resp *http.Response, reqID string) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		s.httpLogger.Error(reqID, "Upgraded response body is not writable")
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.httpLogger.Error(reqID, "Hijacking not supported")
+		return
+	}
+	clientConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		s.httpLogger.Error(reqID, "Hijacking failed: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	s.sanitizeResponse(resp)
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		return
+	}
+
+	s.httpLogger.Debug(reqID, "Switched protocols to %s", resp.Header.Get("Upgrade"))
+	s.incrementRequestsHandled()
+	// The client may already have sent data after its handshake
+	s.relay(&bufferedConn{Conn: clientConn, reader: buffered.Reader}, upstream)
+}
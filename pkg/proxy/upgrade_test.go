@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aproxy/internal/config"
+	"aproxy/pkg/rules"
+)
+
+// newUpgradeEcho starts a server speaking an echo protocol: after the 101,
+// every byte is sent back.
+func newUpgradeEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buffered.Flush()
+		io.Copy(conn, buffered)
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+// newUpgradeProxy starts an HTTP forward proxy that passes upgrades through
+// and counts the requests it forwards.
+func newUpgradeProxy(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	forward := &httputil.ReverseProxy{Rewrite: func(*httputil.ProxyRequest) {}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		forward.ServeHTTP(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.Listener.Addr().String(), &hits
+}
+
+func TestUpgradePassthrough(t *testing.T) {
+	target := newUpgradeEcho(t)
+
+	t.Run("direct", func(t *testing.T) {
+		s := newDirectServer(t, config.ServerConfig{}, &http.Transport{})
+		assertUpgradeEcho(t, s, target)
+	})
+
+	t.Run("upstream proxy", func(t *testing.T) {
+		addr, hits := newUpgradeProxy(t)
+		engine, err := rules.NewEngine(
+			[]config.RuleConfig{{Action: "upstream", Upstream: "static"}},
+			[]config.UpstreamConfig{{Name: "static", Proxies: []string{addr}}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newDirectServer(t, config.ServerConfig{}, &http.Transport{})
+		s.rules = engine
+		s.transports = newTransportCache(10, time.Minute)
+		defer s.transports.closeAll()
+		assertUpgradeEcho(t, s, target)
+		if hits.Load() != 1 {
+			t.Errorf("upstream proxy forwarded %d requests, want the upgrade", hits.Load())
+		}
+	})
+}
+
+// assertUpgradeEcho upgrades a connection to target through s, echoes data
+// both ways and checks that s counted the request and its bytes.
+func assertUpgradeEcho(t *testing.T, s *Server, target *httptest.Server) {
+	t.Helper()
+	front := httptest.NewServer(s)
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	host := strings.TrimPrefix(target.URL, "http://")
+	// Data sent right behind the handshake must not be lost
+	io.WriteString(conn, "GET "+target.URL+"/echo HTTP/1.1\r\nHost: "+host+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nping")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("got %s with Upgrade %q, want 101 echo", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v; want the early data echoed", buf, err)
+	}
+	io.WriteString(conn, "pong")
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read %q, %v; want pong echoed", buf, err)
+	}
+
+	conn.Close()
+	// The relay adds its bytes once both directions have closed
+	waitFor(t, func() bool { return s.getStats().BytesTransferred >= 8 })
+	if stats := s.getStats(); stats.RequestsHandled != 1 {
+		t.Errorf("stats = %d requests; want 1", stats.RequestsHandled)
+	}
+}
@@ -0,0 +1,303 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"aproxy/internal/config"
+	"aproxy/internal/logger"
+	"aproxy/pkg/manager"
+	"aproxy/pkg/scraper"
+)
+
+// Action is what the server does with a request matched by a rule.
+type Action string
+
+const (
+	ActionPool     Action = "pool"     // scraped pool, optionally filtered
+	ActionDirect   Action = "direct"   // connect to the target without a proxy
+	ActionUpstream Action = "upstream" // a named upstream group from config
+	ActionChain    Action = "chain"    // one proxy from each of several groups, in order
+	ActionReject   Action = "reject"   // refuse with 403
+)
+
+// Decision is the routing outcome for one request.
+type Decision struct {
+	Rule   string // name of the matching rule, "" for the default
+	Action Action
+	Filter manager.ProxyFilter // for ActionPool
+	Chain  []*Upstream         // hops for ActionUpstream (one) and ActionChain, client side first
+	// Session keeps one pool proxy per client for ActionPool. The server sets
+	// it from a listener port's preset; rules never do.
+	Session string
+}
+
+// defaultDecision applies when no rule matches: the unfiltered pool.
+var defaultDecision = Decision{Action: ActionPool}
+
+// Upstream is a named upstream group: a fixed list of proxies used in
+// rotation, or, with Pool set, the scraped pool narrowed by Filter.
+type Upstream struct {
+	Name    string
+	Pool    bool
+	Filter  manager.ProxyFilter
+	proxies []scraper.Proxy
+	next    atomic.Uint64
+}
+
+// Next returns a static group's next proxy in round-robin order. Pool groups
+// are selected by the caller from the manager.
+func (u *Upstream) Next() (*scraper.Proxy, error) {
+	if len(u.proxies) == 0 {
+		return nil, fmt.Errorf("upstream %q has no proxies", u.Name)
+	}
+	i := u.next.Add(1) - 1
+	p := u.proxies[i%uint64(len(u.proxies))]
+	return &p, nil
+}
+
+type portRange struct{ lo, hi int }
+
+type rule struct {
+	name     string
+	suffixes []string
+	globs    []string
+	regexes  []*regexp.Regexp
+	nets     []*net.IPNet
+	ports    []portRange
+	decision Decision
+}
+
+// matches reports whether the rule applies to host:port. host is normalized.
+func (r *rule) matches(host string, port int) bool {
+	if len(r.ports) > 0 {
+		inRange := false
+		for _, pr := range r.ports {
+			if port >= pr.lo && port <= pr.hi {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	if len(r.suffixes) == 0 && len(r.globs) == 0 && len(r.regexes) == 0 && len(r.nets) == 0 {
+		return true
+	}
+
+	for _, suffix := range r.suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	for _, glob := range r.globs {
+		if ok, _ := path.Match(glob, host); ok {
+			return true
+		}
+	}
+	for _, re := range r.regexes {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	// CIDRs only match IP-literal hosts; names are not resolved.
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Engine evaluates routing rules in order. The rule set can be replaced at
+// runtime with Update; a nil *Engine routes everything to the pool.
+type Engine struct {
+	rules  atomic.Pointer[[]rule]
+	logger *logger.Logger
+}
+
+// NewEngine compiles the configured rules and upstreams.
+func NewEngine(rules []config.RuleConfig, upstreams []config.UpstreamConfig) (*Engine, error) {
+	e := &Engine{logger: logger.New("rules")}
+	if err := e.Update(rules, upstreams); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Update compiles and swaps in a new rule set. On error the old set stays active.
+func (e *Engine) Update(rules []config.RuleConfig, upstreams []config.UpstreamConfig) error {
+	named := make(map[string]*Upstream, len(upstreams))
+	for _, uc := range upstreams {
+		u, err := compileUpstream(uc)
+		if err != nil {
+			return err
+		}
+		if _, dup := named[u.Name]; dup {
+			return fmt.Errorf("duplicate upstream %q", u.Name)
+		}
+		named[u.Name] = u
+	}
+
+	compiled := make([]rule, 0, len(rules))
+	for i, rc := range rules {
+		r, err := compileRule(rc, named)
+		if err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i+1, rc.Name, err)
+		}
+		compiled = append(compiled, r)
+	}
+
+	e.rules.Store(&compiled)
+	e.logger.InfoBg("Loaded %d routing rules and %d upstreams", len(compiled), len(named))
+	return nil
+}
+
+// Match returns the decision of the first rule matching host:port.
+func (e *Engine) Match(host string, port int) Decision {
+	if e == nil {
+		return defaultDecision
+	}
+
+	host = normalizeHost(host)
+	rules := *e.rules.Load()
+	for i := range rules {
+		r := &rules[i]
+		if r.matches(host, port) {
+			return r.decision
+		}
+	}
+	return defaultDecision
+}
+
+// MatchHostPort is Match for a "host:port" (or bare host) target, using
+// defaultPort when none is given.
+func (e *Engine) MatchHostPort(hostport string, defaultPort int) Decision {
+	host, port := SplitHostPort(hostport, defaultPort)
+	return e.Match(host, port)
+}
+
+// SplitHostPort splits a request target, falling back to defaultPort.
+func SplitHostPort(hostport string, defaultPort int) (string, int) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, defaultPort
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, defaultPort
+	}
+	return host, port
+}
+
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.Trim(host, "[]")
+}
+
+func compileUpstream(uc config.UpstreamConfig) (*Upstream, error) {
+	u := &Upstream{Name: uc.Name}
+	if uc.Type == "pool" {
+		u.Pool = true
+		u.Filter = manager.NewProxyFilter(uc.Filter)
+		return u, nil
+	}
+	for _, entry := range uc.Proxies {
+		parsed, _ := scraper.ParseList(strings.NewReader(entry), "http")
+		if len(parsed) != 1 {
+			return nil, fmt.Errorf("upstream %q: invalid proxy %q", uc.Name, entry)
+		}
+		parsed[0].TLS = parsed[0].Type == "https"
+		parsed[0].VerifyTLS = !uc.InsecureSkipVerify
+		u.proxies = append(u.proxies, parsed[0])
+	}
+	return u, nil
+}
+
+func compileRule(rc config.RuleConfig, upstreams map[string]*Upstream) (rule, error) {
+	r := rule{
+		name: rc.Name,
+		decision: Decision{
+			Rule:   rc.Name,
+			Action: Action(rc.Action),
+			Filter: manager.NewProxyFilter(rc.Filter),
+		},
+	}
+
+	for _, d := range rc.Domains {
+		r.suffixes = append(r.suffixes, strings.TrimPrefix(normalizeHost(d), "."))
+	}
+	for _, g := range rc.Globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return r, fmt.Errorf("invalid glob %q: %w", g, err)
+		}
+		r.globs = append(r.globs, strings.ToLower(g))
+	}
+	for _, expr := range rc.Regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return r, fmt.Errorf("invalid regex %q: %w", expr, err)
+		}
+		r.regexes = append(r.regexes, re)
+	}
+	for _, c := range rc.CIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return r, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		r.nets = append(r.nets, n)
+	}
+	for _, p := range rc.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return r, err
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	var groups []string
+	switch r.decision.Action {
+	case ActionUpstream:
+		groups = []string{rc.Upstream}
+	case ActionChain:
+		groups = rc.Chain
+	}
+	for _, name := range groups {
+		u, ok := upstreams[name]
+		if !ok {
+			return r, fmt.Errorf("unknown upstream %q", name)
+		}
+		r.decision.Chain = append(r.decision.Chain, u)
+	}
+
+	return r, nil
+}
+
+// parsePortRange parses "443" or "8000-8100".
+func parsePortRange(s string) (portRange, error) {
+	lo, hi, err := ParsePortRange(s)
+	return portRange{lo, hi}, err
+}
+
+// ParsePortRange parses a port ("443") or an inclusive range ("8000-8100").
+func ParsePortRange(s string) (lo, hi int, err error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hiStr = loStr
+	}
+	lo, err1 := strconv.Atoi(strings.TrimSpace(loStr))
+	hi, err2 := strconv.Atoi(strings.TrimSpace(hiStr))
+	if err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port or range %q", s)
+	}
+	return lo, hi, nil
+}
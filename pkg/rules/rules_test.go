@@ -0,0 +1,99 @@
+package rules
+
+import (
+	"testing"
+
+	"aproxy/internal/config"
+)
+
+func TestEngineMatch(t *testing.T) {
+	engine, err := NewEngine([]config.RuleConfig{
+		{Name: "internal", Domains: []string{"corp.internal"}, CIDRs: []string{"10.0.0.0/8"}, Action: "direct"},
+		{Name: "ads", Globs: []string{"ads.*"}, Action: "reject"},
+		{Name: "api", Regexes: []string{`^api[0-9]+\.example\.com$`}, Ports: []string{"443", "8000-8100"}, Action: "upstream", Upstream: "corp"},
+		{Name: "chained", Domains: []string{"example.net"}, Action: "chain", Chain: []string{"corp", "premium"}},
+		{Name: "smtp", Ports: []string{"25"}, Action: "reject"},
+	}, []config.UpstreamConfig{
+		{Name: "corp", Proxies: []string{"http://10.1.1.1:3128"}},
+		{Name: "premium", Type: "pool", Filter: config.FilterConfig{Countries: []string{"US"}}},
+	})
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+
+	cases := []struct {
+		host string
+		port int
+		want string // rule name, "" for the default
+	}{
+		{"corp.internal", 443, "internal"},
+		{"git.CORP.internal.", 80, "internal"},
+		{"notcorp.internal", 80, ""},
+		{"10.2.3.4", 80, "internal"},
+		{"[::1]", 80, ""},
+		{"ads.example.com", 443, "ads"},
+		{"api1.example.com", 443, "api"},
+		{"api1.example.com", 8050, "api"},
+		{"api1.example.com", 80, ""},
+		{"mail.example.com", 25, "smtp"},
+		{"www.example.net", 443, "chained"},
+	}
+
+	for _, c := range cases {
+		got := engine.Match(c.host, c.port)
+		if got.Rule != c.want {
+			t.Errorf("Match(%q, %d) = rule %q, want %q", c.host, c.port, got.Rule, c.want)
+		}
+	}
+
+	if d := engine.Match("api1.example.com", 443); len(d.Chain) != 1 || d.Chain[0].Name != "corp" {
+		t.Errorf("api rule did not resolve upstream corp: %+v", d)
+	}
+	if d := engine.Match("example.net", 443); len(d.Chain) != 2 || d.Chain[0].Pool || !d.Chain[1].Pool {
+		t.Errorf("chained rule did not resolve corp -> premium: %+v", d)
+	}
+}
+
+func TestEngineUpdate(t *testing.T) {
+	engine, err := NewEngine([]config.RuleConfig{{Domains: []string{"example.com"}, Action: "reject"}}, nil)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+
+	// A valid reload takes effect at once
+	err = engine.Update([]config.RuleConfig{
+		{Name: "internal", Domains: []string{"corp.internal"}, Action: "direct"},
+		{Name: "partner", Domains: []string{"partner.example"}, Action: "upstream", Upstream: "corp"},
+	}, []config.UpstreamConfig{{Name: "corp", Proxies: []string{"http://10.1.1.1:3128"}}})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if d := engine.Match("example.com", 443); d.Action != ActionPool {
+		t.Errorf("example.com after reload: %s, want the old rule gone", d.Action)
+	}
+	if d := engine.Match("corp.internal", 443); d.Rule != "internal" || d.Action != ActionDirect {
+		t.Errorf("corp.internal after reload: %+v, want rule internal", d)
+	}
+
+	// An invalid one is refused whole and the previous rules stay
+	invalid := []struct {
+		name      string
+		rules     []config.RuleConfig
+		upstreams []config.UpstreamConfig
+	}{
+		{"unknown upstream", []config.RuleConfig{{Domains: []string{"a.example"}, Action: "upstream", Upstream: "missing"}}, nil},
+		{"bad regex", []config.RuleConfig{{Regexes: []string{"("}, Action: "reject"}}, nil},
+		{"duplicate upstream", nil, []config.UpstreamConfig{
+			{Name: "corp", Proxies: []string{"http://10.1.1.1:3128"}},
+			{Name: "corp", Proxies: []string{"http://10.1.1.2:3128"}},
+		}},
+	}
+	for _, c := range invalid {
+		if err := engine.Update(c.rules, c.upstreams); err == nil {
+			t.Errorf("%s: Update accepted it", c.name)
+		}
+		if d := engine.Match("partner.example", 443); d.Rule != "partner" || len(d.Chain) != 1 || d.Chain[0].Name != "corp" {
+			t.Errorf("%s: partner.example = %+v, want the previous rules kept", c.name, d)
+		}
+	}
+}
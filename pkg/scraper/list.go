@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -103,10 +104,16 @@ func (s *listScraper) fetch(ctx context.Context, url string) ([]Proxy, error) {
 		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
 	}
 
+	return ParseList(resp.Body, s.src.defaultType)
+}
+
+// ParseList reads a plain-text proxy list, one "proto://host:port" or
+// "host:port" per line, skipping lines parseLine rejects.
+func ParseList(r io.Reader, defaultType string) ([]Proxy, error) {
 	var proxies []Proxy
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		if p, ok := parseLine(scanner.Text(), s.src.defaultType); ok {
+		if p, ok := parseLine(scanner.Text(), defaultType); ok {
 			proxies = append(proxies, p)
 		}
 	}
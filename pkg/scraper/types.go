@@ -12,6 +12,18 @@ type Proxy struct {
 	Type     string
 	Country  string
 	LastSeen time.Time
+
+	// Health metadata filled in from checks and the database; zero when unknown.
+	Anonymity   string
+	Latency     time.Duration
+	SuccessRate float64 // fraction of recorded checks that passed, 0..1
+
+	// TLS is set for proxies spoken to over TLS: "https://" upstream entries,
+	// and pool proxies the checker found expecting TLS. Scraped lists also call
+	// plain HTTP proxies that support CONNECT "https", so the type alone
+	// doesn't imply it. VerifyTLS checks the proxy's certificate against Host.
+	TLS       bool
+	VerifyTLS bool
 }
 
 func (p Proxy) Address() string {